@@ -0,0 +1,338 @@
+package encrepo
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	sqlds "github.com/ipfs/go-ds-sql"
+	sqliteds "github.com/ipfs/go-ds-sql/sqlite"
+	sqlite3 "github.com/mutecomm/go-sqlcipher/v4"
+	"github.com/pkg/errors"
+)
+
+// BackupProgressFunc is called as a backup or a restore progresses, with
+// the number of bytes copied and the total, -1 if unknown.
+type BackupProgressFunc func(done, total int64)
+
+// BackupOptions are the options of Repo.Backup.
+type BackupOptions struct {
+	// Key is the key of the backup, nil keeps the key of the repo. A
+	// plaintext repo can't be backed up encrypted.
+	Key []byte
+	// PagesPerStep is the number of pages copied at each step, zero is 1024
+	// and a negative number copies all the pages at once. The repo isn't
+	// locked between the steps, but the writes made by the other connections
+	// restart the backup.
+	PagesPerStep int
+	// Progress is called after each step.
+	Progress BackupProgressFunc
+}
+
+const defaultBackupPagesPerStep = 1024
+
+// backupBusyDelay is the wait before retrying a step that made no progress
+const backupBusyDelay = 10 * time.Millisecond
+
+// Backup writes a consistent snapshot of the main database of the repo at
+// dstPath with the SQLite online backup API, while the repo stays usable.
+// The backup has the cipher settings of the repo and is keyed with
+// opts.Key if set, it can be opened directly or installed with Restore. An
+// existing file at dstPath is atomically replaced. The separate database
+// files mounted by Config.Datastore.Spec are not backed up.
+func (r *encRepo) Backup(ctx context.Context, dstPath string, opts BackupOptions) error {
+	// the database can't be rekeyed or closed during the backup
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.closed {
+		return errors.New("repo is closed")
+	}
+
+	return backupDBTo(ctx, r.store.db, r.path, dstPath, opts)
+}
+
+// backupDBTo backs up db, the database at dbPath, to dstPath through a
+// temporary file
+func backupDBTo(ctx context.Context, db *sqlcipherDB, dbPath, dstPath string, opts BackupOptions) error {
+	if filepath.Clean(dstPath) == filepath.Clean(dbPath) {
+		return errors.New("the backup path is the repo database")
+	}
+
+	tmpPath := dstPath + ".backup"
+	if err := removeDBFiles(tmpPath); err != nil {
+		return errors.Wrap(err, "remove stale temporary backup")
+	}
+
+	if err := backupDB(ctx, db, tmpPath, opts); err != nil {
+		_ = removeDBFiles(tmpPath)
+		return err
+	}
+
+	if err := syncFile(tmpPath); err != nil {
+		_ = removeDBFiles(tmpPath)
+		return errors.Wrap(err, "sync backup")
+	}
+	if err := os.Rename(tmpPath, dstPath); err != nil {
+		_ = removeDBFiles(tmpPath)
+		return errors.Wrap(err, "rename backup")
+	}
+	return nil
+}
+
+// BackupTo is like Backup but writes the backup to w. The backup is made in
+// a temporary file next to the repo database first.
+func (r *encRepo) BackupTo(ctx context.Context, w io.Writer, opts BackupOptions) error {
+	f, err := os.CreateTemp(filepath.Dir(r.path), filepath.Base(r.path)+".backup-*")
+	if err != nil {
+		return errors.Wrap(err, "create temporary backup")
+	}
+	tmpPath := f.Name()
+	defer os.Remove(tmpPath)
+	if err := f.Close(); err != nil {
+		return errors.Wrap(err, "create temporary backup")
+	}
+
+	if err := r.Backup(ctx, tmpPath, opts); err != nil {
+		return err
+	}
+
+	f, err = os.Open(tmpPath)
+	if err != nil {
+		return errors.Wrap(err, "open backup")
+	}
+	defer f.Close()
+	if _, err := io.Copy(w, f); err != nil {
+		return errors.Wrap(err, "write backup")
+	}
+	return nil
+}
+
+// backupDB copies db to a new database at dstPath
+func backupDB(ctx context.Context, db *sqlcipherDB, dstPath string, opts BackupOptions) error {
+	key := db.connector.keyCopy()
+	defer func() { key.Close() }()
+
+	if len(opts.Key) != 0 {
+		if key == nil {
+			return errors.New("a plaintext repo can't be backed up encrypted")
+		}
+		key.Close()
+		key = newSecret(opts.Key)
+	}
+
+	// the backup copies the pages, the cipher settings must be the same
+	dstOpts := db.connector.opts
+	dstOpts.JournalMode = ""
+	dstOpts.ReadOnly = false
+	connector, err := newSQLCipherConnector("sqlite3", dstPath, key.Bytes(), dstOpts)
+	if err != nil {
+		return err
+	}
+	defer connector.Close()
+	dstConn, err := connector.Connect(ctx)
+	if err != nil {
+		return errors.Wrap(err, "open backup")
+	}
+	defer dstConn.Close()
+	dst, ok := dstConn.(*sqlite3.SQLiteConn)
+	if !ok {
+		return errors.New("driver doesn't support backups")
+	}
+
+	srcConn, err := db.Conn(ctx)
+	if err != nil {
+		return errors.Wrap(err, "get connection")
+	}
+	defer srcConn.Close()
+
+	var pageSize int64
+	if err := srcConn.QueryRowContext(ctx, "PRAGMA page_size").Scan(&pageSize); err != nil {
+		return errors.Wrap(err, "read page size")
+	}
+
+	pagesPerStep := opts.PagesPerStep
+	if pagesPerStep == 0 {
+		pagesPerStep = defaultBackupPagesPerStep
+	}
+	progress := opts.Progress
+	if progress == nil {
+		progress = func(int64, int64) {}
+	}
+
+	return srcConn.Raw(func(driverConn interface{}) error {
+		src, ok := driverConn.(*sqlite3.SQLiteConn)
+		if !ok {
+			return errors.New("driver doesn't support backups")
+		}
+
+		b, err := dst.Backup("main", src, "main")
+		if err != nil {
+			return errors.Wrap(err, "start backup")
+		}
+
+		remaining := -1
+		for {
+			done, err := b.Step(pagesPerStep)
+			if err != nil {
+				_ = b.Finish()
+				return errors.Wrap(err, "backup")
+			}
+			total := int64(b.PageCount())
+			progress((total-int64(b.Remaining()))*pageSize, total*pageSize)
+			if done {
+				break
+			}
+
+			if b.Remaining() == remaining {
+				// the database is locked
+				time.Sleep(backupBusyDelay)
+			}
+			remaining = b.Remaining()
+
+			if err := ctx.Err(); err != nil {
+				_ = b.Finish()
+				return err
+			}
+		}
+
+		return errors.Wrap(b.Finish(), "finish backup")
+	})
+}
+
+// Restore replaces the repo at dbPath, if any, with the backup at srcPath
+// created by Repo.Backup. key and opts are the ones of the backup, they
+// become the ones of the repo. The repo must not be open in this process.
+//
+// The backup is copied next to the repo and verified before it atomically
+// replaces the repo database, on failure the repo is left untouched. The key
+// slots, KDF descriptor and duress key of the replaced repo are then
+// crypto-erased, they refer to its key.
+func Restore(srcPath, dbPath string, key []byte, opts SQLCipherDatastoreOptions, progress BackupProgressFunc) error {
+	f, err := os.Open(srcPath)
+	if err != nil {
+		return errors.Wrap(err, "open backup")
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return errors.Wrap(err, "stat backup")
+	}
+
+	return restore(f, fi.Size(), dbPath, key, opts, progress)
+}
+
+// RestoreFrom is like Restore but reads the backup from src.
+func RestoreFrom(src io.Reader, dbPath string, key []byte, opts SQLCipherDatastoreOptions, progress BackupProgressFunc) error {
+	return restore(src, -1, dbPath, key, opts, progress)
+}
+
+func restore(src io.Reader, size int64, dbPath string, key []byte, opts SQLCipherDatastoreOptions, progress BackupProgressFunc) error {
+	if progress == nil {
+		progress = func(int64, int64) {}
+	}
+	opts.ReadOnly = false
+
+	return onlyOne.WithClosed(dbPath, func() error {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		fileLock, err := lockRepoExclusive(ctx, dbPath, opts.LockTimeout)
+		if err != nil {
+			return err
+		}
+		defer fileLock.Close()
+
+		tmpPath := dbPath + ".restore"
+		if err := removeDBFiles(tmpPath); err != nil {
+			return errors.Wrap(err, "remove stale temporary database")
+		}
+
+		if err := restoreDB(ctx, src, size, tmpPath, key, opts, progress); err != nil {
+			_ = removeDBFiles(tmpPath)
+			return err
+		}
+
+		if err := swapDB(tmpPath, dbPath); err != nil {
+			_ = removeDBFiles(tmpPath)
+			return err
+		}
+
+		for _, path := range keyMaterialPaths(dbPath) {
+			if err := overwriteFile(path, -1); err != nil {
+				return err
+			}
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return errors.Wrap(err, "remove key material")
+			}
+		}
+		return nil
+	})
+}
+
+// restoreDB copies the backup to tmpPath and verifies it
+func restoreDB(ctx context.Context, src io.Reader, size int64, tmpPath string, key []byte, opts SQLCipherDatastoreOptions, progress BackupProgressFunc) error {
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return errors.Wrap(err, "create temporary database")
+	}
+	_, err = io.Copy(f, &progressReader{r: src, total: size, progress: progress})
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return errors.Wrap(err, "copy backup")
+	}
+
+	db, connector, err := openSQLCipherDB(ctx, "sqlite3", tmpPath, key, opts)
+	if err != nil {
+		return errors.Wrap(err, "open backup")
+	}
+	err = checkBackup(ctx, &sqlcipherDB{DB: db, connector: connector})
+	// closing the last connection checkpoints and removes the WAL
+	if cerr := db.Close(); err == nil && cerr != nil {
+		err = errors.Wrap(cerr, "close backup")
+	}
+	return err
+}
+
+// checkBackup checks the integrity of the backup and that it's a repo
+func checkBackup(ctx context.Context, db *sqlcipherDB) error {
+	report, err := verifyDB(ctx, db)
+	if err != nil {
+		return errors.Wrap(err, "verify backup")
+	}
+	if len(report.BadPages) != 0 || len(report.Errors) != 0 {
+		return fmt.Errorf("%w: backup failed the integrity checks", ErrCorrupt)
+	}
+
+	conf, err := getConfigFromDatastore(ctx, sqlds.NewDatastore(db.DB, sqliteds.NewQueries(tableName)))
+	if err != nil {
+		return errors.Wrap(err, "get backup config")
+	}
+	if conf == nil {
+		return errors.New("backup is not an initialized repo")
+	}
+	return nil
+}
+
+// progressReader reports the bytes read
+type progressReader struct {
+	r        io.Reader
+	done     int64
+	total    int64
+	progress BackupProgressFunc
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.done += int64(n)
+		r.progress(r.done, r.total)
+	}
+	return n, err
+}
@@ -0,0 +1,115 @@
+package encrepo
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+	config "github.com/ipfs/kubo/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackup(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	key := testingKey(t)
+	opts := SQLCipherDatastoreOptions{JournalMode: "WAL"}
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "db.sqlite")
+	require.NoError(t, Init(dbPath, key, opts, &config.Config{}))
+
+	r, err := Open(dbPath, key, opts)
+	require.NoError(t, err)
+	defer requireClose(t, r)
+	require.NoError(t, r.Datastore().Put(ctx, datastore.NewKey("/foo"), []byte("foo")))
+
+	t.Log("backup the open repo")
+	backupPath := filepath.Join(dir, "backup.sqlite")
+	var done, total int64
+	require.NoError(t, r.(Repo).Backup(ctx, backupPath, BackupOptions{
+		PagesPerStep: 1,
+		Progress:     func(d, t int64) { done, total = d, t },
+	}))
+	require.NotZero(t, total)
+	require.Equal(t, total, done)
+	require.NoError(t, r.Datastore().Put(ctx, datastore.NewKey("/bar"), []byte("bar")))
+
+	t.Log("restore the backup")
+	restoredPath := filepath.Join(dir, "restored.sqlite")
+	require.NoError(t, Restore(backupPath, restoredPath, key, opts, nil))
+	restored, err := Open(restoredPath, key, opts)
+	require.NoError(t, err)
+	val, err := restored.Datastore().Get(ctx, datastore.NewKey("/foo"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("foo"), val)
+	_, err = restored.Datastore().Get(ctx, datastore.NewKey("/bar"))
+	require.ErrorIs(t, err, datastore.ErrNotFound)
+
+	t.Log("the repo must be closed")
+	require.ErrorIs(t, Restore(backupPath, restoredPath, key, opts, nil), ErrRepoOpen)
+	require.NoError(t, restored.Close())
+
+	t.Log("rekeyed backup")
+	backupKey := testingKey(t)
+	buf := &bytes.Buffer{}
+	require.NoError(t, r.(Repo).BackupTo(ctx, buf, BackupOptions{Key: backupKey}))
+	err = RestoreFrom(bytes.NewReader(buf.Bytes()), restoredPath, key, opts, nil)
+	require.ErrorIs(t, err, ErrWrongKey)
+	restored, err = Open(restoredPath, key, opts)
+	require.NoError(t, err, "the restored repo was replaced")
+	require.NoError(t, restored.Close())
+	require.NoError(t, SetDuressKey(restoredPath, key, testingKey(t), opts, &config.Config{Datastore: testingDatastoreConfig()}))
+	require.NoError(t, os.WriteFile(KeySlotsPath(restoredPath), []byte("{}"), 0o600))
+
+	done = 0
+	require.NoError(t, RestoreFrom(bytes.NewReader(buf.Bytes()), restoredPath, backupKey, opts, func(d, t int64) { done = d }))
+	require.Equal(t, int64(buf.Len()), done)
+	restored, err = Open(restoredPath, backupKey, opts)
+	require.NoError(t, err)
+	defer requireClose(t, restored)
+	val, err = restored.Datastore().Get(ctx, datastore.NewKey("/bar"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("bar"), val)
+
+	t.Log("the key material of the replaced repo is removed")
+	for _, path := range keyMaterialPaths(restoredPath) {
+		_, err = os.Stat(path)
+		require.True(t, os.IsNotExist(err), path)
+	}
+
+	matches, err := filepath.Glob(filepath.Join(dir, "*.backup*"))
+	require.NoError(t, err)
+	require.Empty(t, matches, "temporary backups")
+}
+
+func TestRestoreInvalid(t *testing.T) {
+	key := testingKey(t)
+	opts := SQLCipherDatastoreOptions{}
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "db.sqlite")
+	require.NoError(t, Init(dbPath, key, opts, &config.Config{}))
+
+	t.Log("not a repo")
+	emptyPath := filepath.Join(dir, "empty.sqlite")
+	db, _, err := openSQLCipherDB(context.Background(), "sqlite3", emptyPath, key, opts)
+	require.NoError(t, err)
+	require.NoError(t, createTable(context.Background(), db, tableName))
+	require.NoError(t, db.Close())
+	require.ErrorContains(t, Restore(emptyPath, dbPath, key, opts, nil), "not an initialized repo")
+
+	t.Log("truncated backup")
+	data, err := os.ReadFile(dbPath)
+	require.NoError(t, err)
+	err = RestoreFrom(bytes.NewReader(data[:len(data)/2]), filepath.Join(dir, "restored.sqlite"), key, opts, nil)
+	require.ErrorIs(t, err, ErrCorrupt)
+	_, err = os.Stat(filepath.Join(dir, "restored.sqlite"))
+	require.True(t, os.IsNotExist(err))
+
+	isInit, err := IsInitialized(dbPath, key, opts)
+	require.NoError(t, err)
+	require.True(t, isInit)
+}
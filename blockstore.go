@@ -0,0 +1,411 @@
+package encrepo
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+
+	"github.com/ipfs/boxo/blockstore"
+	"github.com/ipfs/boxo/datastore/dshelp"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/pkg/errors"
+)
+
+// defaultBlocksTable is the table of the "sqlcipherblocks" datastores
+const defaultBlocksTable = "blocks"
+
+// DefaultDatastoreSpec returns the Config.Datastore.Spec used by Init when
+// the config has none, the blocks are stored in their own table.
+func DefaultDatastoreSpec() map[string]interface{} {
+	return map[string]interface{}{
+		"type": "mount",
+		"mounts": []interface{}{
+			map[string]interface{}{
+				"mountpoint": blockstore.BlockPrefix.String(),
+				"type":       "sqlcipherblocks",
+			},
+			map[string]interface{}{
+				"mountpoint": "/",
+				"type":       "sqlcipher",
+			},
+		},
+	}
+}
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// blocksTable stores blocks by binary multihash. The go-ds-sql tables are
+// keyed by text keys, the base32 encoded multihashes of the blocks would
+// be much larger than the multihashes. It's a rowid table indexed on the
+// multihash, as recommended by SQLite for large rows.
+type blocksTable struct {
+	db    *sql.DB
+	table string
+}
+
+func newBlocksTable(ctx context.Context, db *sql.DB, table string) (*blocksTable, error) {
+	if _, err := db.ExecContext(ctx, fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %[1]s (
+			id INTEGER PRIMARY KEY,
+			mh BLOB NOT NULL,
+			data BLOB NOT NULL
+		);
+		CREATE UNIQUE INDEX IF NOT EXISTS %[1]s_mh ON %[1]s (mh);
+	`, table)); err != nil {
+		return nil, fmt.Errorf("failed to ensure blocks table exists: %w", err)
+	}
+	if err := checkTableSchema(ctx, db, table, "id INTEGER", "mh BLOB", "data BLOB"); err != nil {
+		return nil, err
+	}
+	return &blocksTable{db: db, table: table}, nil
+}
+
+func (t *blocksTable) get(ctx context.Context, mh []byte) ([]byte, error) {
+	var data []byte
+	err := t.db.QueryRowContext(ctx, fmt.Sprintf("SELECT data FROM %s WHERE mh = ?", t.table), mh).Scan(&data)
+	switch err {
+	case nil:
+		return data, nil
+	case sql.ErrNoRows:
+		return nil, ds.ErrNotFound
+	default:
+		return nil, err
+	}
+}
+
+func (t *blocksTable) has(ctx context.Context, mh []byte) (bool, error) {
+	var exists bool
+	err := t.db.QueryRowContext(ctx, fmt.Sprintf("SELECT EXISTS(SELECT 1 FROM %s WHERE mh = ?)", t.table), mh).Scan(&exists)
+	return exists, err
+}
+
+func (t *blocksTable) getSize(ctx context.Context, mh []byte) (int, error) {
+	var size int
+	err := t.db.QueryRowContext(ctx, fmt.Sprintf("SELECT length(data) FROM %s WHERE mh = ?", t.table), mh).Scan(&size)
+	switch err {
+	case nil:
+		return size, nil
+	case sql.ErrNoRows:
+		return -1, ds.ErrNotFound
+	default:
+		return -1, err
+	}
+}
+
+func (t *blocksTable) put(ctx context.Context, e execer, mh, data []byte) error {
+	_, err := e.ExecContext(ctx, fmt.Sprintf(
+		"INSERT INTO %s (mh, data) VALUES (?, ?) ON CONFLICT (mh) DO UPDATE SET data = excluded.data", t.table,
+	), mh, data)
+	return err
+}
+
+func (t *blocksTable) delete(ctx context.Context, e execer, mh []byte) error {
+	_, err := e.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE mh = ?", t.table), mh)
+	return err
+}
+
+// rows returns the rows (mh, data, size), data is NULL if keysOnly
+func (t *blocksTable) rows(ctx context.Context, keysOnly bool) (*sql.Rows, error) {
+	data := "data"
+	if keysOnly {
+		data = "NULL"
+	}
+	return t.db.QueryContext(ctx, fmt.Sprintf("SELECT mh, %s, length(data) FROM %s", data, t.table))
+}
+
+// blocksDatastore exposes a blocks table as a datastore keyed by the
+// dshelp.MultihashToDsKey encoding of the multihashes, as used by boxo's
+// blockstore.
+type blocksDatastore struct {
+	t *blocksTable
+}
+
+var _ ds.Batching = (*blocksDatastore)(nil)
+
+func (d *blocksDatastore) Get(ctx context.Context, key ds.Key) ([]byte, error) {
+	mh, err := dshelp.BinaryFromDsKey(key)
+	if err != nil {
+		return nil, ds.ErrNotFound
+	}
+	return d.t.get(ctx, mh)
+}
+
+func (d *blocksDatastore) Has(ctx context.Context, key ds.Key) (bool, error) {
+	mh, err := dshelp.BinaryFromDsKey(key)
+	if err != nil {
+		return false, nil
+	}
+	return d.t.has(ctx, mh)
+}
+
+func (d *blocksDatastore) GetSize(ctx context.Context, key ds.Key) (int, error) {
+	mh, err := dshelp.BinaryFromDsKey(key)
+	if err != nil {
+		return -1, ds.ErrNotFound
+	}
+	return d.t.getSize(ctx, mh)
+}
+
+func (d *blocksDatastore) Put(ctx context.Context, key ds.Key, value []byte) error {
+	mh, err := blockKey(key)
+	if err != nil {
+		return err
+	}
+	return d.t.put(ctx, d.t.db, mh, value)
+}
+
+func (d *blocksDatastore) Delete(ctx context.Context, key ds.Key) error {
+	mh, err := dshelp.BinaryFromDsKey(key)
+	if err != nil {
+		// can't exist
+		return nil
+	}
+	return d.t.delete(ctx, d.t.db, mh)
+}
+
+func (d *blocksDatastore) Query(ctx context.Context, q query.Query) (query.Results, error) {
+	rows, err := d.t.rows(ctx, q.KeysOnly)
+	if err != nil {
+		return nil, err
+	}
+
+	it := query.Iterator{
+		Next: func() (query.Result, bool) {
+			if !rows.Next() {
+				if err := rows.Err(); err != nil {
+					return query.Result{Error: err}, false
+				}
+				return query.Result{}, false
+			}
+
+			var mh, data []byte
+			var size int
+			if err := rows.Scan(&mh, &data, &size); err != nil {
+				return query.Result{Error: err}, false
+			}
+
+			entry := query.Entry{Key: dshelp.NewKeyFromBinary(mh).String()}
+			if !q.KeysOnly {
+				entry.Value = data
+			}
+			if q.ReturnsSizes {
+				entry.Size = size
+			}
+			return query.Result{Entry: entry}, true
+		},
+		Close: rows.Close,
+	}
+
+	return query.NaiveQueryApply(q, query.ResultsFromIterator(q, it)), nil
+}
+
+// Sync is noop for SQL databases.
+func (d *blocksDatastore) Sync(context.Context, ds.Key) error {
+	return nil
+}
+
+func (d *blocksDatastore) Close() error {
+	return nil
+}
+
+// Batch returns a batch applied in a single transaction.
+func (d *blocksDatastore) Batch(context.Context) (ds.Batch, error) {
+	return &blocksBatch{t: d.t}, nil
+}
+
+func blockKey(key ds.Key) ([]byte, error) {
+	mh, err := dshelp.BinaryFromDsKey(key)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("invalid block key %s", key))
+	}
+	return mh, nil
+}
+
+type blocksBatch struct {
+	t   *blocksTable
+	ops []blocksBatchOp
+}
+
+type blocksBatchOp struct {
+	mh     []byte
+	data   []byte
+	delete bool
+}
+
+func (b *blocksBatch) Put(_ context.Context, key ds.Key, value []byte) error {
+	mh, err := blockKey(key)
+	if err != nil {
+		return err
+	}
+	b.ops = append(b.ops, blocksBatchOp{mh: mh, data: value})
+	return nil
+}
+
+func (b *blocksBatch) Delete(_ context.Context, key ds.Key) error {
+	mh, err := dshelp.BinaryFromDsKey(key)
+	if err != nil {
+		return nil
+	}
+	b.ops = append(b.ops, blocksBatchOp{mh: mh, delete: true})
+	return nil
+}
+
+func (b *blocksBatch) Commit(ctx context.Context) error {
+	tx, err := b.t.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "begin transaction")
+	}
+	defer tx.Rollback() // noop after commit
+
+	for _, op := range b.ops {
+		if op.delete {
+			err = b.t.delete(ctx, tx, op.mh)
+		} else {
+			err = b.t.put(ctx, tx, op.mh, op.data)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "commit transaction")
+	}
+	b.ops = nil
+	return nil
+}
+
+// sqlBlockstore is a blockstore.Blockstore reading and writing a blocks
+// table directly, without going through the datastore key encoding. It
+// shares the mutex of the datastore of the table, so it's blocked during a
+// rekey. The writes fail with ErrReadOnly if the repo is read-only.
+type sqlBlockstore struct {
+	t        *blocksTable
+	mu       *sync.RWMutex
+	readOnly bool
+}
+
+var (
+	_ blockstore.Blockstore = (*sqlBlockstore)(nil)
+	_ blockstore.Viewer     = (*sqlBlockstore)(nil)
+)
+
+func (bs *sqlBlockstore) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	if !c.Defined() {
+		return nil, ipld.ErrNotFound{Cid: c}
+	}
+
+	bs.mu.RLock()
+	defer bs.mu.RUnlock()
+
+	data, err := bs.t.get(ctx, c.Hash())
+	if err == ds.ErrNotFound {
+		return nil, ipld.ErrNotFound{Cid: c}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return blocks.NewBlockWithCid(data, c)
+}
+
+func (bs *sqlBlockstore) View(ctx context.Context, c cid.Cid, callback func([]byte) error) error {
+	b, err := bs.Get(ctx, c)
+	if err != nil {
+		return err
+	}
+	return callback(b.RawData())
+}
+
+func (bs *sqlBlockstore) Has(ctx context.Context, c cid.Cid) (bool, error) {
+	bs.mu.RLock()
+	defer bs.mu.RUnlock()
+
+	return bs.t.has(ctx, c.Hash())
+}
+
+func (bs *sqlBlockstore) GetSize(ctx context.Context, c cid.Cid) (int, error) {
+	bs.mu.RLock()
+	defer bs.mu.RUnlock()
+
+	size, err := bs.t.getSize(ctx, c.Hash())
+	if err == ds.ErrNotFound {
+		return -1, ipld.ErrNotFound{Cid: c}
+	}
+	return size, err
+}
+
+func (bs *sqlBlockstore) Put(ctx context.Context, b blocks.Block) error {
+	if bs.readOnly {
+		return ErrReadOnly
+	}
+
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	return bs.t.put(ctx, bs.t.db, b.Cid().Hash(), b.RawData())
+}
+
+func (bs *sqlBlockstore) PutMany(ctx context.Context, blks []blocks.Block) error {
+	if bs.readOnly {
+		return ErrReadOnly
+	}
+
+	batch := &blocksBatch{t: bs.t}
+	for _, b := range blks {
+		batch.ops = append(batch.ops, blocksBatchOp{mh: b.Cid().Hash(), data: b.RawData()})
+	}
+
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	return batch.Commit(ctx)
+}
+
+func (bs *sqlBlockstore) DeleteBlock(ctx context.Context, c cid.Cid) error {
+	if bs.readOnly {
+		return ErrReadOnly
+	}
+
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	return bs.t.delete(ctx, bs.t.db, c.Hash())
+}
+
+// AllKeysChan returns the blocks as raw CIDv1, the codecs are not stored.
+func (bs *sqlBlockstore) AllKeysChan(ctx context.Context) (<-chan cid.Cid, error) {
+	bs.mu.RLock()
+	rows, err := bs.t.rows(ctx, true)
+	bs.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	output := make(chan cid.Cid, query.KeysOnlyBufSize)
+	go func() {
+		defer close(output)
+		defer rows.Close()
+
+		for rows.Next() {
+			var mh, data []byte
+			var size int
+			if err := rows.Scan(&mh, &data, &size); err != nil {
+				return
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case output <- cid.NewCidV1(cid.Raw, mh):
+			}
+		}
+	}()
+
+	return output, nil
+}
@@ -0,0 +1,85 @@
+package encrepo
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/ipfs/boxo/blockstore"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore/query"
+	ipld "github.com/ipfs/go-ipld-format"
+	config "github.com/ipfs/kubo/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlockstore(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	key := testingKey(t)
+	opts := SQLCipherDatastoreOptions{JournalMode: "WAL"}
+	dbPath := filepath.Join(t.TempDir(), "db.sqlite")
+
+	require.NoError(t, Init(dbPath, key, opts, &config.Config{}))
+
+	r, err := Open(dbPath, key, opts)
+	require.NoError(t, err)
+	defer requireClose(t, r)
+	bs := r.(Repo).Blockstore()
+
+	b1 := blocks.NewBlock([]byte("foo"))
+	b2 := blocks.NewBlock([]byte("bar"))
+	b3 := blocks.NewBlock([]byte("baz"))
+
+	require.NoError(t, bs.Put(ctx, b1))
+	require.NoError(t, bs.PutMany(ctx, []blocks.Block{b2, b3}))
+
+	b, err := bs.Get(ctx, b1.Cid())
+	require.NoError(t, err)
+	require.Equal(t, b1.RawData(), b.RawData())
+	size, err := bs.GetSize(ctx, b2.Cid())
+	require.NoError(t, err)
+	require.Equal(t, 3, size)
+
+	t.Log("delete block")
+	require.NoError(t, bs.DeleteBlock(ctx, b3.Cid()))
+	has, err := bs.Has(ctx, b3.Cid())
+	require.NoError(t, err)
+	require.False(t, has)
+	_, err = bs.Get(ctx, b3.Cid())
+	require.ErrorIs(t, err, ipld.ErrNotFound{Cid: b3.Cid()})
+
+	keys, err := bs.AllKeysChan(ctx)
+	require.NoError(t, err)
+	hashes := []string{}
+	for c := range keys {
+		hashes = append(hashes, c.Hash().String())
+	}
+	require.ElementsMatch(t, []string{b1.Cid().Hash().String(), b2.Cid().Hash().String()}, hashes)
+
+	t.Log("the blocks are reachable through the datastore")
+	dsbs := blockstore.NewBlockstore(r.Datastore())
+	b, err = dsbs.Get(ctx, cid.NewCidV1(cid.Raw, b2.Cid().Hash()))
+	require.NoError(t, err)
+	require.Equal(t, b2.RawData(), b.RawData())
+	b4 := blocks.NewBlock([]byte("qux"))
+	require.NoError(t, dsbs.PutMany(ctx, []blocks.Block{b4, b3}))
+	has, err = bs.Has(ctx, b4.Cid())
+	require.NoError(t, err)
+	require.True(t, has)
+
+	res, err := r.Datastore().Query(ctx, query.Query{Prefix: "/blocks", KeysOnly: true})
+	require.NoError(t, err)
+	entries, err := res.Rest()
+	require.NoError(t, err)
+	require.Len(t, entries, 4)
+
+	t.Log("the blocks are stored in the blocks table")
+	var count int
+	require.NoError(t, r.(*encRepo).store.db.QueryRowContext(ctx, "SELECT count(*) FROM blocks").Scan(&count))
+	require.Equal(t, 4, count)
+	require.NoError(t, r.(*encRepo).store.db.QueryRowContext(ctx, "SELECT count(*) FROM ipfs WHERE key GLOB '/data/blocks/*'").Scan(&count))
+	require.Equal(t, 0, count)
+}
@@ -0,0 +1,234 @@
+package encrepo
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/ipfs/boxo/blockservice"
+	"github.com/ipfs/boxo/blockstore"
+	"github.com/ipfs/boxo/ipld/merkledag"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	carv2 "github.com/ipld/go-car/v2"
+	"github.com/ipld/go-car/v2/index"
+	"github.com/ipld/go-car/v2/storage"
+	"github.com/multiformats/go-multicodec"
+	mh "github.com/multiformats/go-multihash"
+	"github.com/multiformats/go-varint"
+	"github.com/pkg/errors"
+)
+
+// CARExportOptions are the options of Repo.ExportCAR.
+type CARExportOptions struct {
+	// Roots are the roots of the DAGs to export, all the blocks are exported
+	// if empty. The DAGs can have dag-pb and raw nodes.
+	Roots []cid.Cid
+	// Key encrypts the CAR, it's a 32 bytes key. The encrypted CAR can be
+	// imported with the same key or decrypted with DecryptCAR.
+	Key []byte
+}
+
+// CARImportOptions are the options of Repo.ImportCAR.
+type CARImportOptions struct {
+	// Key decrypts a CAR exported with CARExportOptions.Key.
+	Key []byte
+}
+
+// carPlaceholderRoot is the root of the CARs of all the blocks, a CAR must
+// have roots. It's the raw CID of the empty identity multihash.
+var carPlaceholderRoot = cid.NewCidV1(cid.Raw, mh.Multihash{mh.IDENTITY, 0})
+
+// carImportBatchSize is the number of blocks put at once by ImportCAR
+const carImportBatchSize = 1024
+
+// ExportCAR writes the blocks of the repo as a CARv2 to w. The blocks of an
+// export of all the blocks have raw CIDs since their codecs are not stored,
+// and the CAR has a placeholder root that ImportCAR ignores. The CAR is
+// streamed, it's never written plaintext to disk if opts.Key is set.
+func (r *encRepo) ExportCAR(ctx context.Context, w io.Writer, opts CARExportOptions) (err error) {
+	bs := r.Blockstore()
+
+	cids, err := carBlocks(ctx, bs, opts.Roots)
+	if err != nil {
+		return err
+	}
+
+	if len(opts.Key) != 0 {
+		ew, err := newCAREncryptWriter(w, opts.Key)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err == nil {
+				err = ew.Close()
+			}
+		}()
+		w = ew
+	}
+
+	roots := opts.Roots
+	if len(roots) == 0 {
+		roots = []cid.Cid{carPlaceholderRoot}
+	}
+	return writeCARv2(ctx, w, bs, roots, cids)
+}
+
+// carBlocks returns the blocks of the DAGs under roots, or all the blocks
+func carBlocks(ctx context.Context, bs blockstore.Blockstore, roots []cid.Cid) ([]cid.Cid, error) {
+	cids := []cid.Cid{}
+
+	if len(roots) == 0 {
+		ch, err := bs.AllKeysChan(ctx)
+		if err != nil {
+			return nil, errors.Wrap(err, "list blocks")
+		}
+		for c := range ch {
+			cids = append(cids, c)
+		}
+		return cids, ctx.Err()
+	}
+
+	dag := merkledag.NewDAGService(blockservice.New(bs, nil))
+	getLinks := merkledag.GetLinksWithDAG(dag)
+	visited := cid.NewSet()
+	for _, root := range roots {
+		err := merkledag.Walk(ctx, getLinks, root, func(c cid.Cid) bool {
+			if !visited.Visit(c) {
+				return false
+			}
+			cids = append(cids, c)
+			return true
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("walk %s", root))
+		}
+	}
+	return cids, nil
+}
+
+// writeCARv2 writes a CARv2 of the blocks to w. The blocks are read twice,
+// the header has the size of the data which is followed by the index, so
+// the CAR can be streamed.
+func writeCARv2(ctx context.Context, w io.Writer, bs blockstore.Blockstore, roots []cid.Cid, cids []cid.Cid) error {
+	// the CARv1 header of the data
+	v1Header := &bytes.Buffer{}
+	if _, err := storage.NewWritable(v1Header, roots, carv2.WriteAsCarV1(true)); err != nil {
+		return errors.Wrap(err, "write CAR header")
+	}
+
+	sizes := make([]int, len(cids))
+	dataSize := uint64(v1Header.Len())
+	for i, c := range cids {
+		size, err := bs.GetSize(ctx, c)
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("get size of %s", c))
+		}
+		sizes[i] = size
+		dataSize += carSectionSize(c, size)
+	}
+
+	if _, err := w.Write(carv2.Pragma); err != nil {
+		return err
+	}
+	if _, err := carv2.NewHeader(dataSize).WriteTo(w); err != nil {
+		return err
+	}
+	if _, err := w.Write(v1Header.Bytes()); err != nil {
+		return err
+	}
+
+	idx := index.NewInsertionIndex()
+	offset := uint64(v1Header.Len())
+	for i, c := range cids {
+		b, err := bs.Get(ctx, c)
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("get %s", c))
+		}
+		if len(b.RawData()) != sizes[i] {
+			return fmt.Errorf("block %s changed during the export", c)
+		}
+
+		// the identity CIDs are not indexed by default
+		if c.Prefix().MhType != mh.IDENTITY {
+			idx.InsertNoReplace(c, offset)
+		}
+		if _, err := w.Write(varint.ToUvarint(uint64(c.ByteLen() + sizes[i]))); err != nil {
+			return err
+		}
+		if _, err := w.Write(c.Bytes()); err != nil {
+			return err
+		}
+		if _, err := w.Write(b.RawData()); err != nil {
+			return err
+		}
+		offset += carSectionSize(c, sizes[i])
+	}
+
+	flat, err := idx.Flatten(multicodec.CarMultihashIndexSorted)
+	if err != nil {
+		return errors.Wrap(err, "build CAR index")
+	}
+	if _, err := index.WriteTo(flat, w); err != nil {
+		return err
+	}
+	return nil
+}
+
+// carSectionSize is the size of the section of a block in a CAR
+func carSectionSize(c cid.Cid, size int) uint64 {
+	n := uint64(c.ByteLen() + size)
+	return uint64(varint.UvarintSize(n)) + n
+}
+
+// ImportCAR puts the blocks of the CARv1 or CARv2 read from rd in the
+// blockstore of the repo, and returns the roots of the CAR. The blocks are
+// verified against their CIDs.
+func (r *encRepo) ImportCAR(ctx context.Context, rd io.Reader, opts CARImportOptions) ([]cid.Cid, error) {
+	if len(opts.Key) != 0 {
+		var err error
+		if rd, err = newCARDecryptReader(rd, opts.Key); err != nil {
+			return nil, err
+		}
+	}
+
+	br, err := carv2.NewBlockReader(rd, carv2.WithTrustedCAR(false))
+	if err != nil {
+		return nil, errors.Wrap(err, "read CAR header")
+	}
+
+	bs := r.Blockstore()
+	batch := make([]blocks.Block, 0, carImportBatchSize)
+	for {
+		b, err := br.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "read CAR")
+		}
+
+		batch = append(batch, b)
+		if len(batch) == carImportBatchSize {
+			if err := bs.PutMany(ctx, batch); err != nil {
+				return nil, errors.Wrap(err, "put blocks")
+			}
+			batch = batch[:0]
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+	if err := bs.PutMany(ctx, batch); err != nil {
+		return nil, errors.Wrap(err, "put blocks")
+	}
+
+	roots := []cid.Cid{}
+	for _, root := range br.Roots {
+		if !root.Equals(carPlaceholderRoot) {
+			roots = append(roots, root)
+		}
+	}
+	return roots, nil
+}
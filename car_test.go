@@ -0,0 +1,99 @@
+package encrepo
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"path/filepath"
+	"testing"
+
+	"github.com/ipfs/boxo/ipld/merkledag"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	config "github.com/ipfs/kubo/config"
+	carv2 "github.com/ipld/go-car/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func testingCARRepo(t *testing.T) Repo {
+	t.Helper()
+	key := testingKey(t)
+	dbPath := filepath.Join(t.TempDir(), "db.sqlite")
+	require.NoError(t, Init(dbPath, key, SQLCipherDatastoreOptions{}, &config.Config{}))
+	r, err := Open(dbPath, key, SQLCipherDatastoreOptions{})
+	require.NoError(t, err)
+	t.Cleanup(func() { requireClose(t, r) })
+	return r.(Repo)
+}
+
+func TestCAR(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r := testingCARRepo(t)
+	bs := r.Blockstore()
+
+	// a DAG larger than an encrypted chunk, and a block out of it
+	data := make([]byte, 100<<10)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	leaf := merkledag.NewRawNode(data)
+	dagRoot := merkledag.NodeWithData([]byte("root"))
+	require.NoError(t, dagRoot.AddNodeLink("leaf", leaf))
+	other := blocks.NewBlock([]byte("other"))
+	require.NoError(t, bs.PutMany(ctx, []blocks.Block{leaf, dagRoot, other}))
+
+	t.Log("export all the blocks")
+	buf := &bytes.Buffer{}
+	require.NoError(t, r.ExportCAR(ctx, buf, CARExportOptions{}))
+	cr, err := carv2.NewReader(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	stats, err := cr.Inspect(true)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), stats.BlockCount)
+	require.True(t, cr.Header.HasIndex())
+
+	imported := testingCARRepo(t)
+	roots, err := imported.ImportCAR(ctx, bytes.NewReader(buf.Bytes()), CARImportOptions{})
+	require.NoError(t, err)
+	require.Empty(t, roots)
+	for _, b := range []blocks.Block{leaf, dagRoot, other} {
+		has, err := imported.Blockstore().Has(ctx, b.Cid())
+		require.NoError(t, err)
+		require.True(t, has)
+	}
+
+	t.Log("export an encrypted DAG")
+	carKey := testingKey(t)
+	buf.Reset()
+	require.NoError(t, r.ExportCAR(ctx, buf, CARExportOptions{Roots: []cid.Cid{dagRoot.Cid()}, Key: carKey}))
+	require.False(t, bytes.Contains(buf.Bytes(), data[:64]), "plaintext in the encrypted CAR")
+
+	imported = testingCARRepo(t)
+	_, err = imported.ImportCAR(ctx, bytes.NewReader(buf.Bytes()), CARImportOptions{Key: testingKey(t)})
+	require.ErrorIs(t, err, ErrCARDecrypt)
+	_, err = imported.ImportCAR(ctx, bytes.NewReader(buf.Bytes()[:buf.Len()-1]), CARImportOptions{Key: carKey})
+	require.ErrorIs(t, err, ErrCARDecrypt)
+
+	roots, err = imported.ImportCAR(ctx, bytes.NewReader(buf.Bytes()), CARImportOptions{Key: carKey})
+	require.NoError(t, err)
+	require.Equal(t, []cid.Cid{dagRoot.Cid()}, roots)
+	has, err := imported.Blockstore().Has(ctx, leaf.Cid())
+	require.NoError(t, err)
+	require.True(t, has)
+	has, err = imported.Blockstore().Has(ctx, other.Cid())
+	require.NoError(t, err)
+	require.False(t, has)
+
+	t.Log("decrypt the CAR for another node")
+	plain := &bytes.Buffer{}
+	require.NoError(t, DecryptCAR(plain, bytes.NewReader(buf.Bytes()), carKey))
+	cr, err = carv2.NewReader(bytes.NewReader(plain.Bytes()))
+	require.NoError(t, err)
+	carRoots, err := cr.Roots()
+	require.NoError(t, err)
+	require.Equal(t, []cid.Cid{dagRoot.Cid()}, carRoots)
+	stats, err = cr.Inspect(true)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), stats.BlockCount)
+}
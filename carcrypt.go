@@ -0,0 +1,194 @@
+package encrepo
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// The encrypted CARs are split in chunks encrypted with XChaCha20-Poly1305,
+// following the STREAM construction: the nonce of a chunk is a random
+// prefix, the chunk counter and a flag set on the last chunk, so a
+// truncated or reordered stream fails to decrypt. The stream starts with
+// carCryptMagic and the nonce prefix, they are authenticated with each
+// chunk.
+
+const (
+	carCryptMagic     = "ENCRCAR\x01"
+	carCryptChunkSize = 64 << 10
+	carCryptPrefixLen = chacha20poly1305.NonceSizeX - 8 - 1
+	carCryptHeaderLen = len(carCryptMagic) + carCryptPrefixLen
+)
+
+// ErrCARDecrypt is returned when an encrypted CAR can't be decrypted, the
+// key is wrong or the data was modified.
+var ErrCARDecrypt = errors.New("failed to decrypt CAR")
+
+func newCARCipher(key []byte) (cipher.AEAD, error) {
+	if len(key) != chacha20poly1305.KeySize {
+		return nil, fmt.Errorf("bad key length, expected %d bytes, got %d", chacha20poly1305.KeySize, len(key))
+	}
+	return chacha20poly1305.NewX(key)
+}
+
+// carEncryptWriter encrypts the data written to w, Close writes the last
+// chunk.
+type carEncryptWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	header  []byte
+	counter uint64
+	buf     []byte
+}
+
+func newCAREncryptWriter(w io.Writer, key []byte) (*carEncryptWriter, error) {
+	aead, err := newCARCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, carCryptHeaderLen)
+	copy(header, carCryptMagic)
+	if _, err := rand.Read(header[len(carCryptMagic):]); err != nil {
+		return nil, errors.Wrap(err, "generate nonce")
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+
+	return &carEncryptWriter{w: w, aead: aead, header: header, buf: make([]byte, 0, carCryptChunkSize)}, nil
+}
+
+func (w *carEncryptWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) != 0 {
+		// the chunk is sealed once more data comes, the last one is sealed
+		// by Close
+		if len(w.buf) == carCryptChunkSize {
+			if err := w.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := min(len(p), carCryptChunkSize-len(w.buf))
+		w.buf = append(w.buf, p[:n]...)
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (w *carEncryptWriter) seal(last bool) error {
+	out := w.aead.Seal(nil, carCryptNonce(w.header, w.counter, last), w.buf, w.header)
+	w.counter++
+	w.buf = w.buf[:0]
+	_, err := w.w.Write(out)
+	return err
+}
+
+// Close writes the last chunk, it doesn't close the underlying writer.
+func (w *carEncryptWriter) Close() error {
+	return w.seal(true)
+}
+
+func carCryptNonce(header []byte, counter uint64, last bool) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSizeX)
+	copy(nonce, header[len(carCryptMagic):])
+	binary.BigEndian.PutUint64(nonce[carCryptPrefixLen:], counter)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// carDecryptReader decrypts the data written by carEncryptWriter
+type carDecryptReader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	header  []byte
+	counter uint64
+	chunk   []byte
+	plain   []byte
+	done    bool
+}
+
+func newCARDecryptReader(r io.Reader, key []byte) (*carDecryptReader, error) {
+	aead, err := newCARCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, carCryptHeaderLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, errors.Wrap(err, "read encrypted CAR header")
+	}
+	if string(header[:len(carCryptMagic)]) != carCryptMagic {
+		return nil, errors.New("not an encrypted CAR")
+	}
+
+	return &carDecryptReader{
+		r:      bufio.NewReader(r),
+		aead:   aead,
+		header: header,
+		chunk:  make([]byte, carCryptChunkSize+aead.Overhead()),
+	}, nil
+}
+
+func (r *carDecryptReader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+// open decrypts the next chunk
+func (r *carDecryptReader) open() error {
+	n, err := io.ReadFull(r.r, r.chunk)
+	last := false
+	switch err {
+	case nil:
+		if _, err := r.r.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	case io.ErrUnexpectedEOF:
+		last = true
+	case io.EOF:
+		return fmt.Errorf("%w: truncated", ErrCARDecrypt)
+	default:
+		return err
+	}
+
+	plain, err := r.aead.Open(r.chunk[:0], carCryptNonce(r.header, r.counter, last), r.chunk[:n], r.header)
+	if err != nil {
+		return fmt.Errorf("%w: wrong key or modified data", ErrCARDecrypt)
+	}
+	r.counter++
+	r.plain = plain
+	r.done = last
+	return nil
+}
+
+// DecryptCAR decrypts a CAR exported with CARExportOptions.Key, e.g. to
+// import it in another IPFS node.
+func DecryptCAR(dst io.Writer, src io.Reader, key []byte) error {
+	r, err := newCARDecryptReader(src, key)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, r)
+	return err
+}
@@ -0,0 +1,236 @@
+package encrepo
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ErrCipherSettingsMismatch is returned when the SQLCipher settings are not
+// the ones the database was created with.
+var ErrCipherSettingsMismatch = errors.New("cipher settings mismatch")
+
+// cipherSettings are the settings needed to decrypt a database
+type cipherSettings struct {
+	PageSize        int    `json:"page_size"`
+	KDFIter         int    `json:"kdf_iter"`
+	HMACAlgorithm   string `json:"hmac_algorithm"`
+	KDFAlgorithm    string `json:"kdf_algorithm"`
+	PlaintextHeader bool   `json:"plaintext_header,omitempty"`
+	// SaltHash is the hex encoded SHA-256 of the salt of a database with a
+	// plaintext header, SQLCipher can't tell a wrong salt from a wrong key.
+	SaltHash string `json:"salt_sha256,omitempty"`
+}
+
+const defaultCipherCompatibility = 4
+
+// cipherDefaults are the defaults of the SQLCipher major versions
+var cipherDefaults = map[int]cipherSettings{
+	1: {PageSize: 1024, KDFIter: 4000, HMACAlgorithm: "HMAC_SHA1", KDFAlgorithm: "PBKDF2_HMAC_SHA1"},
+	2: {PageSize: 1024, KDFIter: 4000, HMACAlgorithm: "HMAC_SHA1", KDFAlgorithm: "PBKDF2_HMAC_SHA1"},
+	3: {PageSize: 1024, KDFIter: 64000, HMACAlgorithm: "HMAC_SHA1", KDFAlgorithm: "PBKDF2_HMAC_SHA1"},
+	4: {PageSize: 4096, KDFIter: 256000, HMACAlgorithm: "HMAC_SHA512", KDFAlgorithm: "PBKDF2_HMAC_SHA512"},
+}
+
+var (
+	journalModes        = []string{"DELETE", "TRUNCATE", "PERSIST", "MEMORY", "WAL", "OFF"}
+	synchronousModes    = []string{"OFF", "NORMAL", "FULL", "EXTRA"}
+	hmacAlgorithms      = []string{"HMAC_SHA1", "HMAC_SHA256", "HMAC_SHA512"}
+	cipherKDFAlgorithms = []string{"PBKDF2_HMAC_SHA1", "PBKDF2_HMAC_SHA256", "PBKDF2_HMAC_SHA512"}
+)
+
+func checkOneOf(name, val string, valid []string) error {
+	if val == "" {
+		return nil
+	}
+	for _, v := range valid {
+		if val == v {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid %s %q, expected one of %s", name, val, strings.Join(valid, ", "))
+}
+
+// validate checks the options before the database is opened
+func (opts SQLCipherDatastoreOptions) validate() error {
+	if opts.PlaintextHeader && len(opts.Salt) != saltLength {
+		return fmt.Errorf("%w, expected %d bytes, got %d", ErrBadSalt, saltLength, len(opts.Salt))
+	}
+	if err := checkOneOf("journal mode", opts.JournalMode, journalModes); err != nil {
+		return err
+	}
+
+	if _, ok := cipherDefaults[opts.CipherCompatibility]; !ok && opts.CipherCompatibility != 0 {
+		return fmt.Errorf("invalid cipher compatibility %d, expected 1 to 4", opts.CipherCompatibility)
+	}
+	if ps := opts.CipherPageSize; ps != 0 && (ps < 512 || ps > 65536 || ps&(ps-1) != 0) {
+		return fmt.Errorf("invalid cipher page size %d, expected a power of two from 512 to 65536", ps)
+	}
+	if opts.KDFIter < 0 {
+		return fmt.Errorf("invalid kdf iterations %d", opts.KDFIter)
+	}
+	if err := checkOneOf("cipher hmac algorithm", opts.CipherHMACAlgorithm, hmacAlgorithms); err != nil {
+		return err
+	}
+	if err := checkOneOf("cipher kdf algorithm", opts.CipherKDFAlgorithm, cipherKDFAlgorithms); err != nil {
+		return err
+	}
+
+	if err := checkOneOf("synchronous", opts.Synchronous, synchronousModes); err != nil {
+		return err
+	}
+	if opts.BusyTimeout < 0 {
+		return fmt.Errorf("invalid busy timeout %s", opts.BusyTimeout)
+	}
+	if opts.MmapSize < 0 {
+		return fmt.Errorf("invalid mmap size %d", opts.MmapSize)
+	}
+	return nil
+}
+
+// cipherSettings returns the effective cipher settings of the options
+func (opts SQLCipherDatastoreOptions) cipherSettings() cipherSettings {
+	compat := opts.CipherCompatibility
+	if compat == 0 {
+		compat = defaultCipherCompatibility
+	}
+	s := cipherDefaults[compat]
+	if opts.CipherPageSize != 0 {
+		s.PageSize = opts.CipherPageSize
+	}
+	if opts.KDFIter != 0 {
+		s.KDFIter = opts.KDFIter
+	}
+	if opts.CipherHMACAlgorithm != "" {
+		s.HMACAlgorithm = opts.CipherHMACAlgorithm
+	}
+	if opts.CipherKDFAlgorithm != "" {
+		s.KDFAlgorithm = opts.CipherKDFAlgorithm
+	}
+	s.PlaintextHeader = opts.PlaintextHeader
+	if opts.PlaintextHeader {
+		h := sha256.Sum256(opts.Salt)
+		s.SaltHash = hex.EncodeToString(h[:])
+	}
+	return s
+}
+
+// cipherDefaultPragmas returns the pragmas setting the SQLCipher defaults
+// to the cipher settings that the driver doesn't support, see
+// sqlcipherConnector.Connect.
+func (opts SQLCipherDatastoreOptions) cipherDefaultPragmas() []string {
+	pragmas := []string{}
+	// cipher_default_compatibility resets the other defaults
+	if opts.CipherCompatibility != 0 {
+		pragmas = append(pragmas, fmt.Sprintf("PRAGMA cipher_default_compatibility = %d", opts.CipherCompatibility))
+	}
+	if opts.KDFIter != 0 {
+		pragmas = append(pragmas, fmt.Sprintf("PRAGMA cipher_default_kdf_iter = %d", opts.KDFIter))
+	}
+	if opts.CipherHMACAlgorithm != "" {
+		pragmas = append(pragmas, "PRAGMA cipher_default_hmac_algorithm = "+opts.CipherHMACAlgorithm)
+	}
+	if opts.CipherKDFAlgorithm != "" {
+		pragmas = append(pragmas, "PRAGMA cipher_default_kdf_algorithm = "+opts.CipherKDFAlgorithm)
+	}
+	return pragmas
+}
+
+// pragmas returns the connection settings pragmas, they are set once the
+// connection is open
+func (opts SQLCipherDatastoreOptions) pragmas() []string {
+	pragmas := []string{}
+	if opts.ReadOnly {
+		// the journal mode is left as is, WAL is persistent
+		pragmas = append(pragmas, "PRAGMA query_only = 1")
+	} else if opts.JournalMode != "" {
+		pragmas = append(pragmas, "PRAGMA journal_mode = "+opts.JournalMode)
+	}
+	if opts.Synchronous != "" {
+		pragmas = append(pragmas, "PRAGMA synchronous = "+opts.Synchronous)
+	}
+	if opts.CacheSize != 0 {
+		pragmas = append(pragmas, fmt.Sprintf("PRAGMA cache_size = %d", opts.CacheSize))
+	}
+	if opts.BusyTimeout != 0 {
+		pragmas = append(pragmas, fmt.Sprintf("PRAGMA busy_timeout = %d", opts.BusyTimeout.Milliseconds()))
+	}
+	if opts.MmapSize != 0 {
+		pragmas = append(pragmas, fmt.Sprintf("PRAGMA mmap_size = %d", opts.MmapSize))
+	}
+	if opts.TempStoreMemory {
+		pragmas = append(pragmas, "PRAGMA temp_store = MEMORY")
+	}
+	return pragmas
+}
+
+// exportPragmas returns the pragmas setting the cipher settings of the
+// attached database schema
+func (s cipherSettings) exportPragmas(schema string) []string {
+	return []string{
+		fmt.Sprintf("PRAGMA %s.cipher_page_size = %d", schema, s.PageSize),
+		fmt.Sprintf("PRAGMA %s.kdf_iter = %d", schema, s.KDFIter),
+		fmt.Sprintf("PRAGMA %s.cipher_hmac_algorithm = %s", schema, s.HMACAlgorithm),
+		fmt.Sprintf("PRAGMA %s.cipher_kdf_algorithm = %s", schema, s.KDFAlgorithm),
+	}
+}
+
+// check returns an error describing the differences with the requested
+// settings
+func (s cipherSettings) check(requested cipherSettings) error {
+	// the settings stored before the salt hash don't have it
+	if s.SaltHash != "" && requested.SaltHash != "" && s.SaltHash != requested.SaltHash {
+		return fmt.Errorf("%w, db salt doesn't match", ErrBadSalt)
+	}
+
+	diffs := []string{}
+	diff := func(name string, stored, requested interface{}) {
+		if stored != requested {
+			diffs = append(diffs, fmt.Sprintf("%s is %v, requested %v", name, stored, requested))
+		}
+	}
+	diff("cipher_page_size", s.PageSize, requested.PageSize)
+	diff("kdf_iter", s.KDFIter, requested.KDFIter)
+	diff("cipher_hmac_algorithm", s.HMACAlgorithm, requested.HMACAlgorithm)
+	diff("cipher_kdf_algorithm", s.KDFAlgorithm, requested.KDFAlgorithm)
+	diff("plaintext header", s.PlaintextHeader, requested.PlaintextHeader)
+	if len(diffs) != 0 {
+		return errors.Wrap(ErrCipherSettingsMismatch, strings.Join(diffs, ", "))
+	}
+	return nil
+}
+
+// CipherSettingsPath returns the path of the file storing the cipher
+// settings of the encrypted database at dbPath.
+func CipherSettingsPath(dbPath string) string {
+	return dbPath + ".cipher"
+}
+
+func readCipherSettings(dbPath string) (*cipherSettings, error) {
+	b, err := os.ReadFile(CipherSettingsPath(dbPath))
+	if err != nil {
+		return nil, errors.Wrap(err, "read cipher settings")
+	}
+
+	var s cipherSettings
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, errors.Wrap(err, "unmarshal cipher settings")
+	}
+	return &s, nil
+}
+
+func writeCipherSettings(dbPath string, s cipherSettings) error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "marshal cipher settings")
+	}
+	if err := writeFileAtomic(CipherSettingsPath(dbPath), b); err != nil {
+		return errors.Wrap(err, "write cipher settings")
+	}
+	return nil
+}
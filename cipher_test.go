@@ -0,0 +1,167 @@
+package encrepo
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	config "github.com/ipfs/kubo/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCipherSettings(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	key := testingKey(t)
+	opts := SQLCipherDatastoreOptions{
+		JournalMode:         "WAL",
+		CipherCompatibility: 3,
+		CipherPageSize:      8192,
+		KDFIter:             1000,
+		CipherHMACAlgorithm: "HMAC_SHA256",
+		CipherKDFAlgorithm:  "PBKDF2_HMAC_SHA256",
+		CacheSize:           -4000,
+		Synchronous:         "FULL",
+		BusyTimeout:         time.Second,
+		MmapSize:            1 << 20,
+		TempStoreMemory:     true,
+	}
+	dbPath := filepath.Join(t.TempDir(), "db.sqlite")
+
+	require.NoError(t, Init(dbPath, key, opts, &config.Config{}))
+	r, err := Open(dbPath, key, opts)
+	require.NoError(t, err)
+	require.NoError(t, r.Datastore().Put(ctx, datastore.NewKey("/foo"), []byte("foo")))
+
+	t.Log("the pragmas are set on the connections")
+	db := r.(*encRepo).store.db
+	for pragma, expected := range map[string]string{
+		"cipher_page_size":      "8192",
+		"kdf_iter":              "1000",
+		"cipher_hmac_algorithm": "HMAC_SHA256",
+		"cipher_kdf_algorithm":  "PBKDF2_HMAC_SHA256",
+		"journal_mode":          "wal",
+		"cache_size":            "-4000",
+		"synchronous":           "2",
+		"busy_timeout":          "1000",
+		"mmap_size":             "1048576",
+		"temp_store":            "2",
+	} {
+		var val string
+		require.NoError(t, db.QueryRowContext(ctx, "PRAGMA "+pragma).Scan(&val))
+		require.Equal(t, expected, val, pragma)
+	}
+	require.NoError(t, r.Close())
+
+	t.Log("the defaults of the other databases are restored")
+	otherPath := filepath.Join(t.TempDir(), "db.sqlite")
+	require.NoError(t, Init(otherPath, key, SQLCipherDatastoreOptions{}, &config.Config{}))
+	other, err := Open(otherPath, key, SQLCipherDatastoreOptions{})
+	require.NoError(t, err)
+	var kdfIter int
+	require.NoError(t, other.(*encRepo).store.db.QueryRowContext(ctx, "PRAGMA kdf_iter").Scan(&kdfIter))
+	require.Equal(t, 256000, kdfIter)
+	require.NoError(t, other.Close())
+
+	t.Log("detect the mismatches")
+	_, err = os.Stat(CipherSettingsPath(dbPath))
+	require.NoError(t, err)
+	badOpts := opts
+	badOpts.CipherPageSize = 0
+	_, err = Open(dbPath, key, badOpts)
+	require.ErrorIs(t, err, ErrCipherSettingsMismatch)
+	require.ErrorContains(t, err, "cipher_page_size is 8192, requested 1024")
+
+	t.Log("store the settings of a database without them")
+	require.NoError(t, os.Remove(CipherSettingsPath(dbPath)))
+	_, err = Open(dbPath, key, badOpts)
+	require.Error(t, err)
+	_, err = os.Stat(CipherSettingsPath(dbPath))
+	require.True(t, os.IsNotExist(err))
+	r, err = Open(dbPath, key, opts)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	stored, err := readCipherSettings(dbPath)
+	require.NoError(t, err)
+	require.Equal(t, opts.cipherSettings(), *stored)
+
+	t.Log("the settings follow the conversions")
+	require.NoError(t, DecryptDatabase(dbPath, key, opts, nil))
+	_, err = os.Stat(CipherSettingsPath(dbPath))
+	require.True(t, os.IsNotExist(err))
+	require.NoError(t, EncryptDatabase(dbPath, key, opts, nil))
+	r, err = Open(dbPath, key, opts)
+	require.NoError(t, err)
+	val, err := r.Datastore().Get(ctx, datastore.NewKey("/foo"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("foo"), val)
+	require.NoError(t, r.Close())
+}
+
+func TestCipherSettingsInvalid(t *testing.T) {
+	key := testingKey(t)
+
+	for _, opts := range []SQLCipherDatastoreOptions{
+		{JournalMode: "wal2"},
+		{CipherCompatibility: 5},
+		{CipherPageSize: 1000},
+		{CipherPageSize: 256},
+		{KDFIter: -1},
+		{CipherHMACAlgorithm: "HMAC_MD5"},
+		{CipherKDFAlgorithm: "SCRYPT"},
+		{Synchronous: "SOMETIMES"},
+		{BusyTimeout: -time.Second},
+		{MmapSize: -1},
+	} {
+		dbPath := filepath.Join(t.TempDir(), "db.sqlite")
+		require.Error(t, Init(dbPath, key, opts, &config.Config{}), opts)
+		_, err := os.Stat(dbPath)
+		require.True(t, os.IsNotExist(err))
+	}
+}
+
+func TestCipherSettingsConcurrentRepos(t *testing.T) {
+	key := testingKey(t)
+	tuned := SQLCipherDatastoreOptions{CipherCompatibility: 3, KDFIter: 1000, CipherHMACAlgorithm: "HMAC_SHA256"}
+	dir := t.TempDir()
+	tunedPath, defaultPath := filepath.Join(dir, "tuned.sqlite"), filepath.Join(dir, "default.sqlite")
+	require.NoError(t, Init(tunedPath, key, tuned, &config.Config{}))
+	require.NoError(t, Init(defaultPath, key, SQLCipherDatastoreOptions{}, &config.Config{}))
+
+	t.Log("the defaults of a repo don't leak to the connections of another")
+	const numOps = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+	for _, repo := range []struct {
+		path string
+		opts SQLCipherDatastoreOptions
+	}{{tunedPath, tuned}, {defaultPath, SQLCipherDatastoreOptions{}}} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < numOps; i++ {
+				r, err := Open(repo.path, key, repo.opts)
+				if err == nil {
+					_, err = r.Config()
+					if cerr := r.Close(); err == nil {
+						err = cerr
+					}
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+}
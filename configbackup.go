@@ -0,0 +1,152 @@
+package encrepo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	config "github.com/ipfs/kubo/config"
+	"github.com/pkg/errors"
+)
+
+const configBackupsPrefix = "/config-backups"
+
+// configBackupTimeFormat sorts lexicographically
+const configBackupTimeFormat = "20060102T150405.000000000Z"
+
+var ErrConfigBackupNotFound = errors.New("config backup not found")
+
+func configBackupKey(id string) datastore.Key {
+	return datastore.NewKey(configBackupsPrefix).ChildString(id)
+}
+
+// BackupConfig creates a backup of the current configuration in the
+// datastore and returns its identifier, named using the given prefix and
+// the current time.
+func (r *encRepo) BackupConfig(prefix string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return "", errors.New("repo is closed")
+	}
+
+	if r.readOnly {
+		return "", ErrReadOnly
+	}
+
+	if strings.Contains(prefix, "/") {
+		return "", fmt.Errorf("invalid config backup prefix %q", prefix)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	confBytes, err := r.root.Get(ctx, datastore.NewKey(configKey))
+	if err != nil {
+		return "", errors.Wrap(err, "get config")
+	}
+
+	id := prefix + "-" + time.Now().UTC().Format(configBackupTimeFormat)
+	key := configBackupKey(id)
+	has, err := r.root.Has(ctx, key)
+	if err != nil {
+		return "", errors.Wrap(err, fmt.Sprintf("check '%s' in ds", key))
+	}
+	if has {
+		return "", fmt.Errorf("config backup %s already exists", id)
+	}
+
+	if err := r.root.Put(ctx, key, confBytes); err != nil {
+		return "", errors.Wrap(err, fmt.Sprintf("put '%s' in ds", key))
+	}
+
+	return id, nil
+}
+
+// ListConfigBackups returns the identifiers of the config backups, sorted by
+// prefix then creation time.
+func (r *encRepo) ListConfigBackups() ([]string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.closed {
+		return nil, errors.New("repo is closed")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	res, err := r.root.Query(ctx, query.Query{Prefix: configBackupsPrefix, KeysOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(entries))
+	for i, e := range entries {
+		ids[i] = datastore.RawKey(e.Key).BaseNamespace()
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// ReadConfigBackup returns the config backup identified by id.
+func (r *encRepo) ReadConfigBackup(id string) (*config.Config, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.closed {
+		return nil, errors.New("repo is closed")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	return r.readConfigBackup(ctx, id)
+}
+
+func (r *encRepo) readConfigBackup(ctx context.Context, id string) (*config.Config, error) {
+	confBytes, err := r.root.Get(ctx, configBackupKey(id))
+	switch err {
+	case nil:
+	case datastore.ErrNotFound:
+		return nil, ErrConfigBackupNotFound
+	default:
+		return nil, errors.Wrap(err, "get config backup")
+	}
+
+	var conf config.Config
+	if err := json.Unmarshal(confBytes, &conf); err != nil {
+		return nil, errors.Wrap(err, "unmarshal config backup")
+	}
+	return &conf, nil
+}
+
+// RestoreConfigBackup replaces the current configuration with the config
+// backup identified by id.
+func (r *encRepo) RestoreConfigBackup(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return errors.New("repo is closed")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	conf, err := r.readConfigBackup(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	return r.setConfig(ctx, conf, ConfigChangeInfo{Reason: "restore config backup " + id})
+}
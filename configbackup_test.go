@@ -0,0 +1,51 @@
+package encrepo
+
+import (
+	"path/filepath"
+	"testing"
+
+	config "github.com/ipfs/kubo/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigBackup(t *testing.T) {
+	key := testingKey(t)
+	opts := SQLCipherDatastoreOptions{JournalMode: "WAL"}
+	dbPath := filepath.Join(t.TempDir(), "db.sqlite")
+
+	require.NoError(t, Init(dbPath, key, opts, &config.Config{Identity: config.Identity{PeerID: "foo", PrivKey: "bar"}}))
+
+	r, err := Open(dbPath, key, opts)
+	require.NoError(t, err)
+	defer requireClose(t, r)
+	er := r.(Repo)
+
+	_, err = r.BackupConfig("bad/prefix")
+	require.Error(t, err)
+
+	id1, err := r.BackupConfig("edit")
+	require.NoError(t, err)
+	require.NoError(t, r.SetConfigKey("Identity.PeerID", "bar"))
+	id2, err := r.BackupConfig("edit")
+	require.NoError(t, err)
+	require.NoError(t, r.SetConfigKey("Identity.PeerID", "baz"))
+
+	ids, err := er.ListConfigBackups()
+	require.NoError(t, err)
+	require.Equal(t, []string{id1, id2}, ids)
+
+	conf, err := er.ReadConfigBackup(id2)
+	require.NoError(t, err)
+	require.Equal(t, "bar", conf.Identity.PeerID)
+
+	_, err = er.ReadConfigBackup("unknown")
+	require.ErrorIs(t, err, ErrConfigBackupNotFound)
+
+	require.NoError(t, er.RestoreConfigBackup(id1))
+	conf, err = r.Config()
+	require.NoError(t, err)
+	require.Equal(t, "foo", conf.Identity.PeerID)
+	val, err := r.GetConfigKey("Identity.PeerID")
+	require.NoError(t, err)
+	require.Equal(t, "foo", val)
+}
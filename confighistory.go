@@ -0,0 +1,457 @@
+package encrepo
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	config "github.com/ipfs/kubo/config"
+	"github.com/ipfs/kubo/repo/common"
+	"github.com/pkg/errors"
+)
+
+// Every config change is recorded as an immutable revision holding a
+// snapshot of the config, under /config-history/revisions/<id>. The last
+// revision id is stored at /config-history/head. The snapshots don't hold
+// the private key of the identity, and only the last configHistoryLimit
+// revisions are kept.
+
+const configHistoryPrefix = "/config-history"
+
+// configHistoryLimit is the number of revisions kept, the oldest are pruned
+const configHistoryLimit = 100
+
+var (
+	configHistoryHeadKey         = datastore.NewKey(configHistoryPrefix).ChildString("head")
+	configHistoryRevisionsPrefix = datastore.NewKey(configHistoryPrefix).ChildString("revisions")
+)
+
+var ErrConfigRevisionNotFound = errors.New("config revision not found")
+
+// ConfigChangeInfo describes why the config is changed, it's recorded in
+// the config history.
+type ConfigChangeInfo struct {
+	Author string `json:"author,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// ConfigRevision is a revision of the config.
+type ConfigRevision struct {
+	ID   uint64    `json:"id"`
+	Time time.Time `json:"time"`
+	ConfigChangeInfo
+	// ChangedKeys are the config keys changed since the previous revision,
+	// e.g. "Swarm.ConnMgr.HighWater"
+	ChangedKeys []string `json:"changed_keys"`
+	// Config is the config snapshot
+	Config json.RawMessage `json:"config"`
+}
+
+// ConfigDiff is a change of a config key between two revisions, Old is nil
+// if the key was added and New is nil if it was removed.
+type ConfigDiff struct {
+	Key string
+	Old json.RawMessage
+	New json.RawMessage
+}
+
+func configRevisionKey(id uint64) datastore.Key {
+	// zero padded so the keys sort by id
+	return configHistoryRevisionsPrefix.ChildString(fmt.Sprintf("%020d", id))
+}
+
+// commitConfig atomically writes conf and appends a revision to the config
+// history.
+func (r *encRepo) commitConfig(ctx context.Context, conf interface{}, info ConfigChangeInfo) error {
+	if r.readOnly {
+		return ErrReadOnly
+	}
+
+	confBytes, err := config.Marshal(conf)
+	if err != nil {
+		return errors.Wrap(err, "marshal config")
+	}
+
+	// serialize with the other datastore operations, a concurrent write could
+	// prevent the transaction from upgrading to a write transaction
+	r.root.Lock()
+	defer r.root.Unlock()
+
+	txn, err := r.store.NewTransaction(ctx, false)
+	if err != nil {
+		return errors.Wrap(err, "begin transaction")
+	}
+	defer txn.Discard(ctx)
+
+	prevBytes, err := txn.Get(ctx, datastore.NewKey(configKey))
+	if err != nil && err != datastore.ErrNotFound {
+		return errors.Wrap(err, "get config")
+	}
+
+	if err := appendConfigRevision(ctx, txn, prevBytes, confBytes, info); err != nil {
+		return err
+	}
+
+	if err := txn.Put(ctx, datastore.NewKey(configKey), confBytes); err != nil {
+		return errors.Wrap(err, "put config in ds")
+	}
+
+	return txn.Commit(ctx)
+}
+
+func appendConfigRevision(ctx context.Context, txn datastore.Txn, prevBytes, confBytes []byte, info ConfigChangeInfo) error {
+	prevBytes, err := redactConfig(prevBytes)
+	if err != nil {
+		return err
+	}
+	if confBytes, err = redactConfig(confBytes); err != nil {
+		return err
+	}
+
+	var head uint64
+	headBytes, err := txn.Get(ctx, configHistoryHeadKey)
+	switch err {
+	case nil:
+		if head, err = strconv.ParseUint(string(headBytes), 10, 64); err != nil {
+			return errors.Wrap(err, "parse config history head")
+		}
+	case datastore.ErrNotFound:
+		// no history yet, record the current config as the base revision
+		if prevBytes != nil {
+			changed, err := changedConfigKeys(nil, prevBytes)
+			if err != nil {
+				return err
+			}
+			if err := putConfigRevision(ctx, txn, &ConfigRevision{
+				ID:               head,
+				Time:             time.Now().UTC(),
+				ConfigChangeInfo: ConfigChangeInfo{Reason: "initial config"},
+				ChangedKeys:      changed,
+				Config:           prevBytes,
+			}); err != nil {
+				return err
+			}
+			head++
+		}
+	default:
+		return errors.Wrap(err, "get config history head")
+	}
+
+	changed, err := changedConfigKeys(prevBytes, confBytes)
+	if err != nil {
+		return err
+	}
+
+	if err := putConfigRevision(ctx, txn, &ConfigRevision{
+		ID:               head,
+		Time:             time.Now().UTC(),
+		ConfigChangeInfo: info,
+		ChangedKeys:      changed,
+		Config:           confBytes,
+	}); err != nil {
+		return err
+	}
+
+	if head >= configHistoryLimit {
+		key := configRevisionKey(head - configHistoryLimit)
+		if err := txn.Delete(ctx, key); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("delete '%s' in ds", key))
+		}
+	}
+
+	return txn.Put(ctx, configHistoryHeadKey, []byte(strconv.FormatUint(head+1, 10)))
+}
+
+// redactConfig removes the private key of the identity from a json config
+func redactConfig(confBytes []byte) ([]byte, error) {
+	if confBytes == nil {
+		return nil, nil
+	}
+
+	var m map[string]interface{}
+	if err := json.Unmarshal(confBytes, &m); err != nil {
+		return nil, errors.Wrap(err, "unmarshal config")
+	}
+	identity, ok := m["Identity"].(map[string]interface{})
+	if !ok {
+		return confBytes, nil
+	}
+	if _, ok := identity["PrivKey"]; !ok {
+		return confBytes, nil
+	}
+	delete(identity, "PrivKey")
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal config")
+	}
+	return b, nil
+}
+
+func putConfigRevision(ctx context.Context, txn datastore.Txn, rev *ConfigRevision) error {
+	revBytes, err := json.Marshal(rev)
+	if err != nil {
+		return errors.Wrap(err, "marshal config revision")
+	}
+	key := configRevisionKey(rev.ID)
+	if err := txn.Put(ctx, key, revBytes); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("put '%s' in ds", key))
+	}
+	return nil
+}
+
+// changedConfigKeys returns the sorted keys that differ between two configs
+func changedConfigKeys(a, b []byte) ([]string, error) {
+	diffs, err := diffConfigs(a, b)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, len(diffs))
+	for i, d := range diffs {
+		keys[i] = d.Key
+	}
+	return keys, nil
+}
+
+// diffConfigs compares the leaves of two json configs
+func diffConfigs(a, b []byte) ([]ConfigDiff, error) {
+	leavesA, err := configLeaves(a)
+	if err != nil {
+		return nil, err
+	}
+	leavesB, err := configLeaves(b)
+	if err != nil {
+		return nil, err
+	}
+
+	diffs := []ConfigDiff{}
+	for k, va := range leavesA {
+		vb, ok := leavesB[k]
+		if !ok {
+			diffs = append(diffs, ConfigDiff{Key: k, Old: va})
+		} else if !bytes.Equal(va, vb) {
+			diffs = append(diffs, ConfigDiff{Key: k, Old: va, New: vb})
+		}
+	}
+	for k, vb := range leavesB {
+		if _, ok := leavesA[k]; !ok {
+			diffs = append(diffs, ConfigDiff{Key: k, New: vb})
+		}
+	}
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i].Key < diffs[j].Key })
+	return diffs, nil
+}
+
+// configLeaves flattens a json config into its leaves, indexed by dotted
+// keys as used by SetConfigKey
+func configLeaves(confBytes []byte) (map[string]json.RawMessage, error) {
+	leaves := map[string]json.RawMessage{}
+	if confBytes == nil {
+		return leaves, nil
+	}
+
+	var m map[string]interface{}
+	if err := json.Unmarshal(confBytes, &m); err != nil {
+		return nil, errors.Wrap(err, "unmarshal config")
+	}
+
+	var walk func(prefix string, v interface{}) error
+	walk = func(prefix string, v interface{}) error {
+		if obj, ok := v.(map[string]interface{}); ok && len(obj) != 0 {
+			for k, child := range obj {
+				if err := walk(prefix+"."+k, child); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		leaf, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		leaves[prefix[1:]] = leaf
+		return nil
+	}
+	for k, v := range m {
+		if err := walk("."+k, v); err != nil {
+			return nil, errors.Wrap(err, "flatten config")
+		}
+	}
+	return leaves, nil
+}
+
+// SetConfigWithInfo is like SetConfig and records info in the config
+// history.
+func (r *encRepo) SetConfigWithInfo(updated *config.Config, info ConfigChangeInfo) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	return r.setConfig(ctx, updated, info)
+}
+
+// SetConfigKeyWithInfo is like SetConfigKey and records info in the config
+// history.
+func (r *encRepo) SetConfigKeyWithInfo(key string, value interface{}, info ConfigChangeInfo) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	return r.setConfigKey(ctx, key, value, info)
+}
+
+// ConfigHistory returns the config revisions, oldest first. The config
+// snapshots are omitted, use ConfigRevision to get them.
+func (r *encRepo) ConfigHistory() ([]ConfigRevision, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.closed {
+		return nil, errors.New("repo is closed")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	res, err := r.root.Query(ctx, query.Query{Prefix: configHistoryRevisionsPrefix.String()})
+	if err != nil {
+		return nil, err
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		return nil, err
+	}
+
+	revs := make([]ConfigRevision, len(entries))
+	for i, e := range entries {
+		if err := json.Unmarshal(e.Value, &revs[i]); err != nil {
+			return nil, errors.Wrap(err, "unmarshal config revision")
+		}
+		revs[i].Config = nil
+	}
+	sort.Slice(revs, func(i, j int) bool { return revs[i].ID < revs[j].ID })
+	return revs, nil
+}
+
+// ConfigRevision returns the config revision id.
+func (r *encRepo) ConfigRevision(id uint64) (*ConfigRevision, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.closed {
+		return nil, errors.New("repo is closed")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	return r.configRevision(ctx, id)
+}
+
+func (r *encRepo) configRevision(ctx context.Context, id uint64) (*ConfigRevision, error) {
+	revBytes, err := r.root.Get(ctx, configRevisionKey(id))
+	switch err {
+	case nil:
+	case datastore.ErrNotFound:
+		return nil, ErrConfigRevisionNotFound
+	default:
+		return nil, errors.Wrap(err, "get config revision")
+	}
+
+	var rev ConfigRevision
+	if err := json.Unmarshal(revBytes, &rev); err != nil {
+		return nil, errors.Wrap(err, "unmarshal config revision")
+	}
+	return &rev, nil
+}
+
+// DiffConfigRevisions returns the config keys changed between the revisions
+// from and to.
+func (r *encRepo) DiffConfigRevisions(from, to uint64) ([]ConfigDiff, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.closed {
+		return nil, errors.New("repo is closed")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	revFrom, err := r.configRevision(ctx, from)
+	if err != nil {
+		return nil, err
+	}
+	revTo, err := r.configRevision(ctx, to)
+	if err != nil {
+		return nil, err
+	}
+
+	return diffConfigs(revFrom.Config, revTo.Config)
+}
+
+// RollbackConfig atomically replaces the config with the snapshot of the
+// revision id, the rollback is recorded as a new revision. The private key
+// of the identity is kept.
+func (r *encRepo) RollbackConfig(id uint64, info ConfigChangeInfo) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return errors.New("repo is closed")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rev, err := r.configRevision(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	// keep the user-provided keys of the snapshot
+	var mapconf map[string]interface{}
+	if err := json.Unmarshal(rev.Config, &mapconf); err != nil {
+		return errors.Wrap(err, "unmarshal config revision")
+	}
+
+	// the snapshots don't hold the private key
+	var current map[string]interface{}
+	if err := readConfigFromDatastore(ctx, r.root, &current); err != nil {
+		return err
+	}
+	pkval, err := common.MapGetKV(current, config.PrivKeySelector)
+	if err != nil {
+		return err
+	}
+	if err := common.MapSetKV(mapconf, config.PrivKeySelector, pkval); err != nil {
+		return err
+	}
+
+	conf, err := config.FromMap(mapconf)
+	if err != nil {
+		return err
+	}
+
+	if info.Reason == "" {
+		info.Reason = fmt.Sprintf("rollback to revision %d", id)
+	}
+
+	if err := r.commitConfig(ctx, mapconf, info); err != nil {
+		return err
+	}
+
+	r.config = conf
+
+	return nil
+}
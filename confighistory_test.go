@@ -0,0 +1,96 @@
+package encrepo
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	config "github.com/ipfs/kubo/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigHistory(t *testing.T) {
+	key := testingKey(t)
+	opts := SQLCipherDatastoreOptions{JournalMode: "WAL"}
+	dbPath := filepath.Join(t.TempDir(), "db.sqlite")
+
+	require.NoError(t, Init(dbPath, key, opts, &config.Config{Identity: config.Identity{PeerID: "foo", PrivKey: "bar"}}))
+
+	r, err := Open(dbPath, key, opts)
+	require.NoError(t, err)
+	defer requireClose(t, r)
+	er := r.(Repo)
+
+	t.Log("change config")
+
+	require.NoError(t, er.SetConfigKeyWithInfo("Identity.PeerID", "bar", ConfigChangeInfo{Author: "alice", Reason: "new peer"}))
+	require.NoError(t, r.SetConfigKey("Swarm.ConnMgr.HighWater", 42))
+
+	revs, err := er.ConfigHistory()
+	require.NoError(t, err)
+	require.Len(t, revs, 3)
+
+	require.Equal(t, uint64(0), revs[0].ID)
+	require.Equal(t, "initial config", revs[0].Reason)
+	require.Contains(t, revs[0].ChangedKeys, "Identity.PeerID")
+
+	require.Equal(t, uint64(1), revs[1].ID)
+	require.Equal(t, ConfigChangeInfo{Author: "alice", Reason: "new peer"}, revs[1].ConfigChangeInfo)
+	require.Equal(t, []string{"Identity.PeerID"}, revs[1].ChangedKeys)
+	require.Nil(t, revs[1].Config)
+
+	require.Equal(t, uint64(2), revs[2].ID)
+	require.Contains(t, revs[2].ChangedKeys, "Swarm.ConnMgr.HighWater")
+
+	t.Log("diff revisions")
+
+	diffs, err := er.DiffConfigRevisions(0, 1)
+	require.NoError(t, err)
+	require.Equal(t, []ConfigDiff{{Key: "Identity.PeerID", Old: json.RawMessage(`"foo"`), New: json.RawMessage(`"bar"`)}}, diffs)
+
+	_, err = er.ConfigRevision(42)
+	require.ErrorIs(t, err, ErrConfigRevisionNotFound)
+
+	t.Log("rollback")
+
+	require.NoError(t, er.RollbackConfig(0, ConfigChangeInfo{Author: "bob"}))
+	conf, err := r.Config()
+	require.NoError(t, err)
+	require.Equal(t, "foo", conf.Identity.PeerID)
+	val, err := r.GetConfigKey("Identity.PeerID")
+	require.NoError(t, err)
+	require.Equal(t, "foo", val)
+
+	rev, err := er.ConfigRevision(3)
+	require.NoError(t, err)
+	require.Equal(t, ConfigChangeInfo{Author: "bob", Reason: "rollback to revision 0"}, rev.ConfigChangeInfo)
+	require.Contains(t, rev.ChangedKeys, "Identity.PeerID")
+
+	diffs, err = er.DiffConfigRevisions(0, 3)
+	require.NoError(t, err)
+	require.Empty(t, diffs)
+
+	t.Log("the snapshots don't hold the private key")
+	for _, id := range []uint64{0, 3} {
+		rev, err := er.ConfigRevision(id)
+		require.NoError(t, err)
+		require.NotContains(t, string(rev.Config), "PrivKey")
+	}
+
+	t.Log("rollback keeps the private key")
+	val, err = r.GetConfigKey("Identity.PrivKey")
+	require.NoError(t, err)
+	require.Equal(t, "bar", val)
+	require.Equal(t, "bar", conf.Identity.PrivKey)
+
+	t.Log("the oldest revisions are pruned")
+	for i := 0; i < configHistoryLimit; i++ {
+		require.NoError(t, r.SetConfigKey("Swarm.ConnMgr.HighWater", i))
+	}
+	revs, err = er.ConfigHistory()
+	require.NoError(t, err)
+	require.Len(t, revs, configHistoryLimit)
+	require.Equal(t, uint64(4), revs[0].ID)
+	_, err = er.ConfigRevision(3)
+	require.ErrorIs(t, err, ErrConfigRevisionNotFound)
+}
@@ -0,0 +1,56 @@
+package encrepo
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	config "github.com/ipfs/kubo/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContextVariants(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	canceled, cancelNow := context.WithCancel(context.Background())
+	cancelNow()
+
+	key := testingKey(t)
+	opts := SQLCipherDatastoreOptions{JournalMode: "WAL"}
+	dbPath := filepath.Join(t.TempDir(), "db.sqlite")
+	conf := &config.Config{Identity: config.Identity{PeerID: "foo", PrivKey: "bar"}}
+
+	t.Log("canceled init")
+	require.ErrorIs(t, InitContext(canceled, dbPath, key, opts, conf), context.Canceled)
+
+	require.NoError(t, InitContext(ctx, dbPath, key, opts, conf))
+	isInit, err := IsInitializedContext(ctx, dbPath, key, opts)
+	require.NoError(t, err)
+	require.True(t, isInit)
+	_, err = IsInitializedContext(canceled, dbPath, key, opts)
+	require.ErrorIs(t, err, context.Canceled)
+
+	t.Log("canceled open")
+	_, err = OpenContext(canceled, dbPath, key, opts)
+	require.ErrorIs(t, err, context.Canceled)
+
+	r, err := OpenContext(ctx, dbPath, key, opts)
+	require.NoError(t, err)
+	defer requireClose(t, r)
+	rc := r.(RepoContext)
+
+	require.NoError(t, rc.SetConfigKeyContext(ctx, "Identity.PeerID", "bar"))
+	require.Error(t, rc.SetConfigKeyContext(canceled, "Identity.PeerID", "baz"))
+	val, err := rc.GetConfigKeyContext(ctx, "Identity.PeerID")
+	require.NoError(t, err)
+	require.Equal(t, "bar", val)
+
+	t.Log("keystore")
+	ks := r.Keystore().(ContextKeystore)
+	_, err = ks.ListContext(canceled)
+	require.Error(t, err)
+	ids, err := ks.ListContext(ctx)
+	require.NoError(t, err)
+	require.Empty(t, ids)
+}
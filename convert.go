@@ -0,0 +1,307 @@
+package encrepo
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// ConvertStep is a step of a database conversion, see EncryptDatabase and
+// DecryptDatabase.
+type ConvertStep int
+
+const (
+	// ConvertStepExport is the copy of the database into a temporary database
+	ConvertStepExport ConvertStep = iota
+	// ConvertStepVerify is the comparison of the temporary database with the original one
+	ConvertStepVerify
+	// ConvertStepSwap is the replacement of the original database by the temporary one
+	ConvertStepSwap
+	// ConvertStepDone is reported once the conversion succeeded
+	ConvertStepDone
+)
+
+func (s ConvertStep) String() string {
+	switch s {
+	case ConvertStepExport:
+		return "export"
+	case ConvertStepVerify:
+		return "verify"
+	case ConvertStepSwap:
+		return "swap"
+	case ConvertStepDone:
+		return "done"
+	default:
+		return fmt.Sprintf("ConvertStep(%d)", int(s))
+	}
+}
+
+// ConvertProgressFunc is called when a conversion enters a new step.
+type ConvertProgressFunc func(step ConvertStep)
+
+// EncryptDatabase encrypts the plaintext database at dbPath in place, with
+// the given key and options. The repo must not be open in this process.
+//
+// The database is exported in a temporary file that atomically replaces the
+// original one once verified, on failure the original database is left
+// untouched. The separate database files mounted by Config.Datastore.Spec
+// are not converted.
+func EncryptDatabase(dbPath string, key []byte, opts SQLCipherDatastoreOptions, progress ConvertProgressFunc) error {
+	if len(key) == 0 {
+		return errors.New("missing key")
+	}
+
+	return convertDatabase(dbPath, nil, SQLCipherDatastoreOptions{}, key, opts, progress)
+}
+
+// DecryptDatabase decrypts the database at dbPath in place, it's the reverse
+// of EncryptDatabase and is intended for debugging and exports.
+func DecryptDatabase(dbPath string, key []byte, opts SQLCipherDatastoreOptions, progress ConvertProgressFunc) error {
+	if len(key) == 0 {
+		return errors.New("missing key, db is not encrypted")
+	}
+
+	return convertDatabase(dbPath, key, opts, nil, SQLCipherDatastoreOptions{JournalMode: opts.JournalMode}, progress)
+}
+
+func convertDatabase(dbPath string, srcKey []byte, srcOpts SQLCipherDatastoreOptions, dstKey []byte, dstOpts SQLCipherDatastoreOptions, progress ConvertProgressFunc) error {
+	if progress == nil {
+		progress = func(ConvertStep) {}
+	}
+
+	if len(dstKey) != 0 && len(dstKey) != keyLength {
+		return fmt.Errorf("bad key length, expected %d bytes, got %d", keyLength, len(dstKey))
+	}
+	if dstOpts.PlaintextHeader && len(dstOpts.Salt) != saltLength {
+		return fmt.Errorf("bad salt, expected %d bytes, got %d", saltLength, len(dstOpts.Salt))
+	}
+
+	return onlyOne.WithClosed(dbPath, func() error {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		if _, err := os.Stat(dbPath); os.IsNotExist(err) {
+			return ErrDatabaseNotFound
+		}
+
+		fileLock, err := lockRepoExclusive(ctx, dbPath, srcOpts.LockTimeout)
+		if err != nil {
+			return err
+		}
+		defer fileLock.Close()
+
+		tmpPath := dbPath + ".convert"
+		if err := removeDBFiles(tmpPath); err != nil {
+			return errors.Wrap(err, "remove stale temporary database")
+		}
+
+		if err := convertDB(ctx, dbPath, srcKey, srcOpts, tmpPath, dstKey, dstOpts, progress); err != nil {
+			// rollback, the original database was not modified
+			_ = removeDBFiles(tmpPath)
+			return err
+		}
+
+		progress(ConvertStepDone)
+		return nil
+	})
+}
+
+func convertDB(ctx context.Context, dbPath string, srcKey []byte, srcOpts SQLCipherDatastoreOptions, tmpPath string, dstKey []byte, dstOpts SQLCipherDatastoreOptions, progress ConvertProgressFunc) error {
+	progress(ConvertStepExport)
+
+	src, _, err := openSQLCipherDB(ctx, "sqlite3", dbPath, srcKey, srcOpts)
+	if err != nil {
+		return errors.Wrap(err, "open database")
+	}
+	srcCounts, err := exportDB(ctx, src, tmpPath, dstKey, dstOpts)
+	// closing the last connection checkpoints and removes the WAL
+	if cerr := src.Close(); err == nil && cerr != nil {
+		err = errors.Wrap(cerr, "close database")
+	}
+	if err != nil {
+		return err
+	}
+
+	progress(ConvertStepVerify)
+
+	dst, _, err := openSQLCipherDB(ctx, "sqlite3", tmpPath, dstKey, dstOpts)
+	if err != nil {
+		return errors.Wrap(err, "open exported database")
+	}
+	dstCounts, err := countRows(ctx, dst)
+	if cerr := dst.Close(); err == nil && cerr != nil {
+		err = errors.Wrap(cerr, "close exported database")
+	}
+	if err != nil {
+		return errors.Wrap(err, "verify exported database")
+	}
+	if len(srcCounts) != len(dstCounts) {
+		return fmt.Errorf("exported database has %d tables, expected %d", len(dstCounts), len(srcCounts))
+	}
+	for table, count := range srcCounts {
+		if dstCounts[table] != count {
+			return fmt.Errorf("exported table %s has %d rows, expected %d", table, dstCounts[table], count)
+		}
+	}
+
+	progress(ConvertStepSwap)
+
+	return swapDB(tmpPath, dbPath)
+}
+
+// exportDB copies the database in a new database at dstPath using
+// sqlcipher_export and returns the row count of each table
+func exportDB(ctx context.Context, db *sql.DB, dstPath string, dstKey []byte, dstOpts SQLCipherDatastoreOptions) (map[string]int64, error) {
+	// attached databases are per connection
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "get connection")
+	}
+	defer conn.Close()
+
+	counts, err := countRows(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	attach := "ATTACH DATABASE ? AS export KEY ''"
+	if len(dstKey) != 0 {
+		// the key is in the statement, an argument would be copied
+		q := hexSecret(`ATTACH DATABASE ? AS export KEY "x'`, dstKey, `'"`)
+		defer q.Close()
+		attach = q.String()
+	}
+	if _, err := conn.ExecContext(ctx, attach, dstPath); err != nil {
+		return nil, errors.Wrap(err, "attach database")
+	}
+
+	pragmas := []string{}
+	if len(dstKey) != 0 {
+		pragmas = append(pragmas, dstOpts.cipherSettings().exportPragmas("export")...)
+		if dstOpts.PlaintextHeader {
+			pragmas = append(pragmas, "PRAGMA export.cipher_plaintext_header_size = 32")
+			pragmas = append(pragmas, fmt.Sprintf(`PRAGMA export.cipher_salt = "x'%s'"`, hex.EncodeToString(dstOpts.Salt)))
+		}
+	}
+	pragmas = append(pragmas, "SELECT sqlcipher_export('export')")
+	for _, q := range pragmas {
+		if _, err := conn.ExecContext(ctx, q); err != nil {
+			_, _ = conn.ExecContext(ctx, "DETACH DATABASE export")
+			return nil, errors.Wrap(err, "export database")
+		}
+	}
+
+	if _, err := conn.ExecContext(ctx, "DETACH DATABASE export"); err != nil {
+		return nil, errors.Wrap(err, "detach database")
+	}
+
+	return counts, nil
+}
+
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// countRows returns the row count of each table of the main database
+func countRows(ctx context.Context, db queryer) (map[string]int64, error) {
+	rows, err := db.QueryContext(ctx, "SELECT name FROM main.sqlite_master WHERE type = 'table'")
+	if err != nil {
+		return nil, errors.Wrap(err, "list tables")
+	}
+	tables := []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			_ = rows.Close()
+			return nil, errors.Wrap(err, "list tables")
+		}
+		tables = append(tables, name)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "list tables")
+	}
+
+	counts := make(map[string]int64, len(tables))
+	for _, table := range tables {
+		var count int64
+		if err := db.QueryRowContext(ctx, fmt.Sprintf(`SELECT count(*) FROM main."%s"`, table)).Scan(&count); err != nil {
+			return nil, errors.Wrap(err, "count rows of "+table)
+		}
+		counts[table] = count
+	}
+	return counts, nil
+}
+
+// swapDB atomically replaces the database at dbPath with the one at srcPath
+func swapDB(srcPath, dbPath string) error {
+	// a leftover WAL would be applied to the new database
+	for _, suffix := range []string{"-wal", "-journal"} {
+		fi, err := os.Stat(dbPath + suffix)
+		if err == nil && fi.Size() != 0 {
+			return fmt.Errorf("database has a non-empty %s file", suffix)
+		}
+	}
+
+	if err := syncFile(srcPath); err != nil {
+		return errors.Wrap(err, "sync database")
+	}
+
+	if err := os.Rename(srcPath, dbPath); err != nil {
+		return errors.Wrap(err, "replace database")
+	}
+
+	for _, suffix := range dbSidecarSuffixes {
+		_ = os.Remove(dbPath + suffix)
+	}
+
+	// the cipher settings follow the database, there are none if it's not
+	// encrypted
+	err := os.Rename(CipherSettingsPath(srcPath), CipherSettingsPath(dbPath))
+	if os.IsNotExist(err) {
+		err = os.Remove(CipherSettingsPath(dbPath))
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "replace cipher settings")
+	}
+
+	// best effort, not supported on all platforms
+	_ = syncFile(filepath.Dir(dbPath))
+
+	return nil
+}
+
+// dbSidecarSuffixes are the suffixes of the files SQLite creates next to a
+// database
+var dbSidecarSuffixes = []string{"-wal", "-shm", "-journal"}
+
+// removeDBFiles removes the database at dbPath, its sidecar files and
+// cipher settings
+func removeDBFiles(dbPath string) error {
+	for _, suffix := range append([]string{""}, dbSidecarSuffixes...) {
+		if err := os.Remove(dbPath + suffix); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Remove(CipherSettingsPath(dbPath)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func syncFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,67 @@
+package encrepo
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+	config "github.com/ipfs/kubo/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryptDecryptDatabase(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	key := testingKey(t)
+	salt := testingSalt(t)
+	opts := SQLCipherDatastoreOptions{PlaintextHeader: true, Salt: salt, JournalMode: "WAL"}
+	dbPath := filepath.Join(t.TempDir(), "db.sqlite")
+
+	t.Log("create a plaintext repo")
+	require.NoError(t, Init(dbPath, nil, SQLCipherDatastoreOptions{JournalMode: "WAL"}, &config.Config{}))
+	r, err := Open(dbPath, nil, SQLCipherDatastoreOptions{JournalMode: "WAL"})
+	require.NoError(t, err)
+	require.NoError(t, r.Datastore().Put(ctx, datastore.NewKey("foo"), []byte("bar")))
+
+	require.ErrorIs(t, EncryptDatabase(dbPath, key, opts, nil), ErrRepoOpen)
+	require.NoError(t, r.Close())
+
+	t.Log("encrypt it")
+	steps := []ConvertStep{}
+	require.NoError(t, EncryptDatabase(dbPath, key, opts, func(step ConvertStep) { steps = append(steps, step) }))
+	require.Equal(t, []ConvertStep{ConvertStepExport, ConvertStepVerify, ConvertStepSwap, ConvertStepDone}, steps)
+
+	_, err = os.Stat(dbPath + ".convert")
+	require.True(t, os.IsNotExist(err))
+
+	r, err = Open(dbPath, key, opts)
+	require.NoError(t, err)
+	val, err := r.Datastore().Get(ctx, datastore.NewKey("foo"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("bar"), val)
+	require.NoError(t, r.Close())
+
+	t.Log("encrypting twice fails and keeps the database")
+	require.Error(t, EncryptDatabase(dbPath, testingKey(t), SQLCipherDatastoreOptions{}, nil))
+	isInit, err := IsInitialized(dbPath, key, opts)
+	require.NoError(t, err)
+	require.True(t, isInit)
+
+	t.Log("decrypt it")
+	require.NoError(t, DecryptDatabase(dbPath, key, opts, nil))
+
+	ds, err := NewSQLiteDatastore("sqlite3", dbPath, tableName)
+	require.NoError(t, err)
+	defer requireClose(t, ds)
+	val, err = ds.Get(ctx, datastore.NewKey("/data/foo"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("bar"), val)
+}
+
+func TestEncryptDatabaseNotFound(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "db.sqlite")
+	require.ErrorIs(t, EncryptDatabase(dbPath, testingKey(t), SQLCipherDatastoreOptions{}, nil), ErrDatabaseNotFound)
+}
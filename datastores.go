@@ -0,0 +1,557 @@
+package encrepo
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+
+	"github.com/ipfs/boxo/blockstore"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/mount"
+	sync_ds "github.com/ipfs/go-datastore/sync"
+	measure "github.com/ipfs/go-ds-measure"
+	sqlds "github.com/ipfs/go-ds-sql"
+	sqliteds "github.com/ipfs/go-ds-sql/sqlite"
+	"github.com/ipfs/kubo/repo"
+	"github.com/pkg/errors"
+)
+
+// The repo datastore is built from Config.Datastore.Spec, which follows the
+// format of kubo's fsrepo. The supported types are "mount", "measure", "log"
+// "sqlcipher" and "sqlcipherblocks", e.g.
+//
+//	{
+//	  "type": "mount",
+//	  "mounts": [
+//	    {"mountpoint": "/blocks", "type": "sqlcipherblocks", "path": "blocks.sqlite"},
+//	    {"mountpoint": "/", "type": "sqlcipher"}
+//	  ]
+//	}
+//
+// A "sqlcipher" datastore without "path" is a table of the main database,
+// the default "ipfs" table being the one holding the config. With "path" it's
+// a table of a separate database file, relative to the directory of the main
+// database, encrypted with the same key and with its own "journalMode",
+// "plaintextHeader" and hex encoded "salt". A "sqlcipherblocks" datastore
+// takes the same parameters and stores the blocks by binary multihash in the
+// "blocks" table by default, see blocksTable.
+
+// datastoreSpecKey stores the disk spec of the datastore, to detect changes
+// of Config.Datastore.Spec that would make the data unreachable
+var datastoreSpecKey = ds.NewKey("datastore_spec")
+
+var tableNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// datastoreConfig is a parsed spec node, it mirrors fsrepo.DatastoreConfig.
+type datastoreConfig interface {
+	// diskSpec returns the part of the spec that describes what is stored on
+	// disk, runtime values are excluded.
+	diskSpec() diskSpec
+
+	// create instantiates the datastore.
+	create(ctx context.Context, env *datastoreEnv) (repo.Datastore, error)
+
+	// dbFiles returns the separate database files used by the datastore.
+	dbFiles(dbPath string, opts SQLCipherDatastoreOptions) []dbFile
+}
+
+type diskSpec map[string]interface{}
+
+func (spec diskSpec) bytes() []byte {
+	b, err := json.Marshal(spec)
+	if err != nil {
+		// should not happen
+		panic(err)
+	}
+	return bytes.TrimSpace(b)
+}
+
+// dbFile is a separate database file with its options
+type dbFile struct {
+	path string
+	opts SQLCipherDatastoreOptions
+}
+
+var datastoreConfigs map[string]func(params map[string]interface{}) (datastoreConfig, error)
+
+func init() {
+	datastoreConfigs = map[string]func(params map[string]interface{}) (datastoreConfig, error){
+		"mount":           mountDatastoreConfigFromMap,
+		"measure":         measureDatastoreConfigFromMap,
+		"log":             logDatastoreConfigFromMap,
+		"sqlcipher":       sqlcipherDatastoreConfigFromMap,
+		"sqlcipherblocks": sqlcipherBlocksDatastoreConfigFromMap,
+	}
+}
+
+// parseDatastoreSpec parses a Config.Datastore.Spec, an empty spec is the
+// main table of the main database, as in the repos created before the spec
+// was supported.
+func parseDatastoreSpec(spec map[string]interface{}) (datastoreConfig, error) {
+	if len(spec) == 0 {
+		return &sqlcipherDatastoreConfig{}, nil
+	}
+	dsc, err := anyDatastoreConfig(spec)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse Config.Datastore.Spec")
+	}
+	return dsc, nil
+}
+
+func anyDatastoreConfig(params map[string]interface{}) (datastoreConfig, error) {
+	which, ok := params["type"].(string)
+	if !ok {
+		return nil, fmt.Errorf("'type' field missing or not a string")
+	}
+	fn, ok := datastoreConfigs[which]
+	if !ok {
+		return nil, fmt.Errorf("unsupported datastore type: %s", which)
+	}
+	return fn(params)
+}
+
+// datastoreEnv holds what the datastores are created from, and collects the
+// stores they open.
+type datastoreEnv struct {
+	dbPath string
+	key    []byte
+	opts   SQLCipherDatastoreOptions
+	root   *sync_ds.MutexDatastore
+	store  *sqlcipherStore
+
+	// mountpoint is the mountpoint of the datastore being created
+	mountpoint ds.Key
+
+	// locks are the mutexes of the mounted tables, they are held with the
+	// root one to block the datastore operations during a rekey
+	locks []*sync_ds.MutexDatastore
+	// files are the separate database files
+	files []*sqlcipherDB
+	// tables are the used tables, by database file
+	tables map[string]map[string]bool
+	// blockstore is the blocks table mounted at /blocks, if any
+	blockstore *sqlBlockstore
+}
+
+func (env *datastoreEnv) useTable(path, table string) error {
+	if env.tables == nil {
+		env.tables = make(map[string]map[string]bool)
+	}
+	if env.tables[path] == nil {
+		env.tables[path] = make(map[string]bool)
+	}
+	if env.tables[path][table] {
+		return fmt.Errorf("table %s of %s is used by several datastores", table, path)
+	}
+	env.tables[path][table] = true
+	return nil
+}
+
+// close closes the separate database files
+func (env *datastoreEnv) close() error {
+	var err error
+	for _, s := range env.files {
+		if cerr := s.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+type mountDatastoreConfig struct {
+	mounts []premount
+}
+
+type premount struct {
+	ds     datastoreConfig
+	prefix ds.Key
+}
+
+func mountDatastoreConfigFromMap(params map[string]interface{}) (datastoreConfig, error) {
+	var res mountDatastoreConfig
+	mounts, ok := params["mounts"].([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("'mounts' field is missing or not an array")
+	}
+	for _, iface := range mounts {
+		cfg, ok := iface.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("expected map for mountpoint")
+		}
+
+		child, err := anyDatastoreConfig(cfg)
+		if err != nil {
+			return nil, err
+		}
+
+		prefix, ok := cfg["mountpoint"].(string)
+		if !ok {
+			return nil, fmt.Errorf("'mountpoint' field is missing or not a string")
+		}
+
+		res.mounts = append(res.mounts, premount{
+			ds:     child,
+			prefix: ds.NewKey(prefix),
+		})
+	}
+	sort.Slice(res.mounts, func(i, j int) bool {
+		return res.mounts[i].prefix.String() > res.mounts[j].prefix.String()
+	})
+
+	return &res, nil
+}
+
+func (c *mountDatastoreConfig) diskSpec() diskSpec {
+	mounts := make([]interface{}, len(c.mounts))
+	for i, m := range c.mounts {
+		spec := m.ds.diskSpec()
+		spec["mountpoint"] = m.prefix.String()
+		mounts[i] = spec
+	}
+	return diskSpec{"type": "mount", "mounts": mounts}
+}
+
+func (c *mountDatastoreConfig) create(ctx context.Context, env *datastoreEnv) (repo.Datastore, error) {
+	mounts := make([]mount.Mount, len(c.mounts))
+	parent := env.mountpoint
+	defer func() { env.mountpoint = parent }()
+
+	for i, m := range c.mounts {
+		env.mountpoint = ds.NewKey(parent.String() + m.prefix.String())
+		child, err := m.ds.create(ctx, env)
+		if err != nil {
+			return nil, err
+		}
+		mounts[i].Datastore = child
+		mounts[i].Prefix = m.prefix
+	}
+	return mount.New(mounts), nil
+}
+
+func (c *mountDatastoreConfig) dbFiles(dbPath string, opts SQLCipherDatastoreOptions) []dbFile {
+	var files []dbFile
+	for _, m := range c.mounts {
+		files = append(files, m.ds.dbFiles(dbPath, opts)...)
+	}
+	return files
+}
+
+type logDatastoreConfig struct {
+	child datastoreConfig
+	name  string
+}
+
+func logDatastoreConfigFromMap(params map[string]interface{}) (datastoreConfig, error) {
+	childField, ok := params["child"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("'child' field is missing or not a map")
+	}
+	child, err := anyDatastoreConfig(childField)
+	if err != nil {
+		return nil, err
+	}
+	name, ok := params["name"].(string)
+	if !ok {
+		return nil, fmt.Errorf("'name' field was missing or not a string")
+	}
+	return &logDatastoreConfig{child, name}, nil
+}
+
+func (c *logDatastoreConfig) diskSpec() diskSpec {
+	return c.child.diskSpec()
+}
+
+func (c *logDatastoreConfig) create(ctx context.Context, env *datastoreEnv) (repo.Datastore, error) {
+	child, err := c.child.create(ctx, env)
+	if err != nil {
+		return nil, err
+	}
+	return ds.NewLogDatastore(child, c.name), nil
+}
+
+func (c *logDatastoreConfig) dbFiles(dbPath string, opts SQLCipherDatastoreOptions) []dbFile {
+	return c.child.dbFiles(dbPath, opts)
+}
+
+type measureDatastoreConfig struct {
+	child  datastoreConfig
+	prefix string
+}
+
+func measureDatastoreConfigFromMap(params map[string]interface{}) (datastoreConfig, error) {
+	childField, ok := params["child"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("'child' field is missing or not a map")
+	}
+	child, err := anyDatastoreConfig(childField)
+	if err != nil {
+		return nil, err
+	}
+	prefix, ok := params["prefix"].(string)
+	if !ok {
+		return nil, fmt.Errorf("'prefix' field was missing or not a string")
+	}
+	return &measureDatastoreConfig{child, prefix}, nil
+}
+
+func (c *measureDatastoreConfig) diskSpec() diskSpec {
+	return c.child.diskSpec()
+}
+
+func (c *measureDatastoreConfig) create(ctx context.Context, env *datastoreEnv) (repo.Datastore, error) {
+	child, err := c.child.create(ctx, env)
+	if err != nil {
+		return nil, err
+	}
+	return measure.New(c.prefix, child), nil
+}
+
+func (c *measureDatastoreConfig) dbFiles(dbPath string, opts SQLCipherDatastoreOptions) []dbFile {
+	return c.child.dbFiles(dbPath, opts)
+}
+
+type sqlcipherDatastoreConfig struct {
+	// blocks is set for the "sqlcipherblocks" type
+	blocks bool
+
+	// path is the separate database file, the main database if empty
+	path  string
+	table string
+
+	journalMode     string
+	plaintextHeader bool
+	salt            []byte
+}
+
+func sqlcipherDatastoreConfigFromMap(params map[string]interface{}) (datastoreConfig, error) {
+	return parseSQLCipherDatastoreConfig(params, false)
+}
+
+func sqlcipherBlocksDatastoreConfigFromMap(params map[string]interface{}) (datastoreConfig, error) {
+	return parseSQLCipherDatastoreConfig(params, true)
+}
+
+func parseSQLCipherDatastoreConfig(params map[string]interface{}, blocks bool) (datastoreConfig, error) {
+	c := sqlcipherDatastoreConfig{blocks: blocks}
+	var ok bool
+
+	if v, found := params["path"]; found {
+		if c.path, ok = v.(string); !ok {
+			return nil, fmt.Errorf("'path' field is not a string")
+		}
+	}
+
+	if v, found := params["table"]; found {
+		if c.table, ok = v.(string); !ok {
+			return nil, fmt.Errorf("'table' field is not a string")
+		}
+		if !tableNameRegexp.MatchString(c.table) {
+			return nil, fmt.Errorf("invalid table name %q", c.table)
+		}
+		if c.blocks && c.table == tableName {
+			return nil, fmt.Errorf("table %s can't store blocks", tableName)
+		}
+	}
+
+	if v, found := params["journalMode"]; found {
+		if c.journalMode, ok = v.(string); !ok {
+			return nil, fmt.Errorf("'journalMode' field is not a string")
+		}
+	}
+
+	if v, found := params["plaintextHeader"]; found {
+		if c.plaintextHeader, ok = v.(bool); !ok {
+			return nil, fmt.Errorf("'plaintextHeader' field is not a bool")
+		}
+	}
+
+	if v, found := params["salt"]; found {
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("'salt' field is not a string")
+		}
+		var err error
+		if c.salt, err = hex.DecodeString(s); err != nil {
+			return nil, errors.Wrap(err, "decode salt")
+		}
+	}
+
+	if c.path == "" {
+		if c.journalMode != "" || c.plaintextHeader || c.salt != nil {
+			return nil, errors.New("the options of the main database can't be set in the spec")
+		}
+	} else if c.plaintextHeader && len(c.salt) != saltLength {
+		return nil, fmt.Errorf("bad salt, expected %d bytes, got %d", saltLength, len(c.salt))
+	}
+
+	return &c, nil
+}
+
+func (c *sqlcipherDatastoreConfig) diskSpec() diskSpec {
+	spec := diskSpec{"type": "sqlcipher"}
+	if c.blocks {
+		spec["type"] = "sqlcipherblocks"
+	}
+	if c.path != "" {
+		spec["path"] = c.path
+	}
+	spec["table"] = c.tableName()
+	if c.plaintextHeader {
+		spec["plaintextHeader"] = true
+		spec["salt"] = hex.EncodeToString(c.salt)
+	}
+	return spec
+}
+
+func (c *sqlcipherDatastoreConfig) tableName() string {
+	switch {
+	case c.table != "":
+		return c.table
+	case c.blocks:
+		return defaultBlocksTable
+	default:
+		return tableName
+	}
+}
+
+// file returns the separate database file, if any
+func (c *sqlcipherDatastoreConfig) file(dbPath string, opts SQLCipherDatastoreOptions) (dbFile, bool) {
+	if c.path == "" {
+		return dbFile{}, false
+	}
+
+	path := c.path
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(filepath.Dir(dbPath), path)
+	}
+
+	// the other options are the ones of the main database
+	fileOpts := opts
+	fileOpts.PlaintextHeader = c.plaintextHeader
+	fileOpts.Salt = c.salt
+	if c.journalMode != "" {
+		fileOpts.JournalMode = c.journalMode
+	}
+
+	return dbFile{path: path, opts: fileOpts}, true
+}
+
+func (c *sqlcipherDatastoreConfig) dbFiles(dbPath string, opts SQLCipherDatastoreOptions) []dbFile {
+	if f, ok := c.file(dbPath, opts); ok {
+		return []dbFile{f}
+	}
+	return nil
+}
+
+func (c *sqlcipherDatastoreConfig) create(ctx context.Context, env *datastoreEnv) (repo.Datastore, error) {
+	table := c.tableName()
+
+	var db *sql.DB
+	if f, separate := c.file(env.dbPath, env.opts); separate {
+		if filepath.Clean(f.path) == filepath.Clean(env.dbPath) {
+			return nil, errors.New("the separate database path is the main database")
+		}
+		if _, ok := env.tables[f.path]; ok {
+			// a file is opened once, so it's rekeyed once
+			return nil, fmt.Errorf("%s is used by several datastores", f.path)
+		}
+		if err := env.useTable(f.path, table); err != nil {
+			return nil, err
+		}
+
+		fdb, connector, err := openSQLCipherDB(ctx, "sqlite3", f.path, env.key, f.opts)
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("open %s", f.path))
+		}
+		env.files = append(env.files, &sqlcipherDB{DB: fdb, connector: connector})
+		db = fdb
+	} else {
+		if err := env.useTable(env.dbPath, table); err != nil {
+			return nil, err
+		}
+
+		// the main table also holds the config and keystore
+		if !c.blocks && table == tableName {
+			return NewNamespacedDatastore(env.root, ds.NewKey("data")), nil
+		}
+
+		db = env.store.db.DB
+	}
+
+	if c.blocks {
+		t, err := newBlocksTable(ctx, db, table)
+		if err != nil {
+			return nil, err
+		}
+		mds := sync_ds.MutexWrap(&tableDatastore{&blocksDatastore{t: t}})
+		env.locks = append(env.locks, mds)
+		if env.mountpoint.Equal(blockstore.BlockPrefix) {
+			env.blockstore = &sqlBlockstore{t: t, mu: &mds.RWMutex, readOnly: env.opts.ReadOnly}
+		}
+		return mds, nil
+	}
+
+	if err := createTable(ctx, db, table); err != nil {
+		return nil, err
+	}
+	mds := sync_ds.MutexWrap(&tableDatastore{sqlds.NewDatastore(db, sqliteds.NewQueries(table))})
+	env.locks = append(env.locks, mds)
+	return mds, nil
+}
+
+// tableDatastore is a table of a database that is closed with the repo
+type tableDatastore struct {
+	ds.Batching
+}
+
+func (s *tableDatastore) Close() error {
+	// noop
+	return nil
+}
+
+// createDatastore creates the repo datastore from the spec, the separate
+// database files are closed if it fails
+func createDatastore(ctx context.Context, dsc datastoreConfig, env *datastoreEnv) (repo.Datastore, error) {
+	if err := checkDatastoreSpec(ctx, env.root, dsc, env.opts.ReadOnly); err != nil {
+		return nil, err
+	}
+
+	d, err := dsc.create(ctx, env)
+	if err != nil {
+		_ = env.close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// checkDatastoreSpec compares the disk spec with the stored one, it's stored
+// if missing unless readOnly
+func checkDatastoreSpec(ctx context.Context, root ds.Datastore, dsc datastoreConfig, readOnly bool) error {
+	spec := dsc.diskSpec().bytes()
+
+	stored, err := root.Get(ctx, datastoreSpecKey)
+	switch err {
+	case nil:
+		if !bytes.Equal(stored, spec) {
+			return fmt.Errorf("datastore configuration of '%s' does not match what's on disk '%s'", spec, stored)
+		}
+		return nil
+	case ds.ErrNotFound:
+		if readOnly {
+			// stored by the next read-write open
+			return nil
+		}
+		if err := root.Put(ctx, datastoreSpecKey, spec); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("put '%s' in ds", datastoreSpecKey))
+		}
+		return nil
+	default:
+		return errors.Wrap(err, "get datastore spec")
+	}
+}
@@ -0,0 +1,135 @@
+package encrepo
+
+import (
+	"context"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+	config "github.com/ipfs/kubo/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDatastoreSpec(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	key := testingKey(t)
+	newKey := testingKey(t)
+	blocksSalt := testingSalt(t)
+	opts := SQLCipherDatastoreOptions{JournalMode: "WAL"}
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "db.sqlite")
+	blocksPath := filepath.Join(dir, "blocks.sqlite")
+	blocksOpts := SQLCipherDatastoreOptions{PlaintextHeader: true, Salt: blocksSalt, JournalMode: "WAL"}
+
+	conf := &config.Config{Identity: config.Identity{PeerID: "foo", PrivKey: "bar"}, Datastore: config.Datastore{Spec: map[string]interface{}{
+		"type": "mount",
+		"mounts": []interface{}{
+			map[string]interface{}{
+				"mountpoint": "/blocks",
+				"type":       "measure",
+				"prefix":     "sqlcipher.blocks",
+				"child": map[string]interface{}{
+					"type":            "sqlcipher",
+					"path":            "blocks.sqlite",
+					"table":           "blocks",
+					"plaintextHeader": true,
+					"salt":            hex.EncodeToString(blocksSalt),
+				},
+			},
+			map[string]interface{}{
+				"mountpoint": "/pins",
+				"type":       "log",
+				"name":       "pins",
+				"child":      map[string]interface{}{"type": "sqlcipher", "table": "pins"},
+			},
+			map[string]interface{}{
+				"mountpoint": "/",
+				"type":       "sqlcipher",
+			},
+		},
+	}}}
+
+	require.NoError(t, Init(dbPath, key, opts, conf))
+
+	r, err := Open(dbPath, key, opts)
+	require.NoError(t, err)
+	require.NoError(t, r.Datastore().Put(ctx, datastore.NewKey("/blocks/foo"), []byte("foo")))
+	require.NoError(t, r.Datastore().Put(ctx, datastore.NewKey("/pins/bar"), []byte("bar")))
+	require.NoError(t, r.Datastore().Put(ctx, datastore.NewKey("/baz"), []byte("baz")))
+
+	t.Log("rekey the main and separate databases")
+	require.NoError(t, r.(Repo).Rekey(newKey))
+	val, err := r.Datastore().Get(ctx, datastore.NewKey("/blocks/foo"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("foo"), val)
+	require.NoError(t, r.Close())
+
+	t.Log("check the tables")
+	blocks, err := OpenSQLCipherDatastore("sqlite3", blocksPath, "blocks", newKey, blocksOpts)
+	require.NoError(t, err)
+	val, err = blocks.Get(ctx, datastore.NewKey("/foo"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("foo"), val)
+	require.NoError(t, blocks.Close())
+
+	pins, err := OpenSQLCipherDatastore("sqlite3", dbPath, "pins", newKey, opts)
+	require.NoError(t, err)
+	val, err = pins.Get(ctx, datastore.NewKey("/bar"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("bar"), val)
+	require.NoError(t, pins.Close())
+
+	main, err := OpenSQLCipherDatastore("sqlite3", dbPath, tableName, newKey, opts)
+	require.NoError(t, err)
+	val, err = main.Get(ctx, datastore.NewKey("/data/baz"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("baz"), val)
+	require.NoError(t, main.Close())
+
+	t.Log("offline rekey")
+	require.NoError(t, Rekey(dbPath, newKey, key, opts))
+	r, err = Open(dbPath, key, opts)
+	require.NoError(t, err)
+	val, err = r.Datastore().Get(ctx, datastore.NewKey("/blocks/foo"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("foo"), val)
+
+	t.Log("refuse to open with a changed spec")
+	require.NoError(t, r.SetConfigKey("Datastore.Spec", map[string]interface{}{"type": "sqlcipher", "table": "other"}))
+	require.NoError(t, r.Close())
+	_, err = Open(dbPath, key, opts)
+	require.ErrorContains(t, err, "does not match")
+}
+
+func TestDatastoreSpecInvalid(t *testing.T) {
+	key := testingKey(t)
+	opts := SQLCipherDatastoreOptions{JournalMode: "WAL"}
+
+	for _, spec := range []map[string]interface{}{
+		config.DefaultDatastoreConfig().Spec,
+		{"type": "sqlcipher", "table": "bad;table"},
+		{"type": "sqlcipher", "journalMode": "DELETE"},
+		{"type": "sqlcipher", "path": "other.sqlite", "plaintextHeader": true},
+	} {
+		dbPath := filepath.Join(t.TempDir(), "db.sqlite")
+		require.Error(t, Init(dbPath, key, opts, &config.Config{Datastore: config.Datastore{Spec: spec}}), spec)
+		_, err := os.Stat(dbPath)
+		require.True(t, os.IsNotExist(err))
+	}
+
+	t.Log("refuse to use a table twice")
+	dbPath := filepath.Join(t.TempDir(), "db.sqlite")
+	require.NoError(t, Init(dbPath, key, opts, &config.Config{Datastore: config.Datastore{Spec: map[string]interface{}{
+		"type": "mount",
+		"mounts": []interface{}{
+			map[string]interface{}{"mountpoint": "/a", "type": "sqlcipher", "table": "a"},
+			map[string]interface{}{"mountpoint": "/b", "type": "sqlcipher", "table": "a"},
+		},
+	}}}))
+	_, err := Open(dbPath, key, opts)
+	require.ErrorContains(t, err, "used by several datastores")
+}
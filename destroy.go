@@ -0,0 +1,140 @@
+package encrepo
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DestroyOptions are the options of Destroy.
+type DestroyOptions struct {
+	// CryptoErase overwrites the key material of the repo with random data
+	// before removing it: the header of the database, holding the SQLCipher
+	// salt unless the header is plaintext, its sidecar files, the KDF
+	// descriptor, the key slots and the duress key. The passphrases and key
+	// slots can't unlock the remains of the database left by the storage,
+	// on flash notably, but the raw key still can.
+	CryptoErase bool
+	// LockTimeout is how long to wait for another process to close the
+	// repo, see SQLCipherDatastoreOptions.LockTimeout.
+	LockTimeout time.Duration
+}
+
+// destroyedTmpSuffixes are the suffixes of the temporary databases left next
+// to a repo by an interrupted restore or conversion
+var destroyedTmpSuffixes = []string{".restore", ".convert"}
+
+// Destroy removes the repo at dbPath: the database with its sidecar files,
+// cipher settings, KDF descriptor, key slots and duress key. The lock files
+// are kept, see LockPath.
+// The repo must not be open in this process, ErrRepoOpen is returned
+// otherwise, nor in another one, read-only or not, see ErrRepoLocked. The
+// separate database files mounted by Config.Datastore.Spec are not removed.
+func Destroy(dbPath string, opts DestroyOptions) error {
+	return onlyOne.WithClosed(dbPath, func() error {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		fileLock, err := lockRepoExclusive(ctx, dbPath, opts.LockTimeout)
+		if err != nil {
+			return err
+		}
+
+		// the lock files are kept, the processes waiting for them find no
+		// repo once they get them
+		err = destroyRepoFiles(dbPath, opts)
+		if cerr := fileLock.Close(); err == nil && cerr != nil {
+			err = errors.Wrap(cerr, "unlock repo")
+		}
+		return err
+	})
+}
+
+// destroyRepoFiles removes the files of the repo at dbPath but the lock
+func destroyRepoFiles(dbPath string, opts DestroyOptions) error {
+	if opts.CryptoErase {
+		if err := cryptoEraseRepo(dbPath); err != nil {
+			return errors.Wrap(err, "crypto-erase repo")
+		}
+	}
+
+	for _, suffix := range destroyedTmpSuffixes {
+		if err := removeDBFiles(dbPath + suffix); err != nil {
+			return errors.Wrap(err, "remove temporary database")
+		}
+	}
+	if err := removeDBFiles(dbPath); err != nil {
+		return errors.Wrap(err, "remove database")
+	}
+	for _, path := range keyMaterialPaths(dbPath) {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "remove key material")
+		}
+	}
+	return nil
+}
+
+// cryptoEraseRepo overwrites the first page of the database and the whole
+// sidecar and key material files
+func cryptoEraseRepo(dbPath string) error {
+	pageSize := int64(cipherDefaults[defaultCipherCompatibility].PageSize)
+	if s, err := readCipherSettings(dbPath); err == nil && s.PageSize != 0 {
+		pageSize = int64(s.PageSize)
+	}
+	if err := overwriteFile(dbPath, pageSize); err != nil {
+		return err
+	}
+
+	paths := keyMaterialPaths(dbPath)
+	for _, suffix := range dbSidecarSuffixes {
+		paths = append(paths, dbPath+suffix)
+	}
+	for _, path := range paths {
+		if err := overwriteFile(path, -1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// keyMaterialPaths returns the paths of the files next to the database at
+// dbPath holding key material
+func keyMaterialPaths(dbPath string) []string {
+	return []string{KDFDescriptorPath(dbPath), KeySlotsPath(dbPath), DuressKeyPath(dbPath)}
+}
+
+// overwriteFile overwrites the first n bytes of the file at path with random
+// data and syncs it, the whole file if n is negative. A missing file is
+// ignored.
+func overwriteFile(path string, n int64) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	fi, err := f.Stat()
+	if err == nil {
+		if n < 0 || n > fi.Size() {
+			n = fi.Size()
+		}
+		_, err = io.CopyN(f, rand.Reader, n)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("overwrite %s", path))
+	}
+	return nil
+}
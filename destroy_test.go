@@ -0,0 +1,86 @@
+package encrepo
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	config "github.com/ipfs/kubo/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDestroy(t *testing.T) {
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "db.sqlite")
+	key := testingKey(t)
+	opts := SQLCipherDatastoreOptions{JournalMode: "WAL"}
+	require.NoError(t, Init(dbPath, key, opts, &config.Config{Datastore: testingDatastoreConfig()}))
+
+	t.Log("an open repo can't be destroyed")
+	r, err := Open(dbPath, key, opts)
+	require.NoError(t, err)
+	require.ErrorIs(t, Destroy(dbPath, DestroyOptions{}), ErrRepoOpen)
+	_, err = os.Stat(dbPath + "-wal")
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+
+	t.Log("nor a repo locked by another process")
+	fileLock, err := lockRepoFile(context.Background(), dbPath, 0)
+	require.NoError(t, err)
+	require.ErrorIs(t, Destroy(dbPath, DestroyOptions{}), ErrRepoLocked)
+	require.NoError(t, fileLock.Close())
+
+	t.Log("a process waiting for the lock finds no repo")
+	fileLock, err = lockRepoExclusive(context.Background(), dbPath, 0)
+	require.NoError(t, err)
+	opened := make(chan error)
+	go func() {
+		_, err := Open(dbPath, key, SQLCipherDatastoreOptions{LockTimeout: time.Minute})
+		opened <- err
+	}()
+	time.Sleep(5 * lockPollInterval)
+	require.NoError(t, destroyRepoFiles(dbPath, DestroyOptions{}))
+	require.NoError(t, fileLock.Close())
+	require.ErrorIs(t, <-opened, ErrDatabaseNotFound)
+	require.Equal(t, []string{"db.sqlite.lock", "db.sqlite.readers.lock"}, testingRepoFiles(t, dir))
+	require.NoError(t, Init(dbPath, key, opts, &config.Config{Datastore: testingDatastoreConfig()}))
+
+	require.NoError(t, os.WriteFile(dbPath+"-journal", []byte("journal"), 0o600))
+	require.NoError(t, Destroy(dbPath, DestroyOptions{}))
+	require.Equal(t, []string{"db.sqlite.lock", "db.sqlite.readers.lock"}, testingRepoFiles(t, dir), "only the lock files are kept")
+
+	require.NoError(t, Destroy(dbPath, DestroyOptions{}), "destroying a missing repo")
+}
+
+func TestDestroyCryptoErase(t *testing.T) {
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "db.sqlite")
+	passphrase := []byte("correct horse battery staple")
+	opts := SQLCipherDatastoreOptions{PlaintextHeader: true, JournalMode: "WAL"}
+	require.NoError(t, InitWithKeySlot(dbPath, "passphrase", passphrase, &testingKDFParams, opts, &config.Config{}))
+
+	header, err := os.ReadFile(dbPath)
+	require.NoError(t, err)
+	slots, err := os.ReadFile(KeySlotsPath(dbPath))
+	require.NoError(t, err)
+
+	t.Log("the key material is overwritten")
+	require.NoError(t, cryptoEraseRepo(dbPath))
+	erased, err := os.ReadFile(dbPath)
+	require.NoError(t, err)
+	require.Len(t, erased, len(header))
+	require.False(t, bytes.Equal(header[:4096], erased[:4096]))
+	require.Equal(t, header[4096:], erased[4096:], "only the first page is overwritten")
+	erasedSlots, err := os.ReadFile(KeySlotsPath(dbPath))
+	require.NoError(t, err)
+	require.NotEqual(t, slots, erasedSlots)
+
+	_, err = OpenWithKeySlot(dbPath, passphrase, SQLCipherDatastoreOptions{})
+	require.Error(t, err)
+
+	require.NoError(t, Destroy(dbPath, DestroyOptions{CryptoErase: true}))
+	require.Equal(t, []string{"db.sqlite.lock", "db.sqlite.readers.lock"}, testingRepoFiles(t, dir))
+}
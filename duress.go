@@ -0,0 +1,234 @@
+package encrepo
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	config "github.com/ipfs/kubo/config"
+	"github.com/pkg/errors"
+)
+
+// A duress key is a key that, given to Open instead of the key of the repo,
+// crypto-erases the repo and opens a new one initialized with a decoy config,
+// like a new install. The decoy config is stored next to the database,
+// encrypted with the duress key, so the duress key is only recognized by
+// decrypting it and the file is removed with the repo.
+
+// duressInfo is the HKDF info of the key encrypting the duress payload
+const duressInfo = "encrepo duress key"
+
+// duressKeyFile is the file storing the duress payload
+type duressKeyFile struct {
+	Nonce  []byte `json:"nonce"`
+	Sealed []byte `json:"sealed"`
+}
+
+// duressPayload is what is needed to replace the repo with a decoy
+type duressPayload struct {
+	Config *config.Config `json:"config"`
+	// Files are the separate database files of the repo
+	Files []string `json:"files,omitempty"`
+}
+
+// DuressKeyPath returns the path of the duress key of the database at
+// dbPath.
+func DuressKeyPath(dbPath string) string {
+	return dbPath + ".duress"
+}
+
+// SetDuressKey sets the duress key of the repo at dbPath, replacing the
+// previous one. When duressKey is given to Open, the repo and the separate
+// database files mounted by its Config.Datastore.Spec are crypto-erased, see
+// DestroyOptions.CryptoErase, and a new repo is initialized with duressKey
+// and decoy, which should be the config of a new install. The repo must not
+// be open in this process when duressKey is given to Open. key must open the
+// repo, the repos opened with a key slot or a passphrase have no duress key.
+func SetDuressKey(dbPath string, key, duressKey []byte, opts SQLCipherDatastoreOptions, decoy *config.Config) error {
+	if len(duressKey) != keyLength {
+		return fmt.Errorf("bad duress key length, expected %d bytes, got %d", keyLength, len(duressKey))
+	}
+	if bytes.Equal(key, duressKey) {
+		return errors.New("the duress key is the key of the repo")
+	}
+	if decoy == nil {
+		return errors.New("no decoy config")
+	}
+	if _, err := parseDatastoreSpec(decoy.Datastore.Spec); err != nil {
+		return errors.Wrap(err, "decoy config")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r, err := OpenContext(ctx, dbPath, key, opts)
+	if err != nil {
+		return err
+	}
+	files, err := specDBFiles(ctx, r.(*encRepo).store.db.DB, dbPath, opts)
+	if cerr := r.Close(); err == nil && cerr != nil {
+		err = errors.Wrap(cerr, "close repo")
+	}
+	if err != nil {
+		return err
+	}
+
+	payload := duressPayload{Config: decoy}
+	for _, f := range files {
+		payload.Files = append(payload.Files, f.path)
+	}
+
+	b, err := sealDuressPayload(duressKey, &payload)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(DuressKeyPath(dbPath), b)
+}
+
+// RemoveDuressKey removes the duress key of the repo at dbPath, key must open
+// the repo.
+func RemoveDuressKey(dbPath string, key []byte, opts SQLCipherDatastoreOptions) error {
+	r, err := Open(dbPath, key, opts)
+	if err != nil {
+		return err
+	}
+	if err := r.Close(); err != nil {
+		return errors.Wrap(err, "close repo")
+	}
+
+	if err := overwriteFile(DuressKeyPath(dbPath), -1); err != nil {
+		return err
+	}
+	if err := os.Remove(DuressKeyPath(dbPath)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "remove duress key")
+	}
+	return nil
+}
+
+// checkDuressKey replaces the repo at dbPath with a decoy if key is its
+// duress key
+func checkDuressKey(ctx context.Context, dbPath string, key []byte, opts SQLCipherDatastoreOptions) error {
+	payload, err := readDuressPayload(dbPath, key)
+	if err != nil || payload == nil {
+		return err
+	}
+
+	opts.ReadOnly = false
+	return onlyOne.WithClosed(dbPath, func() error {
+		fileLock, err := lockRepoExclusive(ctx, dbPath, opts.LockTimeout)
+		if err != nil {
+			return err
+		}
+
+		// the lock files are kept, see Destroy
+		err = replaceWithDecoy(ctx, dbPath, key, opts, payload)
+		if cerr := fileLock.Close(); err == nil && cerr != nil {
+			err = errors.Wrap(cerr, "unlock repo")
+		}
+		return err
+	})
+}
+
+// replaceWithDecoy crypto-erases the repo at dbPath and initializes the
+// decoy, the caller holds the locks
+func replaceWithDecoy(ctx context.Context, dbPath string, key []byte, opts SQLCipherDatastoreOptions, payload *duressPayload) error {
+	for _, path := range payload.Files {
+		if err := cryptoEraseRepo(path); err != nil {
+			return errors.Wrap(err, "crypto-erase database")
+		}
+		if err := removeDBFiles(path); err != nil {
+			return errors.Wrap(err, "remove database")
+		}
+	}
+	if err := destroyRepoFiles(dbPath, DestroyOptions{CryptoErase: true}); err != nil {
+		return err
+	}
+	return initRepo(ctx, dbPath, key, opts, payload.Config)
+}
+
+// readDuressPayload returns the duress payload of the repo at dbPath if key
+// is its duress key, nil otherwise
+func readDuressPayload(dbPath string, key []byte) (*duressPayload, error) {
+	if len(key) != keyLength {
+		return nil, nil
+	}
+	b, err := os.ReadFile(DuressKeyPath(dbPath))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "read duress key")
+	}
+
+	// a file that can't be decrypted doesn't stop the key of the repo from
+	// opening it, nor tells that there is a duress key
+	var f duressKeyFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, nil
+	}
+	aead, err := duressAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(f.Nonce) != aead.NonceSize() {
+		return nil, nil
+	}
+	plaintext, err := aead.Open(nil, f.Nonce, f.Sealed, nil)
+	if err != nil {
+		// not the duress key
+		return nil, nil
+	}
+
+	var payload duressPayload
+	if err := json.Unmarshal(plaintext, &payload); err != nil {
+		return nil, errors.Wrap(err, "unmarshal duress payload")
+	}
+	if payload.Config == nil {
+		return nil, errors.New("duress payload has no config")
+	}
+	return &payload, nil
+}
+
+func sealDuressPayload(key []byte, payload *duressPayload) ([]byte, error) {
+	plaintext, err := json.Marshal(payload)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal duress payload")
+	}
+	aead, err := duressAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	f := duressKeyFile{Nonce: make([]byte, aead.NonceSize())}
+	if _, err := rand.Read(f.Nonce); err != nil {
+		return nil, errors.Wrap(err, "generate nonce")
+	}
+	f.Sealed = aead.Seal(nil, f.Nonce, plaintext, nil)
+
+	b, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal duress key")
+	}
+	return b, nil
+}
+
+// duressAEAD returns the AEAD of the duress payload, its key is derived
+// from the duress key which is also the key of the decoy repo
+func duressAEAD(key []byte) (cipher.AEAD, error) {
+	kek, err := hkdf.Key(sha256.New, key, nil, duressInfo, keyLength)
+	if err != nil {
+		return nil, errors.Wrap(err, "derive key")
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,167 @@
+package encrepo
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+	config "github.com/ipfs/kubo/config"
+	"github.com/stretchr/testify/require"
+)
+
+// testingRepoFiles returns the names of the files in dir
+func testingRepoFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	names := make([]string, len(entries))
+	for i, e := range entries {
+		names[i] = e.Name()
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestDuressKey(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	key, duressKey := testingKey(t), testingKey(t)
+	opts := SQLCipherDatastoreOptions{JournalMode: "WAL"}
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "db.sqlite")
+	conf := &config.Config{Identity: config.Identity{PeerID: "foo"}, Datastore: config.Datastore{Spec: map[string]interface{}{
+		"type": "mount",
+		"mounts": []interface{}{
+			map[string]interface{}{"mountpoint": "/blocks", "type": "sqlcipher", "path": "blocks.sqlite", "table": "blocks"},
+			map[string]interface{}{"mountpoint": "/", "type": "sqlcipher"},
+		},
+	}}}
+	decoy := &config.Config{Identity: config.Identity{PeerID: "decoy"}, Datastore: testingDatastoreConfig()}
+	require.NoError(t, Init(dbPath, key, opts, conf))
+
+	r, err := Open(dbPath, key, opts)
+	require.NoError(t, err)
+	require.NoError(t, r.Datastore().Put(ctx, datastore.NewKey("/blocks/foo"), []byte("foo")))
+	require.NoError(t, r.Datastore().Put(ctx, datastore.NewKey("/bar"), []byte("bar")))
+	require.NoError(t, r.Close())
+
+	t.Log("set the duress key")
+	require.Error(t, SetDuressKey(dbPath, key, key, opts, decoy))
+	require.Error(t, SetDuressKey(dbPath, key, duressKey[:16], opts, decoy))
+	require.Error(t, SetDuressKey(dbPath, testingKey(t), duressKey, opts, decoy))
+	require.Error(t, SetDuressKey(dbPath, key, duressKey, opts, nil))
+	_, err = os.Stat(DuressKeyPath(dbPath))
+	require.True(t, os.IsNotExist(err))
+	require.NoError(t, SetDuressKey(dbPath, key, duressKey, opts, decoy))
+	stored, err := os.ReadFile(DuressKeyPath(dbPath))
+	require.NoError(t, err)
+	require.NotContains(t, string(stored), "decoy")
+	require.NotContains(t, string(stored), "blocks.sqlite")
+
+	requireRealRepo := func() {
+		t.Helper()
+		r, err := Open(dbPath, key, opts)
+		require.NoError(t, err)
+		defer requireClose(t, r)
+		val, err := r.Datastore().Get(ctx, datastore.NewKey("/blocks/foo"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("foo"), val)
+	}
+
+	t.Log("the key and a wrong key don't trigger it")
+	requireRealRepo()
+	_, err = Open(dbPath, testingKey(t), opts)
+	require.Error(t, err)
+	requireRealRepo()
+
+	t.Log("a tampered duress key is not triggered")
+	var f duressKeyFile
+	require.NoError(t, json.Unmarshal(stored, &f))
+	f.Sealed[0] ^= 1
+	tampered, err := json.Marshal(f)
+	require.NoError(t, err)
+	badNonce, err := json.Marshal(duressKeyFile{Nonce: []byte("nonce"), Sealed: f.Sealed})
+	require.NoError(t, err)
+	for _, b := range [][]byte{tampered, badNonce, []byte("garbage")} {
+		require.NoError(t, os.WriteFile(DuressKeyPath(dbPath), b, 0o600))
+		_, err = Open(dbPath, duressKey, opts)
+		require.ErrorIs(t, err, ErrWrongKey)
+		requireRealRepo()
+	}
+	require.NoError(t, os.WriteFile(DuressKeyPath(dbPath), stored, 0o600))
+
+	t.Log("it can't be triggered while the repo is open")
+	r, err = Open(dbPath, key, opts)
+	require.NoError(t, err)
+	_, err = Open(dbPath, duressKey, opts)
+	require.ErrorIs(t, err, ErrRepoOpen)
+	require.NoError(t, r.Close())
+	requireRealRepo()
+
+	t.Log("the duress key opens a decoy")
+	r, err = Open(dbPath, duressKey, opts)
+	require.NoError(t, err)
+	decoyConf, err := r.Config()
+	require.NoError(t, err)
+	require.Equal(t, "decoy", decoyConf.Identity.PeerID)
+	_, err = r.Datastore().Get(ctx, datastore.NewKey("/bar"))
+	require.ErrorIs(t, err, datastore.ErrNotFound)
+	require.NoError(t, r.Close())
+
+	_, err = Open(dbPath, key, opts)
+	require.Error(t, err, "the key doesn't open the decoy")
+
+	t.Log("the decoy looks like a new install")
+	newDir := t.TempDir()
+	newPath := filepath.Join(newDir, "db.sqlite")
+	newKey := testingKey(t)
+	require.NoError(t, Init(newPath, newKey, opts, decoy))
+	// the lock file of the readers is kept once created
+	fileLock, err := lockRepoReader(ctx, newPath, 0)
+	require.NoError(t, err)
+	require.NoError(t, fileLock.Close())
+	r, err = Open(newPath, newKey, opts)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	require.Equal(t, testingRepoFiles(t, newDir), testingRepoFiles(t, dir))
+
+	t.Log("the duress key opens the decoy again")
+	r, err = Open(dbPath, duressKey, opts)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+
+	t.Log("remove a duress key")
+	require.NoError(t, SetDuressKey(dbPath, duressKey, key, opts, decoy))
+	require.NoError(t, RemoveDuressKey(dbPath, duressKey, opts))
+	_, err = os.Stat(DuressKeyPath(dbPath))
+	require.True(t, os.IsNotExist(err))
+	_, err = Open(dbPath, key, opts)
+	require.Error(t, err)
+}
+
+func TestDuressKeyProvider(t *testing.T) {
+	key, duressKey := testingKey(t), testingKey(t)
+	opts := SQLCipherDatastoreOptions{}
+	dbPath := filepath.Join(t.TempDir(), "db.sqlite")
+	decoy := &config.Config{Identity: config.Identity{PeerID: "decoy"}, Datastore: testingDatastoreConfig()}
+	require.NoError(t, Init(dbPath, key, opts, &config.Config{Identity: config.Identity{PeerID: "foo"}, Datastore: testingDatastoreConfig()}))
+	require.NoError(t, SetDuressKey(dbPath, key, duressKey, opts, decoy))
+
+	t.Log("the duress key is recognized from a key provider")
+	keyPath := filepath.Join(t.TempDir(), "key")
+	require.NoError(t, os.WriteFile(keyPath, []byte(hex.EncodeToString(duressKey)+"\n"), 0o600))
+	r, err := OpenWithKeyProvider(dbPath, NewFileKeyProvider(keyPath), opts)
+	require.NoError(t, err)
+	defer requireClose(t, r)
+	conf, err := r.Config()
+	require.NoError(t, err)
+	require.Equal(t, "decoy", conf.Identity.PeerID)
+	_, err = os.Stat(DuressKeyPath(dbPath))
+	require.True(t, os.IsNotExist(err))
+}
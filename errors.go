@@ -0,0 +1,30 @@
+package encrepo
+
+import (
+	"github.com/pkg/errors"
+)
+
+// The errors returned by Open, Init and IsInitialized when the database
+// can't be opened with the given key and options, they are detected by
+// reading the header of the database file and probing SQLCipher once the
+// key is set. They wrap the underlying error if any, use errors.Is.
+var (
+	// ErrWrongKey is returned when SQLCipher can't decrypt the database with
+	// the key.
+	ErrWrongKey = errors.New("wrong key")
+	// ErrNotEncrypted is returned when a key is provided for a plaintext
+	// database.
+	ErrNotEncrypted = errors.New("key provided while db is not encrypted")
+	// ErrEncryptedNoKey is returned when no key is provided for an encrypted
+	// database.
+	ErrEncryptedNoKey = errors.New("missing key, db is encrypted")
+	// ErrBadSalt is returned when the salt is invalid, doesn't match the one
+	// of the database, or when the plaintext header option doesn't match the
+	// database.
+	ErrBadSalt = errors.New("bad salt")
+	// ErrCorrupt is returned when the database file is malformed.
+	ErrCorrupt = errors.New("db is corrupt")
+	// ErrSchemaMismatch is returned when a table of the database doesn't
+	// have the expected columns.
+	ErrSchemaMismatch = errors.New("db schema mismatch")
+)
@@ -0,0 +1,105 @@
+package encrepo
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+
+	config "github.com/ipfs/kubo/config"
+	"github.com/stretchr/testify/require"
+)
+
+// requireOpenErrorIs checks that Open, Init and IsInitialized fail with
+// target
+func requireOpenErrorIs(t *testing.T, dbPath string, key []byte, opts SQLCipherDatastoreOptions, target error) {
+	t.Helper()
+
+	_, err := Open(dbPath, key, opts)
+	require.ErrorIs(t, err, target, "Open")
+	require.ErrorIs(t, Init(dbPath, key, opts, &config.Config{}), target, "Init")
+	_, err = IsInitialized(dbPath, key, opts)
+	require.ErrorIs(t, err, target, "IsInitialized")
+}
+
+func TestOpenErrors(t *testing.T) {
+	key := testingKey(t)
+	salt := testingSalt(t)
+	dir := t.TempDir()
+
+	encPath := filepath.Join(dir, "enc.sqlite")
+	require.NoError(t, Init(encPath, key, SQLCipherDatastoreOptions{}, &config.Config{}))
+	plainPath := filepath.Join(dir, "plain.sqlite")
+	require.NoError(t, Init(plainPath, nil, SQLCipherDatastoreOptions{}, &config.Config{}))
+	headerOpts := SQLCipherDatastoreOptions{PlaintextHeader: true, Salt: salt}
+	headerPath := filepath.Join(dir, "header.sqlite")
+	require.NoError(t, Init(headerPath, key, headerOpts, &config.Config{}))
+
+	t.Log("wrong key")
+	requireOpenErrorIs(t, encPath, testingKey(t), SQLCipherDatastoreOptions{}, ErrWrongKey)
+	requireOpenErrorIs(t, headerPath, testingKey(t), headerOpts, ErrWrongKey)
+
+	t.Log("missing key")
+	requireOpenErrorIs(t, encPath, nil, SQLCipherDatastoreOptions{}, ErrEncryptedNoKey)
+	requireOpenErrorIs(t, headerPath, nil, SQLCipherDatastoreOptions{}, ErrEncryptedNoKey)
+
+	t.Log("key of a plaintext db")
+	requireOpenErrorIs(t, plainPath, key, SQLCipherDatastoreOptions{}, ErrNotEncrypted)
+
+	t.Log("bad salt")
+	requireOpenErrorIs(t, headerPath, key, SQLCipherDatastoreOptions{PlaintextHeader: true, Salt: testingSalt(t)}, ErrBadSalt)
+	requireOpenErrorIs(t, headerPath, key, SQLCipherDatastoreOptions{PlaintextHeader: true, Salt: salt[1:]}, ErrBadSalt)
+	requireOpenErrorIs(t, headerPath, key, SQLCipherDatastoreOptions{}, ErrBadSalt)
+	requireOpenErrorIs(t, encPath, key, headerOpts, ErrBadSalt)
+
+	t.Log("the right keys still work")
+	for path, opts := range map[string]SQLCipherDatastoreOptions{encPath: {}, headerPath: headerOpts} {
+		isInit, err := IsInitialized(path, key, opts)
+		require.NoError(t, err)
+		require.True(t, isInit)
+	}
+	isInit, err := IsInitialized(plainPath, nil, SQLCipherDatastoreOptions{})
+	require.NoError(t, err)
+	require.True(t, isInit)
+}
+
+func TestOpenErrorsCorrupt(t *testing.T) {
+	key := testingKey(t)
+	dir := t.TempDir()
+
+	t.Log("truncated db")
+	dbPath := filepath.Join(dir, "truncated.sqlite")
+	require.NoError(t, Init(dbPath, nil, SQLCipherDatastoreOptions{}, &config.Config{}))
+	fi, err := os.Stat(dbPath)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(dbPath, fi.Size()-100))
+	requireOpenErrorIs(t, dbPath, nil, SQLCipherDatastoreOptions{}, ErrCorrupt)
+
+	t.Log("too small db")
+	dbPath = filepath.Join(dir, "small.sqlite")
+	require.NoError(t, os.WriteFile(dbPath, []byte("foo"), 0o600))
+	requireOpenErrorIs(t, dbPath, key, SQLCipherDatastoreOptions{}, ErrCorrupt)
+	requireOpenErrorIs(t, dbPath, nil, SQLCipherDatastoreOptions{}, ErrCorrupt)
+
+	t.Log("overwritten pages")
+	dbPath = filepath.Join(dir, "overwritten.sqlite")
+	require.NoError(t, Init(dbPath, nil, SQLCipherDatastoreOptions{}, &config.Config{}))
+	f, err := os.OpenFile(dbPath, os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = f.WriteAt(make([]byte, 512), sqliteHeaderSize)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	requireOpenErrorIs(t, dbPath, nil, SQLCipherDatastoreOptions{}, ErrCorrupt)
+}
+
+func TestOpenErrorsSchemaMismatch(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "db.sqlite")
+
+	db, err := sql.Open("sqlite3", dbPath)
+	require.NoError(t, err)
+	_, err = db.Exec("CREATE TABLE ipfs (id INTEGER PRIMARY KEY, value TEXT)")
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	requireOpenErrorIs(t, dbPath, nil, SQLCipherDatastoreOptions{}, ErrSchemaMismatch)
+}
@@ -0,0 +1,167 @@
+package encrepo
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrRepoLocked is returned when the repo is locked by another process, the
+// returned error is a *RepoLockedError.
+var ErrRepoLocked = errors.New("repo is locked by another process")
+
+// RepoLockedError reports the process holding the lock of a repo.
+type RepoLockedError struct {
+	Path string
+	// PID is the process ID of the holder, zero if unknown
+	PID int
+}
+
+func (e *RepoLockedError) Error() string {
+	if e.PID == 0 {
+		return fmt.Sprintf("repo %s is locked by another process", e.Path)
+	}
+	return fmt.Sprintf("repo %s is locked by process %d", e.Path, e.PID)
+}
+
+func (e *RepoLockedError) Is(target error) bool {
+	return target == ErrRepoLocked
+}
+
+// errLockHeld is returned by lockFile when the lock is held by another file
+// descriptor
+var errLockHeld = errors.New("lock held")
+
+// lockPollInterval is the interval at which a locked repo is retried
+const lockPollInterval = 50 * time.Millisecond
+
+// LockPath returns the path of the lock file of the database at dbPath,
+// like the repo.lock of fsrepo. The lock files are never removed, not even
+// by Destroy.
+func LockPath(dbPath string) string {
+	return dbPath + ".lock"
+}
+
+// readersLockPath returns the path of the lock file of the read-only opens
+// of the database at dbPath
+func readersLockPath(dbPath string) string {
+	return dbPath + ".readers.lock"
+}
+
+// repoFileLock is an advisory lock of the lock file of a repo, it excludes
+// the other processes.
+type repoFileLock struct {
+	f *os.File
+	// readers is the lock of the readers held with the lock, see
+	// lockRepoExclusive
+	readers *repoFileLock
+}
+
+// lockRepoFile locks the repo at dbPath, waiting up to timeout if it's
+// locked by another process. The lock file holds the PID of the holder. The
+// read-only opens are not excluded, see lockRepoExclusive.
+func lockRepoFile(ctx context.Context, dbPath string, timeout time.Duration) (*repoFileLock, error) {
+	path := LockPath(dbPath)
+	l, err := waitLockFile(ctx, dbPath, path, true, time.Now().Add(timeout))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := l.f.Truncate(0); err != nil {
+		_ = l.Close()
+		return nil, errors.Wrap(err, "truncate lock file")
+	}
+	if _, err := l.f.WriteAt([]byte(strconv.Itoa(os.Getpid())), 0); err != nil {
+		_ = l.Close()
+		return nil, errors.Wrap(err, "write lock file")
+	}
+	return l, nil
+}
+
+// lockRepoReader takes the lock shared by the read-only opens of the repo at
+// dbPath, it excludes the functions replacing or removing the database.
+func lockRepoReader(ctx context.Context, dbPath string, timeout time.Duration) (*repoFileLock, error) {
+	return waitLockFile(ctx, dbPath, readersLockPath(dbPath), false, time.Now().Add(timeout))
+}
+
+// lockRepoExclusive is like lockRepoFile and excludes the read-only opens
+// too, it's taken to replace or remove the database.
+func lockRepoExclusive(ctx context.Context, dbPath string, timeout time.Duration) (*repoFileLock, error) {
+	deadline := time.Now().Add(timeout)
+	l, err := lockRepoFile(ctx, dbPath, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if l.readers, err = waitLockFile(ctx, dbPath, readersLockPath(dbPath), true, deadline); err != nil {
+		_ = l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// waitLockFile locks the file at path, waiting until deadline if it's
+// locked by another process
+func waitLockFile(ctx context.Context, dbPath, path string, exclusive bool, deadline time.Time) (*repoFileLock, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, errors.Wrap(err, "open lock file")
+	}
+
+	for {
+		err := lockFile(f, exclusive)
+		if err == nil {
+			return &repoFileLock{f: f}, nil
+		}
+		if err != errLockHeld {
+			_ = f.Close()
+			return nil, errors.Wrap(err, "lock repo")
+		}
+		if !time.Now().Before(deadline) {
+			_ = f.Close()
+			return nil, &RepoLockedError{Path: dbPath, PID: readLockPID(path)}
+		}
+
+		select {
+		case <-ctx.Done():
+			_ = f.Close()
+			return nil, ctx.Err()
+		case <-time.After(lockPollInterval):
+		}
+	}
+}
+
+// readLockPID returns the PID written in the lock file, zero if it can't be
+// read
+func readLockPID(path string) int {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.Atoi(string(bytes.TrimSpace(b)))
+	if err != nil {
+		return 0
+	}
+	return pid
+}
+
+// Close unlocks the repo. The lock file is kept, removing it would race
+// with the processes waiting for it.
+func (l *repoFileLock) Close() error {
+	var err error
+	if l.readers != nil {
+		err = l.readers.Close()
+	}
+	_ = l.f.Truncate(0)
+	if uerr := unlockFile(l.f); err == nil {
+		err = uerr
+	}
+	if cerr := l.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,23 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd || windows)
+
+package encrepo
+
+import "os"
+
+// the repo is not locked against other processes on this platform
+
+func lockFile(*os.File, bool) error {
+	return nil
+}
+
+func unlockFile(*os.File) error {
+	return nil
+}
+
+func lockFSRepoFile(f *os.File) error {
+	return lockFile(f, true)
+}
+
+func unlockFSRepoFile(f *os.File) error {
+	return unlockFile(f)
+}
@@ -0,0 +1,164 @@
+package encrepo
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	config "github.com/ipfs/kubo/config"
+	"github.com/stretchr/testify/require"
+)
+
+// TestRepoLockHelper holds the repo open in a separate process, it's run by
+// TestRepoLockProcess.
+func TestRepoLockHelper(t *testing.T) {
+	dbPath := os.Getenv("ENCREPO_LOCK_HELPER_DB")
+	if dbPath == "" {
+		t.Skip("helper process")
+	}
+	key, err := hex.DecodeString(os.Getenv("ENCREPO_LOCK_HELPER_KEY"))
+	require.NoError(t, err)
+
+	opts := SQLCipherDatastoreOptions{JournalMode: "WAL"}
+	opts.ReadOnly = os.Getenv("ENCREPO_LOCK_HELPER_READONLY") != ""
+	r, err := Open(dbPath, key, opts)
+	require.NoError(t, err)
+	os.Stdout.WriteString("opened\n")
+
+	// hold the lock until the parent closes stdin
+	_, _ = io.Copy(io.Discard, os.Stdin)
+	require.NoError(t, r.Close())
+}
+
+// startRepoLockHelper runs TestRepoLockHelper, it holds the repo open until
+// stdin is closed
+func startRepoLockHelper(t *testing.T, dbPath string, key []byte, readOnly bool) (*exec.Cmd, io.WriteCloser) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestRepoLockHelper$")
+	cmd.Env = append(os.Environ(),
+		"ENCREPO_LOCK_HELPER_DB="+dbPath,
+		"ENCREPO_LOCK_HELPER_KEY="+hex.EncodeToString(key),
+	)
+	if readOnly {
+		cmd.Env = append(cmd.Env, "ENCREPO_LOCK_HELPER_READONLY=1")
+	}
+	stdin, err := cmd.StdinPipe()
+	require.NoError(t, err)
+	stdout, err := cmd.StdoutPipe()
+	require.NoError(t, err)
+	require.NoError(t, cmd.Start())
+	t.Cleanup(func() { _ = cmd.Process.Kill() })
+
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, "opened\n", line)
+	return cmd, stdin
+}
+
+func TestRepoLockProcess(t *testing.T) {
+	key := testingKey(t)
+	opts := SQLCipherDatastoreOptions{JournalMode: "WAL"}
+	dbPath := filepath.Join(t.TempDir(), "db.sqlite")
+	require.NoError(t, Init(dbPath, key, opts, &config.Config{}))
+
+	cmd, stdin := startRepoLockHelper(t, dbPath, key, false)
+
+	t.Log("the repo is locked by the helper")
+	_, err := Open(dbPath, key, opts)
+	require.ErrorIs(t, err, ErrRepoLocked)
+	var lockedErr *RepoLockedError
+	require.True(t, errors.As(err, &lockedErr))
+	require.Equal(t, cmd.Process.Pid, lockedErr.PID)
+	require.ErrorIs(t, Rekey(dbPath, key, testingKey(t), opts), ErrRepoLocked)
+
+	t.Log("wait for the helper to close the repo")
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		_ = stdin.Close()
+	}()
+	waitOpts := opts
+	waitOpts.LockTimeout = 10 * time.Second
+	r, err := Open(dbPath, key, waitOpts)
+	require.NoError(t, err)
+	requireClose(t, r)
+	require.NoError(t, cmd.Wait())
+}
+
+func TestRepoLock(t *testing.T) {
+	key := testingKey(t)
+	opts := SQLCipherDatastoreOptions{JournalMode: "WAL"}
+	dbPath := filepath.Join(t.TempDir(), "db.sqlite")
+	require.NoError(t, Init(dbPath, key, opts, &config.Config{}))
+
+	t.Log("the lock is held until the repo is closed")
+	r, err := Open(dbPath, key, opts)
+	require.NoError(t, err)
+	_, err = lockRepoFile(context.Background(), dbPath, 0)
+	var lockedErr *RepoLockedError
+	require.True(t, errors.As(err, &lockedErr))
+	require.Equal(t, os.Getpid(), lockedErr.PID)
+	require.NoError(t, r.Close())
+
+	l, err := lockRepoFile(context.Background(), dbPath, 0)
+	require.NoError(t, err)
+
+	t.Log("timeout")
+	timeoutOpts := opts
+	timeoutOpts.LockTimeout = 100 * time.Millisecond
+	start := time.Now()
+	_, err = Open(dbPath, key, timeoutOpts)
+	require.ErrorIs(t, err, ErrRepoLocked)
+	require.GreaterOrEqual(t, time.Since(start), timeoutOpts.LockTimeout)
+
+	t.Log("canceled wait")
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	timeoutOpts.LockTimeout = time.Minute
+	_, err = OpenContext(ctx, dbPath, key, timeoutOpts)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	require.NoError(t, l.Close())
+	r, err = Open(dbPath, key, opts)
+	require.NoError(t, err)
+	requireClose(t, r)
+}
+
+func TestRepoLockReaderProcess(t *testing.T) {
+	key := testingKey(t)
+	opts := SQLCipherDatastoreOptions{JournalMode: "WAL"}
+	dbPath := filepath.Join(t.TempDir(), "db.sqlite")
+	require.NoError(t, Init(dbPath, key, opts, &config.Config{Identity: config.Identity{PeerID: "foo", PrivKey: "bar"}}))
+	r, err := Open(dbPath, key, opts)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+
+	cmd, stdin := startRepoLockHelper(t, dbPath, key, true)
+
+	t.Log("the repo is written while a reader has it open")
+	r, err = Open(dbPath, key, opts)
+	require.NoError(t, err)
+	require.NoError(t, r.SetConfigKey("Identity.PeerID", "baz"))
+
+	t.Log("but not rekeyed, replaced nor removed")
+	require.ErrorIs(t, r.(Repo).Rekey(testingKey(t)), ErrRepoLocked)
+	require.NoError(t, r.Close())
+	require.ErrorIs(t, Rekey(dbPath, key, testingKey(t), opts), ErrRepoLocked)
+	require.ErrorIs(t, Destroy(dbPath, DestroyOptions{}), ErrRepoLocked)
+	_, err = MigrateRepo(dbPath, key, opts, RepoMigrationOptions{})
+	require.ErrorIs(t, err, ErrRepoLocked)
+	_, err = os.Stat(dbPath)
+	require.NoError(t, err)
+
+	require.NoError(t, stdin.Close())
+	require.NoError(t, cmd.Wait())
+	require.NoError(t, Destroy(dbPath, DestroyOptions{}))
+	_, err = os.Stat(dbPath)
+	require.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,39 @@
+//go:build windows
+
+package encrepo
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// the locked byte is beyond the content of the lock file so that the PID
+// can be read while the file is locked
+const lockOffsetHigh = 0x7fffffff
+
+func lockFile(f *os.File, exclusive bool) error {
+	flags := uint32(windows.LOCKFILE_FAIL_IMMEDIATELY)
+	if exclusive {
+		flags |= windows.LOCKFILE_EXCLUSIVE_LOCK
+	}
+	ol := &windows.Overlapped{OffsetHigh: lockOffsetHigh}
+	err := windows.LockFileEx(windows.Handle(f.Fd()), flags, 0, 1, 0, ol)
+	if err == windows.ERROR_LOCK_VIOLATION {
+		return errLockHeld
+	}
+	return err
+}
+
+func unlockFile(f *os.File) error {
+	ol := &windows.Overlapped{OffsetHigh: lockOffsetHigh}
+	return windows.UnlockFileEx(windows.Handle(f.Fd()), 0, 1, 0, ol)
+}
+
+func lockFSRepoFile(f *os.File) error {
+	return lockFile(f, true)
+}
+
+func unlockFSRepoFile(f *os.File) error {
+	return unlockFile(f)
+}
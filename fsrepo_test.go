@@ -40,11 +40,6 @@ func TestInitIdempotence(t *testing.T) {
 	}
 }
 
-func Remove(repoPath string) error {
-	repoPath = filepath.Clean(repoPath)
-	return os.RemoveAll(repoPath)
-}
-
 func testingKey(t *testing.T) []byte {
 	t.Helper()
 	buf := make([]byte, 32)
@@ -95,11 +90,11 @@ func TestCanManageReposIndependently(t *testing.T) {
 
 	t.Log("close and remove b while a is open")
 	require.NoError(t, repoB.Close(), "close b")
-	require.NoError(t, Remove(pathB), "remove b")
+	require.NoError(t, Destroy(pathB, DestroyOptions{}), "remove b")
 
 	t.Log("close and remove a")
 	require.NoError(t, repoA.Close())
-	require.NoError(t, Remove(pathA))
+	require.NoError(t, Destroy(pathA, DestroyOptions{}))
 }
 
 func TestDatastoreGetNotAllowedAfterClose(t *testing.T) {
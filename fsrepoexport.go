@@ -0,0 +1,450 @@
+package encrepo
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cockroachdb/pebble/v2"
+	"github.com/ipfs/boxo/keystore"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	leveldb "github.com/ipfs/go-ds-leveldb"
+	ipfs "github.com/ipfs/kubo"
+	config "github.com/ipfs/kubo/config"
+	serialize "github.com/ipfs/kubo/config/serialize"
+	"github.com/pkg/errors"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+const fsrepoSpecFile = "datastore_spec"
+
+// ExportFSRepoOptions are the options of ExportFSRepo.
+type ExportFSRepoOptions struct {
+	// DatastoreSpec is the Config.Datastore.Spec of the fsrepo, nil is the
+	// flatfs and levelds spec of kubo. Its datastores can be flatfs, levelds
+	// and pebbleds.
+	DatastoreSpec map[string]interface{}
+}
+
+// ExportFSRepo writes the repo at dbPath as a new kubo fsrepo at fsrepoPath,
+// it's the reverse of MigrateFromFSRepo: the config, the keystore, the
+// swarm.key and the entries of Repo.Datastore are exported, so a kubo daemon
+// of the same repo version can start from it. The API and gateway addresses
+// are not exported, the daemon writes them.
+//
+// The fsrepo is written plaintext. The entries of each of its datastores are
+// counted once written, on failure the fsrepo is removed.
+func ExportFSRepo(dbPath, fsrepoPath string, key []byte, opts SQLCipherDatastoreOptions, eopts ExportFSRepoOptions) (*MigrateReport, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	spec := eopts.DatastoreSpec
+	if len(spec) == 0 {
+		spec = config.DefaultDatastoreConfig().Spec
+	}
+	mounts, err := fsrepoMounts(fsrepoPath, spec, ds.NewKey("/"))
+	if err != nil {
+		return nil, errors.Wrap(err, "parse fsrepo Datastore.Spec")
+	}
+	for _, path := range fsrepoPaths(fsrepoPath, mounts) {
+		if _, err := os.Stat(path); err == nil {
+			return nil, fmt.Errorf("%s already exists", path)
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	rr, err := OpenContext(ctx, dbPath, key, opts)
+	if err != nil {
+		return nil, errors.Wrap(err, "open repo")
+	}
+	defer rr.Close()
+
+	report, err := exportFSRepo(ctx, rr.(*encRepo), fsrepoPath, spec, mounts)
+	if err != nil {
+		_ = removeFSRepo(fsrepoPath, mounts)
+		return nil, err
+	}
+	return report, nil
+}
+
+func exportFSRepo(ctx context.Context, r *encRepo, fsrepoPath string, spec map[string]interface{}, mounts []fsrepoMount) (*MigrateReport, error) {
+	conf, err := r.Config()
+	if err != nil {
+		return nil, err
+	}
+	exported := *conf
+	if exported.Identity.PrivKey == "" {
+		return nil, errors.New("repo has no identity")
+	}
+	exported.Datastore.Spec = spec
+
+	if err := os.Mkdir(fsrepoPath, 0o700); err != nil {
+		return nil, errors.Wrap(err, "create fsrepo")
+	}
+	if err := serialize.WriteConfigFile(filepath.Join(fsrepoPath, fsrepoConfigFile), &exported); err != nil {
+		return nil, errors.Wrap(err, "write fsrepo config")
+	}
+	if err := os.WriteFile(filepath.Join(fsrepoPath, fsrepoSpecFile), fsrepoDiskSpec(spec).bytes(), 0o600); err != nil {
+		return nil, errors.Wrap(err, "write fsrepo datastore spec")
+	}
+
+	entries, err := exportEntries(ctx, r.Datastore(), mounts)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := exportKeystore(ctx, r, filepath.Join(fsrepoPath, fsrepoKeystoreDir))
+	if err != nil {
+		return nil, err
+	}
+
+	swarmKey, err := r.SwarmKeyContext(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "get swarm.key")
+	}
+	if swarmKey != nil {
+		if err := os.WriteFile(filepath.Join(fsrepoPath, fsrepoSwarmKeyFile), swarmKey, 0o600); err != nil {
+			return nil, errors.Wrap(err, "write swarm.key")
+		}
+	}
+
+	// the version is written last, kubo doesn't open a fsrepo without it
+	version := []byte(strconv.Itoa(ipfs.RepoVersion) + "\n")
+	if err := os.WriteFile(filepath.Join(fsrepoPath, fsrepoVersionFile), version, 0o644); err != nil {
+		return nil, errors.Wrap(err, "write fsrepo version")
+	}
+
+	return &MigrateReport{Entries: entries, Keys: keys}, nil
+}
+
+// exportEntries writes the entries of src in the fsrepo datastores and
+// counts them back
+func exportEntries(ctx context.Context, src ds.Datastore, mounts []fsrepoMount) (map[string]int, error) {
+	writers := make([]fsrepoDatastoreWriter, 0, len(mounts))
+	closeWriters := func() error {
+		var err error
+		for _, w := range writers {
+			if cerr := w.Close(); err == nil {
+				err = cerr
+			}
+		}
+		writers = nil
+		return err
+	}
+	defer closeWriters()
+
+	for _, m := range mounts {
+		w, err := m.create()
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("create fsrepo datastore %s", m.prefix))
+		}
+		writers = append(writers, w)
+	}
+
+	res, err := src.Query(ctx, query.Query{})
+	if err != nil {
+		return nil, errors.Wrap(err, "query datastore")
+	}
+	defer res.Close()
+
+	counts := make([]int, len(mounts))
+	for e := range res.Next() {
+		if e.Error != nil {
+			return nil, errors.Wrap(e.Error, "query datastore")
+		}
+		k := ds.NewKey(e.Key)
+		i := fsrepoMountOf(k, mounts)
+		if i < 0 {
+			return nil, fmt.Errorf("no fsrepo datastore is mounted for %s", k)
+		}
+		if err := writers[i].put(ctx, fsrepoMountKey(k, mounts[i].prefix), e.Value); err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("export %s", k))
+		}
+		counts[i]++
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := closeWriters(); err != nil {
+		return nil, errors.Wrap(err, "close fsrepo datastores")
+	}
+
+	entries := make(map[string]int, len(mounts))
+	for i, m := range mounts {
+		count, err := countFSRepoEntries(ctx, m)
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("verify fsrepo datastore %s", m.prefix))
+		}
+		if count != counts[i] {
+			return nil, fmt.Errorf("exported %d entries to %s, counted %d", counts[i], m.prefix, count)
+		}
+		entries[m.prefix.String()] = count
+	}
+	return entries, nil
+}
+
+func countFSRepoEntries(ctx context.Context, m fsrepoMount) (int, error) {
+	d, err := m.open()
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	err = d.each(ctx, true, func(ds.Key, []byte, int) error {
+		count++
+		return nil
+	})
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return count, err
+}
+
+// fsrepoMountOf returns the index of the most specific mount of k, -1 if
+// none
+func fsrepoMountOf(k ds.Key, mounts []fsrepoMount) int {
+	found := -1
+	for i, m := range mounts {
+		if !m.prefix.Equal(k) && !m.prefix.IsAncestorOf(k) {
+			continue
+		}
+		if found < 0 || len(m.prefix.String()) > len(mounts[found].prefix.String()) {
+			found = i
+		}
+	}
+	return found
+}
+
+// fsrepoMountKey returns the key of k in the datastore mounted at prefix
+func fsrepoMountKey(k, prefix ds.Key) ds.Key {
+	if prefix.Equal(ds.NewKey("/")) {
+		return k
+	}
+	return ds.NewKey(strings.TrimPrefix(k.String(), prefix.String()))
+}
+
+// exportKeystore writes the keys of the repo in a kubo keystore at dir
+func exportKeystore(ctx context.Context, r *encRepo, dir string) (int, error) {
+	// read the keys without recording their use, the export doesn't
+	// modify the repo
+	src := r.ks.(*dsks)
+	names, err := src.ListContext(ctx)
+	if err != nil {
+		return 0, errors.Wrap(err, "list keys")
+	}
+
+	dst, err := keystore.NewFSKeystore(dir)
+	if err != nil {
+		return 0, errors.Wrap(err, "create fsrepo keystore")
+	}
+	for _, name := range names {
+		// the names are listed as datastore keys
+		name = ds.NewKey(name).Name()
+		k, err := src.getKey(ctx, ds.NewKey(name))
+		if err != nil {
+			return 0, errors.Wrap(err, fmt.Sprintf("get key %s", name))
+		}
+		if err := dst.Put(name, k); err != nil {
+			return 0, errors.Wrap(err, fmt.Sprintf("put fsrepo key %s", name))
+		}
+	}
+	return len(names), nil
+}
+
+// fsrepoDiskSpec returns the content of the datastore_spec file of a fsrepo
+// spec validated by fsrepoMounts, like kubo's DatastoreConfig.DiskSpec
+func fsrepoDiskSpec(spec map[string]interface{}) diskSpec {
+	switch spec["type"] {
+	case "mount":
+		var mounts []map[string]interface{}
+		for _, iface := range spec["mounts"].([]interface{}) {
+			mounts = append(mounts, iface.(map[string]interface{}))
+		}
+		prefix := func(i int) string {
+			return ds.NewKey(mounts[i]["mountpoint"].(string)).String()
+		}
+		sort.Slice(mounts, func(i, j int) bool { return prefix(i) > prefix(j) })
+
+		res := make([]interface{}, len(mounts))
+		for i, m := range mounts {
+			child := fsrepoDiskSpec(m)
+			child["mountpoint"] = prefix(i)
+			res[i] = child
+		}
+		return diskSpec{"type": "mount", "mounts": res}
+	case "measure", "log":
+		return fsrepoDiskSpec(spec["child"].(map[string]interface{}))
+	case "flatfs":
+		return diskSpec{"type": "flatfs", "path": spec["path"], "shardFunc": spec["shardFunc"]}
+	default:
+		return diskSpec{"type": spec["type"], "path": spec["path"]}
+	}
+}
+
+// fsrepoDatastoreWriter writes a new datastore of a fsrepo
+type fsrepoDatastoreWriter interface {
+	put(ctx context.Context, k ds.Key, value []byte) error
+	Close() error
+}
+
+func (m fsrepoMount) create() (fsrepoDatastoreWriter, error) {
+	switch m.typ {
+	case "flatfs":
+		return newFlatfsWriter(m.path, m.params)
+	case "levelds":
+		o := &leveldb.Options{ErrorIfExist: true}
+		switch m.params["compression"] {
+		case "none":
+			o.Compression = opt.NoCompression
+		case "snappy":
+			o.Compression = opt.SnappyCompression
+		}
+		d, err := leveldb.NewDatastore(m.path, o)
+		if err != nil {
+			return nil, err
+		}
+		return &leveldbWriter{d: d}, nil
+	case "pebbleds":
+		db, err := pebble.Open(m.path, &pebble.Options{ErrorIfExists: true, FormatMajorVersion: pebble.FormatNewest, Logger: pebbleLogger{}})
+		if err != nil {
+			return nil, err
+		}
+		return &pebbleWriter{db}, nil
+	default:
+		return nil, fmt.Errorf("unsupported fsrepo datastore type: %s", m.typ)
+	}
+}
+
+// flatfsWriter writes a go-ds-flatfs directory, see flatfsDatastore
+type flatfsWriter struct {
+	dir   string
+	shard func(name string) string
+}
+
+func newFlatfsWriter(dir string, params map[string]interface{}) (*flatfsWriter, error) {
+	shardFunc, ok := params["shardFunc"].(string)
+	if !ok {
+		return nil, fmt.Errorf("'shardFunc' field is missing or not a string")
+	}
+	shard, err := parseFlatfsShardFunc(shardFunc)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "SHARDING"), []byte(shardFunc+"\n"), 0o644); err != nil {
+		return nil, err
+	}
+	return &flatfsWriter{dir: dir, shard: shard}, nil
+}
+
+// parseFlatfsShardFunc parses a go-ds-flatfs shard function, e.g.
+// /repo/flatfs/shard/v1/next-to-last/2
+func parseFlatfsShardFunc(s string) (func(string) string, error) {
+	parts := strings.Split(strings.TrimPrefix(s, "/repo/flatfs/shard/"), "/")
+	if len(parts) != 3 || parts[0] != "v1" {
+		return nil, fmt.Errorf("invalid flatfs shard function %q", s)
+	}
+	n, err := strconv.Atoi(parts[2])
+	if err != nil || n <= 0 {
+		return nil, fmt.Errorf("invalid flatfs shard function %q", s)
+	}
+
+	padding := strings.Repeat("_", n+1)
+	switch parts[1] {
+	case "prefix":
+		return func(name string) string { return (name + padding)[:n] }, nil
+	case "suffix":
+		return func(name string) string {
+			s := padding + name
+			return s[len(s)-n:]
+		}, nil
+	case "next-to-last":
+		return func(name string) string {
+			s := padding + name
+			return s[len(s)-n-1 : len(s)-1]
+		}, nil
+	default:
+		return nil, fmt.Errorf("invalid flatfs shard function %q", s)
+	}
+}
+
+func (w *flatfsWriter) put(_ context.Context, k ds.Key, value []byte) error {
+	name := strings.TrimPrefix(k.String(), "/")
+	if name == "" || strings.ContainsAny(name, "/.") {
+		return fmt.Errorf("%s can't be stored in flatfs", k)
+	}
+	dir := filepath.Join(w.dir, w.shard(name))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, name+".data"), value, 0o644)
+}
+
+func (w *flatfsWriter) Close() error { return nil }
+
+// leveldbWriter puts the entries in batches
+type leveldbWriter struct {
+	d       *leveldb.Datastore
+	batch   ds.Batch
+	pending int
+}
+
+func (w *leveldbWriter) put(ctx context.Context, k ds.Key, value []byte) error {
+	if w.batch == nil {
+		b, err := w.d.Batch(ctx)
+		if err != nil {
+			return err
+		}
+		w.batch = b
+	}
+	if err := w.batch.Put(ctx, k, value); err != nil {
+		return err
+	}
+	w.pending++
+	if w.pending == migrateBatchSize {
+		return w.commit(ctx)
+	}
+	return nil
+}
+
+func (w *leveldbWriter) commit(ctx context.Context) error {
+	if w.batch == nil {
+		return nil
+	}
+	err := w.batch.Commit(ctx)
+	w.batch, w.pending = nil, 0
+	return err
+}
+
+func (w *leveldbWriter) Close() error {
+	err := w.commit(context.Background())
+	if cerr := w.d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// pebbleWriter sets the entries without syncing, they are flushed on Close
+type pebbleWriter struct {
+	db *pebble.DB
+}
+
+func (w *pebbleWriter) put(_ context.Context, k ds.Key, value []byte) error {
+	return w.db.Set(k.Bytes(), value, pebble.NoSync)
+}
+
+func (w *pebbleWriter) Close() error {
+	err := w.db.Flush()
+	if cerr := w.db.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
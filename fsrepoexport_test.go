@@ -0,0 +1,110 @@
+package encrepo
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ipfs/boxo/datastore/dshelp"
+	"github.com/ipfs/boxo/keystore"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-datastore"
+	config "github.com/ipfs/kubo/config"
+	serialize "github.com/ipfs/kubo/config/serialize"
+	"github.com/ipfs/kubo/core/coreiface/options"
+	ci "github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportFSRepo(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	identity, err := config.CreateIdentity(io.Discard, []options.KeyGenerateOption{options.Key.Type(options.Ed25519Key)})
+	require.NoError(t, err)
+	conf, err := config.InitWithIdentity(identity)
+	require.NoError(t, err)
+	conf.Datastore = testingDatastoreConfig()
+
+	key := testingKey(t)
+	opts := SQLCipherDatastoreOptions{}
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "db.sqlite")
+	require.NoError(t, Init(dbPath, key, opts, conf))
+
+	t.Log("fill the repo")
+	r, err := Open(dbPath, key, opts)
+	require.NoError(t, err)
+	b := blocks.NewBlock([]byte("foo"))
+	require.NoError(t, r.(Repo).Blockstore().Put(ctx, b))
+	require.NoError(t, r.Datastore().Put(ctx, datastore.NewKey("/local/filesroot"), []byte("root")))
+	sk, _, err := ci.GenerateEd25519Key(nil)
+	require.NoError(t, err)
+	require.NoError(t, r.Keystore().Put("foo", sk))
+	require.NoError(t, r.(*encRepo).root.Put(ctx, datastore.NewKey("swarm.key"), []byte("swarm key")))
+	require.NoError(t, r.Close())
+
+	t.Log("export to the default kubo datastores")
+	fsrepoPath := filepath.Join(dir, ".ipfs")
+	report, err := ExportFSRepo(dbPath, fsrepoPath, key, opts, ExportFSRepoOptions{})
+	require.NoError(t, err)
+	require.Equal(t, map[string]int{"/blocks": 1, "/": 1}, report.Entries)
+	require.Equal(t, 1, report.Keys)
+
+	_, err = ExportFSRepo(dbPath, fsrepoPath, key, opts, ExportFSRepoOptions{})
+	require.ErrorContains(t, err, "already exists")
+
+	spec, err := os.ReadFile(filepath.Join(fsrepoPath, "datastore_spec"))
+	require.NoError(t, err)
+	require.Equal(t, `{"mounts":[{"mountpoint":"/blocks","path":"blocks","shardFunc":"/repo/flatfs/shard/v1/next-to-last/2","type":"flatfs"},{"mountpoint":"/","path":"datastore","type":"levelds"}],"type":"mount"}`, string(spec))
+
+	exported, err := serialize.Load(filepath.Join(fsrepoPath, "config"))
+	require.NoError(t, err)
+	require.Equal(t, identity, exported.Identity)
+
+	name := dshelp.MultihashToDsKey(b.Cid().Hash()).String()[1:]
+	data, err := os.ReadFile(filepath.Join(fsrepoPath, "blocks", name[len(name)-3:len(name)-1], name+".data"))
+	require.NoError(t, err)
+	require.Equal(t, b.RawData(), data)
+
+	ks, err := keystore.NewFSKeystore(filepath.Join(fsrepoPath, "keystore"))
+	require.NoError(t, err)
+	got, err := ks.Get("foo")
+	require.NoError(t, err)
+	require.True(t, sk.Equals(got))
+
+	t.Log("the export doesn't record the use of the keys")
+	r, err = Open(dbPath, key, opts)
+	require.NoError(t, err)
+	info, err := r.Keystore().(InfoKeystore).GetInfo(ctx, "foo")
+	require.NoError(t, err)
+	require.True(t, info.LastUsed.IsZero())
+	require.NoError(t, r.Close())
+
+	swarmKey, err := os.ReadFile(filepath.Join(fsrepoPath, "swarm.key"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("swarm key"), swarmKey)
+
+	t.Log("export to pebble and migrate back")
+	pebblePath := filepath.Join(dir, ".ipfs-pebble")
+	report, err = ExportFSRepo(dbPath, pebblePath, key, opts, ExportFSRepoOptions{
+		DatastoreSpec: map[string]interface{}{"type": "pebbleds", "path": "pebbleds"},
+	})
+	require.NoError(t, err)
+	require.Equal(t, map[string]int{"/": 2}, report.Entries)
+
+	migratedPath := filepath.Join(dir, "migrated.sqlite")
+	_, err = MigrateFromFSRepo(pebblePath, migratedPath, key, opts, MigrateOptions{})
+	require.NoError(t, err)
+	migrated, err := Open(migratedPath, key, opts)
+	require.NoError(t, err)
+	defer requireClose(t, migrated)
+	has, err := migrated.(Repo).Blockstore().Has(ctx, b.Cid())
+	require.NoError(t, err)
+	require.True(t, has)
+	val, err := migrated.Datastore().Get(ctx, datastore.NewKey("/local/filesroot"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("root"), val)
+}
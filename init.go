@@ -5,27 +5,27 @@ import (
 
 	sync_ds "github.com/ipfs/go-datastore/sync"
 	config "github.com/ipfs/kubo/config"
-	"github.com/pkg/errors"
 )
 
 const tableName = "ipfs"
 
 func IsInitialized(dbPath string, key []byte, opts SQLCipherDatastoreOptions) (bool, error) {
-	// packageLock is held to ensure that another caller doesn't attempt to
-	// Init or Remove the repo while this call is in progress.
-	packageLock.Lock()
-	defer packageLock.Unlock()
+	return IsInitializedContext(context.Background(), dbPath, key, opts)
+}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+// IsInitializedContext is like IsInitialized with a context.
+func IsInitializedContext(ctx context.Context, dbPath string, key []byte, opts SQLCipherDatastoreOptions) (bool, error) {
+	// the lock of dbPath is held to ensure that another caller doesn't
+	// attempt to Init or Remove the repo while this call is in progress.
+	defer dbLocks.lock(dbPath)()
 
 	return isInitialized(ctx, dbPath, key, opts)
 }
 
 // isInitialized reports whether the repo is initialized. Caller must
-// hold the packageLock.
+// hold the lock of dbPath.
 func isInitialized(ctx context.Context, dbPath string, key []byte, opts SQLCipherDatastoreOptions) (bool, error) {
-	uds, err := OpenSQLCipherDatastore("sqlite3", dbPath, tableName, key, opts)
+	uds, err := OpenSQLCipherDatastoreContext(ctx, "sqlite3", dbPath, tableName, key, opts)
 	if err == ErrDatabaseNotFound {
 		return false, nil
 	}
@@ -45,14 +45,21 @@ func isInitialized(ctx context.Context, dbPath string, key []byte, opts SQLCiphe
 }
 
 func Init(dbPath string, key []byte, opts SQLCipherDatastoreOptions, conf *config.Config) error {
-	// packageLock must be held to ensure that the repo is not initialized more
-	// than once.
-	packageLock.Lock()
-	defer packageLock.Unlock()
+	return InitContext(context.Background(), dbPath, key, opts, conf)
+}
+
+// InitContext is like Init with a context.
+func InitContext(ctx context.Context, dbPath string, key []byte, opts SQLCipherDatastoreOptions, conf *config.Config) error {
+	// the lock of dbPath must be held to ensure that the repo is not
+	// initialized more than once.
+	defer dbLocks.lock(dbPath)()
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	return initRepo(ctx, dbPath, key, opts, conf)
+}
 
+// initRepo initializes the repo at dbPath if it's not. Caller must hold the
+// lock of dbPath.
+func initRepo(ctx context.Context, dbPath string, key []byte, opts SQLCipherDatastoreOptions, conf *config.Config) error {
 	isInit, err := isInitialized(ctx, dbPath, key, opts)
 	if err != nil {
 		return err
@@ -61,7 +68,19 @@ func Init(dbPath string, key []byte, opts SQLCipherDatastoreOptions, conf *confi
 		return nil
 	}
 
-	uds, err := NewSQLCipherDatastore("sqlite3", dbPath, tableName, key, opts)
+	if len(conf.Datastore.Spec) == 0 {
+		// an empty spec is the single table layout of the first repos
+		withSpec := *conf
+		withSpec.Datastore.Spec = DefaultDatastoreSpec()
+		conf = &withSpec
+	}
+
+	dsc, err := parseDatastoreSpec(conf.Datastore.Spec)
+	if err != nil {
+		return err
+	}
+
+	uds, err := NewSQLCipherDatastoreContext(ctx, "sqlite3", dbPath, tableName, key, opts)
 	if err != nil {
 		return err
 	}
@@ -72,13 +91,13 @@ func Init(dbPath string, key []byte, opts SQLCipherDatastoreOptions, conf *confi
 		return err
 	}
 
-	if len(conf.Datastore.Spec) != 0 {
-		return errors.New("Config.Datastore.Spec not supported")
+	if err := checkDatastoreSpec(ctx, ds, dsc, false); err != nil {
+		return err
 	}
 
-	/*if err := migrations.WriteRepoVersion(repoPath, RepoVersion); err != nil {
+	if err := putRepoVersion(ctx, ds); err != nil {
 		return err
-	}*/
+	}
 
 	return uds.Close()
 }
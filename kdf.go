@@ -0,0 +1,223 @@
+package encrepo
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	config "github.com/ipfs/kubo/config"
+	"github.com/ipfs/kubo/repo"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// KDFAlgorithm is a key derivation function used to derive the database key
+// from a passphrase.
+type KDFAlgorithm string
+
+const (
+	KDFArgon2id KDFAlgorithm = "argon2id"
+	KDFScrypt   KDFAlgorithm = "scrypt"
+)
+
+// KDFParams are the tunable parameters of the key derivation. Time, Memory
+// (in KiB) and Threads are used by argon2id, N, R and P by scrypt.
+type KDFParams struct {
+	Algorithm KDFAlgorithm `json:"algorithm"`
+
+	Time    uint32 `json:"time,omitempty"`
+	Memory  uint32 `json:"memory,omitempty"`
+	Threads uint8  `json:"threads,omitempty"`
+
+	N int `json:"n,omitempty"`
+	R int `json:"r,omitempty"`
+	P int `json:"p,omitempty"`
+}
+
+// DefaultKDFParams returns the argon2id parameters recommended by RFC 9106
+// for memory constrained environments.
+func DefaultKDFParams() KDFParams {
+	return KDFParams{Algorithm: KDFArgon2id, Time: 3, Memory: 64 * 1024, Threads: 4}
+}
+
+func (p KDFParams) validate() error {
+	switch p.Algorithm {
+	case KDFArgon2id:
+		if p.Time == 0 || p.Memory == 0 || p.Threads == 0 {
+			return errors.New("argon2id time, memory and threads must be set")
+		}
+	case KDFScrypt:
+		if p.N <= 1 || p.N&(p.N-1) != 0 {
+			return errors.New("scrypt N must be a power of two greater than 1")
+		}
+		if p.R <= 0 || p.P <= 0 {
+			return errors.New("scrypt r and p must be set")
+		}
+	default:
+		return fmt.Errorf("unknown kdf algorithm %q", p.Algorithm)
+	}
+	return nil
+}
+
+// KDFDescriptor describes how the key of a repo is derived, it's stored in
+// plaintext next to the database so the repo is self-describing.
+type KDFDescriptor struct {
+	KDFParams
+
+	// Salt is the salt of the key derivation
+	Salt []byte `json:"salt"`
+	// CipherSalt is the SQLCipher salt, set when the database has a plaintext
+	// header
+	CipherSalt []byte `json:"cipher_salt,omitempty"`
+}
+
+const kdfSaltLength = 16
+
+// DeriveKey derives the database key from passphrase.
+func (d *KDFDescriptor) DeriveKey(passphrase []byte) ([]byte, error) {
+	if err := d.validate(); err != nil {
+		return nil, err
+	}
+	if len(d.Salt) < kdfSaltLength {
+		return nil, fmt.Errorf("bad kdf salt, expected at least %d bytes, got %d", kdfSaltLength, len(d.Salt))
+	}
+
+	switch d.Algorithm {
+	case KDFArgon2id:
+		return argon2.IDKey(passphrase, d.Salt, d.Time, d.Memory, d.Threads, keyLength), nil
+	case KDFScrypt:
+		return scrypt.Key(passphrase, d.Salt, d.N, d.R, d.P, keyLength)
+	}
+	return nil, fmt.Errorf("unknown kdf algorithm %q", d.Algorithm)
+}
+
+// apply sets the options stored in the descriptor
+func (d *KDFDescriptor) apply(opts SQLCipherDatastoreOptions) SQLCipherDatastoreOptions {
+	if len(d.CipherSalt) != 0 {
+		opts.PlaintextHeader = true
+		opts.Salt = d.CipherSalt
+	}
+	return opts
+}
+
+// KDFDescriptorPath returns the path of the KDF descriptor of the database at
+// dbPath.
+func KDFDescriptorPath(dbPath string) string {
+	return dbPath + ".kdf"
+}
+
+// ReadKDFDescriptor reads the KDF descriptor of the database at dbPath.
+func ReadKDFDescriptor(dbPath string) (*KDFDescriptor, error) {
+	b, err := os.ReadFile(KDFDescriptorPath(dbPath))
+	if err != nil {
+		return nil, errors.Wrap(err, "read kdf descriptor")
+	}
+
+	var d KDFDescriptor
+	if err := json.Unmarshal(b, &d); err != nil {
+		return nil, errors.Wrap(err, "unmarshal kdf descriptor")
+	}
+	return &d, nil
+}
+
+func writeKDFDescriptor(dbPath string, d *KDFDescriptor) error {
+	b, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "marshal kdf descriptor")
+	}
+	return writeFileAtomic(KDFDescriptorPath(dbPath), b)
+}
+
+// writeFileAtomic writes data in a temporary file renamed to path, the
+// temporary file is unique so that concurrent writers don't clobber it
+func writeFileAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := f.Name()
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// InitWithPassphrase initializes a repo whose key is derived from passphrase
+// with the given parameters. The salts are generated and stored in the KDF
+// descriptor, if the repo has a plaintext header opts.Salt may be left
+// empty.
+func InitWithPassphrase(dbPath string, passphrase []byte, params KDFParams, opts SQLCipherDatastoreOptions, conf *config.Config) error {
+	d, err := ReadKDFDescriptor(dbPath)
+	switch {
+	case err == nil:
+		// already initialized or interrupted initialization
+	case errors.Is(err, os.ErrNotExist):
+		if _, err := os.Stat(dbPath); err == nil {
+			return errors.New("database exists without kdf descriptor")
+		}
+
+		if err := params.validate(); err != nil {
+			return err
+		}
+		d = &KDFDescriptor{KDFParams: params, Salt: make([]byte, kdfSaltLength)}
+		if _, err := rand.Read(d.Salt); err != nil {
+			return errors.Wrap(err, "generate kdf salt")
+		}
+		if opts.PlaintextHeader {
+			d.CipherSalt = opts.Salt
+			if len(d.CipherSalt) == 0 {
+				d.CipherSalt = make([]byte, saltLength)
+				if _, err := rand.Read(d.CipherSalt); err != nil {
+					return errors.Wrap(err, "generate cipher salt")
+				}
+			}
+		}
+		if err := writeKDFDescriptor(dbPath, d); err != nil {
+			return err
+		}
+	default:
+		return err
+	}
+
+	key, err := d.DeriveKey(passphrase)
+	if err != nil {
+		return errors.Wrap(err, "derive key")
+	}
+	defer clear(key)
+
+	return Init(dbPath, key, d.apply(opts), conf)
+}
+
+// OpenWithPassphrase opens a repo initialized with InitWithPassphrase.
+func OpenWithPassphrase(dbPath string, passphrase []byte, opts SQLCipherDatastoreOptions) (repo.Repo, error) {
+	d, err := ReadKDFDescriptor(dbPath)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := d.DeriveKey(passphrase)
+	if err != nil {
+		return nil, errors.Wrap(err, "derive key")
+	}
+	defer clear(key)
+
+	return Open(dbPath, key, d.apply(opts))
+}
@@ -0,0 +1,66 @@
+package encrepo
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	config "github.com/ipfs/kubo/config"
+	"github.com/stretchr/testify/require"
+)
+
+// testingKDFParams are cheap parameters to keep the tests fast
+var testingKDFParams = KDFParams{Algorithm: KDFArgon2id, Time: 1, Memory: 64, Threads: 1}
+
+func TestInitWithPassphrase(t *testing.T) {
+	for _, params := range []KDFParams{
+		testingKDFParams,
+		{Algorithm: KDFScrypt, N: 16, R: 8, P: 1},
+	} {
+		t.Run(string(params.Algorithm), func(t *testing.T) {
+			dbPath := filepath.Join(t.TempDir(), "db.sqlite")
+			passphrase := []byte("correct horse battery staple")
+			opts := SQLCipherDatastoreOptions{PlaintextHeader: true, JournalMode: "WAL"}
+
+			require.NoError(t, InitWithPassphrase(dbPath, passphrase, params, opts, &config.Config{}))
+			require.NoError(t, InitWithPassphrase(dbPath, passphrase, params, opts, &config.Config{}))
+
+			d, err := ReadKDFDescriptor(dbPath)
+			require.NoError(t, err)
+			require.Equal(t, params, d.KDFParams)
+			require.Len(t, d.Salt, kdfSaltLength)
+			require.Len(t, d.CipherSalt, saltLength)
+
+			_, err = OpenWithPassphrase(dbPath, []byte("wrong"), SQLCipherDatastoreOptions{JournalMode: "WAL"})
+			require.Error(t, err)
+
+			r, err := OpenWithPassphrase(dbPath, passphrase, SQLCipherDatastoreOptions{JournalMode: "WAL"})
+			require.NoError(t, err)
+			require.NoError(t, r.Close())
+
+			key, err := d.DeriveKey(passphrase)
+			require.NoError(t, err)
+			isInit, err := IsInitialized(dbPath, key, SQLCipherDatastoreOptions{PlaintextHeader: true, Salt: d.CipherSalt})
+			require.NoError(t, err)
+			require.True(t, isInit)
+
+			t.Log("the passphrase would no longer open a rekeyed repo")
+			require.ErrorIs(t, Rekey(dbPath, key, testingKey(t), d.apply(opts)), ErrKeyWrapped)
+		})
+	}
+}
+
+func TestInitWithPassphraseExistingDatabase(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "db.sqlite")
+	require.NoError(t, Init(dbPath, testingKey(t), SQLCipherDatastoreOptions{}, &config.Config{}))
+	require.Error(t, InitWithPassphrase(dbPath, []byte("foo"), testingKDFParams, SQLCipherDatastoreOptions{}, &config.Config{}))
+	_, err := os.Stat(KDFDescriptorPath(dbPath))
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestKDFParamsValidate(t *testing.T) {
+	require.NoError(t, DefaultKDFParams().validate())
+	require.Error(t, KDFParams{}.validate())
+	require.Error(t, KDFParams{Algorithm: KDFArgon2id}.validate())
+	require.Error(t, KDFParams{Algorithm: KDFScrypt, N: 15, R: 8, P: 1}.validate())
+}
@@ -0,0 +1,357 @@
+package encrepo
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+
+	sqlds "github.com/ipfs/go-ds-sql"
+	config "github.com/ipfs/kubo/config"
+	"github.com/ipfs/kubo/repo"
+	"github.com/pkg/errors"
+)
+
+// KeyProvider provides the database key.
+type KeyProvider interface {
+	// Key returns a copy of the current key, the caller wipes it after use.
+	Key(ctx context.Context) ([]byte, error)
+
+	// OnRotation registers fn to be called after the key has been rotated,
+	// Key then returns the new key. The returned function unregisters fn.
+	OnRotation(fn func(ctx context.Context) error) (unregister func())
+
+	// Wipe erases the key material held by the provider.
+	Wipe()
+}
+
+// rotationNotifier implements KeyProvider.OnRotation
+type rotationNotifier struct {
+	muCallbacks sync.Mutex
+	nextID      int
+	callbacks   map[int]func(ctx context.Context) error
+}
+
+func (n *rotationNotifier) OnRotation(fn func(ctx context.Context) error) func() {
+	n.muCallbacks.Lock()
+	defer n.muCallbacks.Unlock()
+
+	if n.callbacks == nil {
+		n.callbacks = make(map[int]func(ctx context.Context) error)
+	}
+	id := n.nextID
+	n.nextID++
+	n.callbacks[id] = fn
+
+	return func() {
+		n.muCallbacks.Lock()
+		defer n.muCallbacks.Unlock()
+		delete(n.callbacks, id)
+	}
+}
+
+// notifyRotation calls the callbacks in registration order and stops at the
+// first error
+func (n *rotationNotifier) notifyRotation(ctx context.Context) error {
+	n.muCallbacks.Lock()
+	ids := make([]int, 0, len(n.callbacks))
+	for id := range n.callbacks {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	callbacks := make([]func(ctx context.Context) error, len(ids))
+	for i, id := range ids {
+		callbacks[i] = n.callbacks[id]
+	}
+	n.muCallbacks.Unlock()
+
+	for _, fn := range callbacks {
+		if err := fn(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StaticKeyProvider provides a key held in memory.
+type StaticKeyProvider struct {
+	rotationNotifier
+
+	muKey sync.RWMutex
+	key   []byte
+	// muRotate serializes the rotations
+	muRotate sync.Mutex
+}
+
+var _ KeyProvider = (*StaticKeyProvider)(nil)
+
+// NewStaticKeyProvider returns a provider of a copy of key.
+func NewStaticKeyProvider(key []byte) *StaticKeyProvider {
+	return &StaticKeyProvider{key: bytes.Clone(key)}
+}
+
+func (p *StaticKeyProvider) Key(context.Context) ([]byte, error) {
+	p.muKey.RLock()
+	defer p.muKey.RUnlock()
+
+	if p.key == nil {
+		return nil, errors.New("key wiped")
+	}
+	return bytes.Clone(p.key), nil
+}
+
+// Rotate replaces the key with newKey and notifies the rotation callbacks.
+// The previous key is restored if a callback fails.
+func (p *StaticKeyProvider) Rotate(ctx context.Context, newKey []byte) error {
+	p.muRotate.Lock()
+	defer p.muRotate.Unlock()
+
+	p.muKey.Lock()
+	previous := p.key
+	p.key = bytes.Clone(newKey)
+	p.muKey.Unlock()
+
+	if err := p.notifyRotation(ctx); err != nil {
+		p.muKey.Lock()
+		clear(p.key)
+		p.key = previous
+		p.muKey.Unlock()
+		return err
+	}
+	clear(previous)
+	return nil
+}
+
+func (p *StaticKeyProvider) Wipe() {
+	p.muKey.Lock()
+	defer p.muKey.Unlock()
+
+	clear(p.key)
+	p.key = nil
+}
+
+// EnvKeyProvider provides a hex encoded key read from an environment
+// variable. The environment is owned by the caller, Wipe doesn't unset the
+// variable.
+type EnvKeyProvider struct {
+	rotationNotifier
+
+	Name string
+}
+
+var _ KeyProvider = (*EnvKeyProvider)(nil)
+
+// NewEnvKeyProvider returns a provider of the key in the environment
+// variable name.
+func NewEnvKeyProvider(name string) *EnvKeyProvider {
+	return &EnvKeyProvider{Name: name}
+}
+
+func (p *EnvKeyProvider) Key(context.Context) ([]byte, error) {
+	val, ok := os.LookupEnv(p.Name)
+	if !ok {
+		return nil, fmt.Errorf("environment variable %s not set", p.Name)
+	}
+	key, err := hex.DecodeString(val)
+	if err != nil {
+		return nil, errors.Wrap(err, "decode key from environment")
+	}
+	if err := checkKeyLength(key); err != nil {
+		clear(key)
+		return nil, errors.Wrap(err, "decode key from environment")
+	}
+	return key, nil
+}
+
+// Wipe is a noop, the environment is owned by the caller.
+func (p *EnvKeyProvider) Wipe() {}
+
+// FileKeyProvider provides a key read from a file, either raw or hex
+// encoded.
+type FileKeyProvider struct {
+	rotationNotifier
+
+	Path string
+}
+
+var _ KeyProvider = (*FileKeyProvider)(nil)
+
+// NewFileKeyProvider returns a provider of the key stored in the file at
+// path.
+func NewFileKeyProvider(path string) *FileKeyProvider {
+	return &FileKeyProvider{Path: path}
+}
+
+func (p *FileKeyProvider) Key(context.Context) ([]byte, error) {
+	b, err := os.ReadFile(p.Path)
+	if err != nil {
+		return nil, errors.Wrap(err, "read key file")
+	}
+	defer clear(b)
+	return decodeKey(b)
+}
+
+// Wipe is a noop, the key file is owned by the caller.
+func (p *FileKeyProvider) Wipe() {}
+
+// ReaderKeyProvider provides a key read once from a reader, e.g. a pipe set
+// up by a parent process, either raw or hex encoded.
+type ReaderKeyProvider struct {
+	rotationNotifier
+
+	muKey sync.Mutex
+	r     io.Reader
+	key   []byte
+}
+
+var _ KeyProvider = (*ReaderKeyProvider)(nil)
+
+// NewReaderKeyProvider returns a provider of the key read from r, r is
+// closed after use if it's an io.Closer.
+func NewReaderKeyProvider(r io.Reader) *ReaderKeyProvider {
+	return &ReaderKeyProvider{r: r}
+}
+
+// NewFDKeyProvider returns a provider of the key read from fd, it takes
+// ownership of fd.
+func NewFDKeyProvider(fd uintptr) *ReaderKeyProvider {
+	return NewReaderKeyProvider(os.NewFile(fd, "key"))
+}
+
+func (p *ReaderKeyProvider) Key(context.Context) ([]byte, error) {
+	p.muKey.Lock()
+	defer p.muKey.Unlock()
+
+	if p.key == nil {
+		if p.r == nil {
+			return nil, errors.New("key wiped")
+		}
+		b, err := io.ReadAll(p.r)
+		p.closeReader()
+		defer clear(b)
+		if err != nil {
+			return nil, errors.Wrap(err, "read key")
+		}
+		if p.key, err = decodeKey(b); err != nil {
+			return nil, err
+		}
+	}
+	return bytes.Clone(p.key), nil
+}
+
+func (p *ReaderKeyProvider) Wipe() {
+	p.muKey.Lock()
+	defer p.muKey.Unlock()
+
+	p.closeReader()
+	clear(p.key)
+	p.key = nil
+}
+
+func (p *ReaderKeyProvider) closeReader() {
+	if c, ok := p.r.(io.Closer); ok {
+		_ = c.Close()
+	}
+	p.r = nil
+}
+
+// decodeKey decodes a raw or hex encoded key
+func decodeKey(b []byte) ([]byte, error) {
+	if len(b) == keyLength {
+		return bytes.Clone(b), nil
+	}
+	trimmed := bytes.TrimSpace(b)
+	key := make([]byte, hex.DecodedLen(len(trimmed)))
+	if _, err := hex.Decode(key, trimmed); err != nil {
+		return nil, errors.Wrap(err, "decode key")
+	}
+	if err := checkKeyLength(key); err != nil {
+		clear(key)
+		return nil, errors.Wrap(err, "decode key")
+	}
+	return key, nil
+}
+
+// checkKeyLength returns an error if key is not keyLength bytes long
+func checkKeyLength(key []byte) error {
+	if len(key) != keyLength {
+		return fmt.Errorf("bad key length, expected %d bytes, got %d", keyLength, len(key))
+	}
+	return nil
+}
+
+// OpenWithKeyProvider is like Open but gets the key from kp. The repo is
+// rekeyed when kp notifies a rotation.
+func OpenWithKeyProvider(dbPath string, kp KeyProvider, opts SQLCipherDatastoreOptions) (repo.Repo, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	key, err := kp.Key(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "get key")
+	}
+	defer clear(key)
+
+	// a duress key replaces the repo with a decoy which is then opened
+	if err := checkDuressKey(ctx, dbPath, key, opts); err != nil {
+		return nil, err
+	}
+
+	fn := func() (*encRepo, error) {
+		r, err := open(ctx, dbPath, key, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		r.unregisterRotation = kp.OnRotation(func(ctx context.Context) error {
+			newKey, err := kp.Key(ctx)
+			if err != nil {
+				return errors.Wrap(err, "get key")
+			}
+			defer clear(newKey)
+			return r.Rekey(newKey)
+		})
+
+		return r, nil
+	}
+	return onlyOne.Open(dbPath, opts, fn)
+}
+
+// InitWithKeyProvider is like Init but gets the key from kp.
+func InitWithKeyProvider(dbPath string, kp KeyProvider, opts SQLCipherDatastoreOptions, conf *config.Config) error {
+	key, err := kp.Key(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "get key")
+	}
+	defer clear(key)
+
+	return Init(dbPath, key, opts, conf)
+}
+
+// IsInitializedWithKeyProvider is like IsInitialized but gets the key from
+// kp.
+func IsInitializedWithKeyProvider(dbPath string, kp KeyProvider, opts SQLCipherDatastoreOptions) (bool, error) {
+	key, err := kp.Key(context.Background())
+	if err != nil {
+		return false, errors.Wrap(err, "get key")
+	}
+	defer clear(key)
+
+	return IsInitialized(dbPath, key, opts)
+}
+
+// OpenSQLCipherDatastoreWithKeyProvider is like OpenSQLCipherDatastore but
+// gets the key from kp.
+func OpenSQLCipherDatastoreWithKeyProvider(driver, dbPath, table string, kp KeyProvider, opts SQLCipherDatastoreOptions) (*sqlds.Datastore, error) {
+	key, err := kp.Key(context.Background())
+	if err != nil {
+		return nil, errors.Wrap(err, "get key")
+	}
+	defer clear(key)
+
+	return OpenSQLCipherDatastore(driver, dbPath, table, key, opts)
+}
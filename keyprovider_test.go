@@ -0,0 +1,158 @@
+package encrepo
+
+import (
+	"context"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+	config "github.com/ipfs/kubo/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStaticKeyProviderRotation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	salt := testingSalt(t)
+	opts := SQLCipherDatastoreOptions{PlaintextHeader: true, Salt: salt, JournalMode: "WAL"}
+	dbPath := filepath.Join(t.TempDir(), "db.sqlite")
+	kp := NewStaticKeyProvider(testingKey(t))
+
+	require.NoError(t, InitWithKeyProvider(dbPath, kp, opts, &config.Config{}))
+	isInit, err := IsInitializedWithKeyProvider(dbPath, kp, opts)
+	require.NoError(t, err)
+	require.True(t, isInit)
+
+	r, err := OpenWithKeyProvider(dbPath, kp, opts)
+	require.NoError(t, err)
+	require.NoError(t, r.Datastore().Put(ctx, datastore.NewKey("foo"), []byte("bar")))
+
+	t.Log("a failed rotation keeps the key")
+	oldKey, err := kp.Key(ctx)
+	require.NoError(t, err)
+	require.Error(t, kp.Rotate(ctx, testingKey(t)[:16]))
+	key, err := kp.Key(ctx)
+	require.NoError(t, err)
+	require.Equal(t, oldKey, key)
+	require.NoError(t, r.Datastore().Put(ctx, datastore.NewKey("foo"), []byte("bar")))
+
+	t.Log("rotating the key rekeys the open repo")
+	newKey := testingKey(t)
+	require.NoError(t, kp.Rotate(ctx, newKey))
+	require.NoError(t, r.Close())
+
+	r, err = Open(dbPath, newKey, opts)
+	require.NoError(t, err)
+	val, err := r.Datastore().Get(ctx, datastore.NewKey("foo"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("bar"), val)
+	require.NoError(t, r.Close())
+
+	t.Log("closed repos are not rekeyed")
+	require.NoError(t, kp.Rotate(ctx, testingKey(t)))
+	isInit, err = IsInitialized(dbPath, newKey, opts)
+	require.NoError(t, err)
+	require.True(t, isInit)
+
+	kp.Wipe()
+	_, err = kp.Key(ctx)
+	require.Error(t, err)
+}
+
+func TestKeyProviders(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	key := testingKey(t)
+
+	t.Log("env")
+	const envName = "ENCREPO_TEST_KEY"
+	t.Setenv(envName, hex.EncodeToString(key))
+	envKey, err := NewEnvKeyProvider(envName).Key(ctx)
+	require.NoError(t, err)
+	require.Equal(t, key, envKey)
+
+	t.Log("raw and hex files")
+	rawPath := filepath.Join(t.TempDir(), "key")
+	require.NoError(t, os.WriteFile(rawPath, key, 0o600))
+	fileKey, err := NewFileKeyProvider(rawPath).Key(ctx)
+	require.NoError(t, err)
+	require.Equal(t, key, fileKey)
+	hexPath := filepath.Join(t.TempDir(), "key.hex")
+	require.NoError(t, os.WriteFile(hexPath, []byte(hex.EncodeToString(key)+"\n"), 0o600))
+	fileKey, err = NewFileKeyProvider(hexPath).Key(ctx)
+	require.NoError(t, err)
+	require.Equal(t, key, fileKey)
+
+	t.Log("the keys of the wrong length are rejected")
+	for _, b := range [][]byte{[]byte(hex.EncodeToString(key[:31])), []byte(hex.EncodeToString(append(key, 0)))} {
+		require.NoError(t, os.WriteFile(hexPath, b, 0o600))
+		_, err = NewFileKeyProvider(hexPath).Key(ctx)
+		require.ErrorContains(t, err, "bad key length")
+	}
+	t.Setenv(envName, hex.EncodeToString(key[:16]))
+	_, err = NewEnvKeyProvider(envName).Key(ctx)
+	require.ErrorContains(t, err, "bad key length")
+
+	t.Log("wiping doesn't unset the environment variable")
+	NewEnvKeyProvider(envName).Wipe()
+	_, ok := os.LookupEnv(envName)
+	require.True(t, ok)
+
+	t.Log("pipe")
+	pr, pw, err := os.Pipe()
+	require.NoError(t, err)
+	_, err = pw.Write(key)
+	require.NoError(t, err)
+	require.NoError(t, pw.Close())
+	fdkp := NewReaderKeyProvider(pr)
+	for i := 0; i < 2; i++ {
+		fdKey, err := fdkp.Key(ctx)
+		require.NoError(t, err)
+		require.Equal(t, key, fdKey)
+	}
+	fdkp.Wipe()
+	_, err = fdkp.Key(ctx)
+	require.Error(t, err)
+}
+
+func TestSoftToken(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tokenPath := filepath.Join(t.TempDir(), "token.json")
+	pin := []byte("1234")
+	dbPath := filepath.Join(t.TempDir(), "db.sqlite")
+	opts := SQLCipherDatastoreOptions{JournalMode: "WAL"}
+
+	token, err := OpenSoftToken(tokenPath, pin, testingKDFParams)
+	require.NoError(t, err)
+	require.NoError(t, token.GenerateKey("repo"))
+	require.ErrorIs(t, token.GenerateKey("repo"), ErrTokenKeyExists)
+
+	kp := token.KeyProvider("repo")
+	require.NoError(t, InitWithKeyProvider(dbPath, kp, opts, &config.Config{}))
+	r, err := OpenWithKeyProvider(dbPath, kp, opts)
+	require.NoError(t, err)
+
+	require.NoError(t, token.RotateKey(ctx, "repo"))
+	require.NoError(t, r.Close())
+	require.NoError(t, token.Close())
+
+	_, err = OpenSoftToken(tokenPath, []byte("4321"), testingKDFParams)
+	require.ErrorIs(t, err, ErrTokenBadPIN)
+
+	t.Log("the rotated key is persisted")
+	token, err = OpenSoftToken(tokenPath, pin, testingKDFParams)
+	require.NoError(t, err)
+	defer requireClose(t, token)
+	isInit, err := IsInitializedWithKeyProvider(dbPath, token.KeyProvider("repo"), opts)
+	require.NoError(t, err)
+	require.True(t, isInit)
+
+	_, err = token.KeyProvider("unknown").Key(ctx)
+	require.ErrorIs(t, err, ErrTokenNoSuchKey)
+}
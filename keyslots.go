@@ -0,0 +1,351 @@
+package encrepo
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	config "github.com/ipfs/kubo/config"
+	"github.com/ipfs/kubo/repo"
+	"github.com/pkg/errors"
+)
+
+// Key slots wrap the random data encryption key (DEK) used as the SQLCipher
+// key with several key encryption keys (KEK), like LUKS. A KEK is either
+// derived from a passphrase or a raw 32 bytes key (e.g. a device bound key).
+// The slots are stored in plaintext next to the database, so they can be
+// added and removed without re-encrypting the database.
+
+var (
+	ErrNoMatchingKeySlot = errors.New("no key slot matches the secret")
+	ErrKeySlotNotFound   = errors.New("key slot not found")
+	ErrKeySlotExists     = errors.New("key slot already exists")
+)
+
+// KeySlot is a copy of the data encryption key wrapped by a key encryption
+// key.
+type KeySlot struct {
+	Name string `json:"name"`
+	// KDF is set when the key encryption key is derived from a passphrase
+	KDF        *KDFDescriptor `json:"kdf,omitempty"`
+	Nonce      []byte         `json:"nonce"`
+	WrappedKey []byte         `json:"wrapped_key"`
+	CreatedAt  time.Time      `json:"created_at"`
+}
+
+// KeySlotInfo describes a key slot.
+type KeySlotInfo struct {
+	Name       string
+	Passphrase bool
+	CreatedAt  time.Time
+}
+
+type keySlotsHeader struct {
+	// CipherSalt is the SQLCipher salt, set when the database has a plaintext
+	// header
+	CipherSalt []byte    `json:"cipher_salt,omitempty"`
+	Slots      []KeySlot `json:"slots"`
+}
+
+// KeySlotsPath returns the path of the key slots header of the database at
+// dbPath.
+func KeySlotsPath(dbPath string) string {
+	return dbPath + ".keyslots"
+}
+
+func readKeySlots(dbPath string) (*keySlotsHeader, error) {
+	b, err := os.ReadFile(KeySlotsPath(dbPath))
+	if err != nil {
+		return nil, errors.Wrap(err, "read key slots")
+	}
+
+	var h keySlotsHeader
+	if err := json.Unmarshal(b, &h); err != nil {
+		return nil, errors.Wrap(err, "unmarshal key slots")
+	}
+	return &h, nil
+}
+
+func writeKeySlots(dbPath string, h *keySlotsHeader) error {
+	b, err := json.MarshalIndent(h, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "marshal key slots")
+	}
+	return writeFileAtomic(KeySlotsPath(dbPath), b)
+}
+
+func (h *keySlotsHeader) find(name string) int {
+	for i, s := range h.Slots {
+		if s.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// unlock returns the data encryption key from the first slot that matches
+// secret
+func (h *keySlotsHeader) unlock(secret []byte) ([]byte, error) {
+	for i := range h.Slots {
+		dek, err := h.Slots[i].unwrap(secret)
+		if err == nil {
+			return dek, nil
+		}
+	}
+	return nil, ErrNoMatchingKeySlot
+}
+
+func (h *keySlotsHeader) apply(opts SQLCipherDatastoreOptions) SQLCipherDatastoreOptions {
+	if len(h.CipherSalt) != 0 {
+		opts.PlaintextHeader = true
+		opts.Salt = h.CipherSalt
+	}
+	return opts
+}
+
+// newKeySlot wraps dek with a KEK derived from secret, if params is nil secret
+// is used as the KEK and must be 32 bytes long
+func newKeySlot(name string, dek, secret []byte, params *KDFParams) (*KeySlot, error) {
+	if name == "" {
+		return nil, errors.New("empty key slot name")
+	}
+
+	s := &KeySlot{Name: name, CreatedAt: time.Now().UTC()}
+	if params != nil {
+		if err := params.validate(); err != nil {
+			return nil, err
+		}
+		s.KDF = &KDFDescriptor{KDFParams: *params, Salt: make([]byte, kdfSaltLength)}
+		if _, err := rand.Read(s.KDF.Salt); err != nil {
+			return nil, errors.Wrap(err, "generate kdf salt")
+		}
+	}
+
+	aead, err := s.aead(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	s.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(s.Nonce); err != nil {
+		return nil, errors.Wrap(err, "generate nonce")
+	}
+	s.WrappedKey = aead.Seal(nil, s.Nonce, dek, []byte(s.Name))
+
+	return s, nil
+}
+
+func (s *KeySlot) aead(secret []byte) (cipher.AEAD, error) {
+	kek := secret
+	if s.KDF != nil {
+		var err error
+		if kek, err = s.KDF.DeriveKey(secret); err != nil {
+			return nil, errors.Wrap(err, "derive key")
+		}
+		// the cipher expands its own copy
+		defer clear(kek)
+	} else if len(kek) != keyLength {
+		return nil, fmt.Errorf("bad key length, expected %d bytes, got %d", keyLength, len(kek))
+	}
+
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (s *KeySlot) unwrap(secret []byte) ([]byte, error) {
+	aead, err := s.aead(secret)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, s.Nonce, s.WrappedKey, []byte(s.Name))
+}
+
+// InitWithKeySlot initializes a repo with a random data encryption key,
+// wrapped in a first key slot named name. If params is nil, secret is used
+// directly as the key encryption key and must be 32 bytes long, otherwise
+// the key encryption key is derived from secret.
+func InitWithKeySlot(dbPath string, name string, secret []byte, params *KDFParams, opts SQLCipherDatastoreOptions, conf *config.Config) error {
+	h, err := readKeySlots(dbPath)
+	switch {
+	case err == nil:
+		// already initialized or interrupted initialization
+	case errors.Is(err, os.ErrNotExist):
+		if _, err := os.Stat(dbPath); err == nil {
+			return errors.New("database exists without key slots")
+		}
+
+		dek := make([]byte, keyLength)
+		if _, err := rand.Read(dek); err != nil {
+			return errors.Wrap(err, "generate key")
+		}
+		defer clear(dek)
+		slot, err := newKeySlot(name, dek, secret, params)
+		if err != nil {
+			return err
+		}
+
+		h = &keySlotsHeader{Slots: []KeySlot{*slot}}
+		if opts.PlaintextHeader {
+			h.CipherSalt = opts.Salt
+			if len(h.CipherSalt) == 0 {
+				h.CipherSalt = make([]byte, saltLength)
+				if _, err := rand.Read(h.CipherSalt); err != nil {
+					return errors.Wrap(err, "generate cipher salt")
+				}
+			}
+		}
+		if err := writeKeySlots(dbPath, h); err != nil {
+			return err
+		}
+	default:
+		return err
+	}
+
+	dek, err := h.unlock(secret)
+	if err != nil {
+		return err
+	}
+	defer clear(dek)
+
+	return Init(dbPath, dek, h.apply(opts), conf)
+}
+
+// OpenWithKeySlot opens a repo initialized with InitWithKeySlot with the
+// secret of any of its key slots.
+func OpenWithKeySlot(dbPath string, secret []byte, opts SQLCipherDatastoreOptions) (repo.Repo, error) {
+	h, err := readKeySlots(dbPath)
+	if err != nil {
+		return nil, err
+	}
+
+	dek, err := h.unlock(secret)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(dek)
+
+	return Open(dbPath, dek, h.apply(opts))
+}
+
+// AddKeySlot adds a key slot named name, unlocked by newSecret. secret must
+// unlock one of the existing slots. The repo must not be open, see
+// ErrRepoOpen and ErrRepoLocked.
+func AddKeySlot(dbPath string, secret []byte, name string, newSecret []byte, params *KDFParams) error {
+	return withKeySlotsLocked(dbPath, func() error {
+		return addKeySlot(dbPath, secret, name, newSecret, params)
+	})
+}
+
+func addKeySlot(dbPath string, secret []byte, name string, newSecret []byte, params *KDFParams) error {
+	h, err := readKeySlots(dbPath)
+	if err != nil {
+		return err
+	}
+
+	if h.find(name) != -1 {
+		return ErrKeySlotExists
+	}
+
+	dek, err := h.unlock(secret)
+	if err != nil {
+		return err
+	}
+	defer clear(dek)
+
+	slot, err := newKeySlot(name, dek, newSecret, params)
+	if err != nil {
+		return err
+	}
+	h.Slots = append(h.Slots, *slot)
+
+	return writeKeySlots(dbPath, h)
+}
+
+// RemoveKeySlot removes the key slot named name. secret must unlock one of
+// the slots, the last slot can't be removed. The repo must not be open, see
+// ErrRepoOpen and ErrRepoLocked.
+func RemoveKeySlot(dbPath string, secret []byte, name string) error {
+	return withKeySlotsLocked(dbPath, func() error {
+		return removeKeySlot(dbPath, secret, name)
+	})
+}
+
+func removeKeySlot(dbPath string, secret []byte, name string) error {
+	h, err := readKeySlots(dbPath)
+	if err != nil {
+		return err
+	}
+
+	i := h.find(name)
+	if i == -1 {
+		return ErrKeySlotNotFound
+	}
+
+	if len(h.Slots) == 1 {
+		return errors.New("cannot remove the last key slot")
+	}
+
+	if _, err := h.unlock(secret); err != nil {
+		return err
+	}
+
+	h.Slots = append(h.Slots[:i], h.Slots[i+1:]...)
+
+	return writeKeySlots(dbPath, h)
+}
+
+// withKeySlotsLocked runs fn, which reads, modifies and writes the key slots
+// of the repo at dbPath, with the repo locked in this process and the others
+func withKeySlotsLocked(dbPath string, fn func() error) error {
+	return onlyOne.WithClosed(dbPath, func() error {
+		fileLock, err := lockRepoExclusive(context.Background(), dbPath, 0)
+		if err != nil {
+			return err
+		}
+		err = fn()
+		if cerr := fileLock.Close(); err == nil && cerr != nil {
+			err = errors.Wrap(cerr, "unlock repo")
+		}
+		return err
+	})
+}
+
+// ListKeySlots lists the key slots of the database at dbPath.
+func ListKeySlots(dbPath string) ([]KeySlotInfo, error) {
+	h, err := readKeySlots(dbPath)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]KeySlotInfo, len(h.Slots))
+	for i, s := range h.Slots {
+		infos[i] = KeySlotInfo{Name: s.Name, Passphrase: s.KDF != nil, CreatedAt: s.CreatedAt}
+	}
+	return infos, nil
+}
+
+// CheckKeySlot checks that secret unlocks the key slot named name.
+func CheckKeySlot(dbPath string, name string, secret []byte) error {
+	h, err := readKeySlots(dbPath)
+	if err != nil {
+		return err
+	}
+
+	i := h.find(name)
+	if i == -1 {
+		return ErrKeySlotNotFound
+	}
+
+	if _, err := h.Slots[i].unwrap(secret); err != nil {
+		return ErrNoMatchingKeySlot
+	}
+	return nil
+}
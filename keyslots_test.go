@@ -0,0 +1,79 @@
+package encrepo
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	config "github.com/ipfs/kubo/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeySlots(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "db.sqlite")
+	opts := SQLCipherDatastoreOptions{PlaintextHeader: true, JournalMode: "WAL"}
+	passphrase := []byte("correct horse battery staple")
+	deviceKey := testingKey(t)
+	recoveryCode := []byte("1234-5678-9012")
+
+	require.NoError(t, InitWithKeySlot(dbPath, "passphrase", passphrase, &testingKDFParams, opts, &config.Config{}))
+
+	t.Log("add a device key and a recovery code")
+	require.NoError(t, AddKeySlot(dbPath, passphrase, "device", deviceKey, nil))
+	require.NoError(t, AddKeySlot(dbPath, deviceKey, "recovery", recoveryCode, &testingKDFParams))
+	require.ErrorIs(t, AddKeySlot(dbPath, passphrase, "device", testingKey(t), nil), ErrKeySlotExists)
+	require.ErrorIs(t, AddKeySlot(dbPath, []byte("wrong"), "other", testingKey(t), nil), ErrNoMatchingKeySlot)
+
+	slots, err := ListKeySlots(dbPath)
+	require.NoError(t, err)
+	require.Len(t, slots, 3)
+	require.Equal(t, "passphrase", slots[0].Name)
+	require.True(t, slots[0].Passphrase)
+	require.Equal(t, "device", slots[1].Name)
+	require.False(t, slots[1].Passphrase)
+
+	require.NoError(t, CheckKeySlot(dbPath, "recovery", recoveryCode))
+	require.ErrorIs(t, CheckKeySlot(dbPath, "recovery", passphrase), ErrNoMatchingKeySlot)
+	require.ErrorIs(t, CheckKeySlot(dbPath, "unknown", passphrase), ErrKeySlotNotFound)
+
+	t.Log("open with each secret")
+	for _, secret := range [][]byte{passphrase, deviceKey, recoveryCode} {
+		r, err := OpenWithKeySlot(dbPath, secret, SQLCipherDatastoreOptions{JournalMode: "WAL"})
+		require.NoError(t, err)
+		require.NoError(t, r.Close())
+	}
+	_, err = OpenWithKeySlot(dbPath, []byte("wrong"), SQLCipherDatastoreOptions{})
+	require.ErrorIs(t, err, ErrNoMatchingKeySlot)
+
+	t.Log("the slots can't be changed while the repo is open")
+	r, err := OpenWithKeySlot(dbPath, passphrase, SQLCipherDatastoreOptions{JournalMode: "WAL"})
+	require.NoError(t, err)
+	require.ErrorIs(t, AddKeySlot(dbPath, passphrase, "other", testingKey(t), nil), ErrRepoOpen)
+	require.NoError(t, r.Close())
+	fileLock, err := lockRepoReader(context.Background(), dbPath, 0)
+	require.NoError(t, err)
+	require.ErrorIs(t, RemoveKeySlot(dbPath, passphrase, "recovery"), ErrRepoLocked)
+	require.NoError(t, fileLock.Close())
+
+	t.Log("remove the passphrase")
+	require.NoError(t, RemoveKeySlot(dbPath, deviceKey, "passphrase"))
+	_, err = OpenWithKeySlot(dbPath, passphrase, SQLCipherDatastoreOptions{})
+	require.ErrorIs(t, err, ErrNoMatchingKeySlot)
+	require.NoError(t, RemoveKeySlot(dbPath, deviceKey, "recovery"))
+	require.Error(t, RemoveKeySlot(dbPath, deviceKey, "device"))
+
+	t.Log("the slots would no longer open a rekeyed repo")
+	r, err = OpenWithKeySlot(dbPath, deviceKey, SQLCipherDatastoreOptions{JournalMode: "WAL"})
+	require.NoError(t, err)
+	require.ErrorIs(t, r.(Repo).Rekey(testingKey(t)), ErrKeyWrapped)
+	require.NoError(t, r.Close())
+	h, err := readKeySlots(dbPath)
+	require.NoError(t, err)
+	dek, err := h.unlock(deviceKey)
+	require.NoError(t, err)
+	require.ErrorIs(t, Rekey(dbPath, dek, testingKey(t), h.apply(opts)), ErrKeyWrapped)
+
+	r, err = OpenWithKeySlot(dbPath, deviceKey, SQLCipherDatastoreOptions{JournalMode: "WAL"})
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+}
@@ -2,32 +2,128 @@ package encrepo
 
 import (
 	"context"
+	"encoding/json"
+	"sync"
+	"time"
 
 	"github.com/ipfs/go-datastore"
 	"github.com/ipfs/go-datastore/query"
 	keystore "github.com/ipfs/go-ipfs-keystore"
 	ci "github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/pkg/errors"
 )
 
 type dsks struct {
 	ds datastore.Datastore
+	// meta stores the metadata of the keys, nil if not stored
+	meta datastore.Datastore
+
+	// mu serializes the writes, Get records the last use of the key
+	mu sync.Mutex
+}
+
+var _ InfoKeystore = (*dsks)(nil)
+
+// ContextKeystore is a keystore.Keystore with variants of its methods that
+// accept a context, it's implemented by the keystores returned by
+// KeystoreFromDatastore and encRepo.Keystore.
+type ContextKeystore interface {
+	keystore.Keystore
+
+	HasContext(ctx context.Context, id string) (bool, error)
+	PutContext(ctx context.Context, id string, val ci.PrivKey) error
+	GetContext(ctx context.Context, id string) (ci.PrivKey, error)
+	DeleteContext(ctx context.Context, id string) error
+	ListContext(ctx context.Context) ([]string, error)
+}
+
+// InfoKeystore is a ContextKeystore storing metadata alongside the keys,
+// it's implemented by the keystores returned by KeystoreFromDatastores and
+// encRepo.Keystore. The keys stored without metadata have a zero CreatedAt
+// and Origin.
+type InfoKeystore interface {
+	ContextKeystore
+
+	// PutWithInfo is like Put and stores the Comment and Origin of info,
+	// CreatedAt is the current time if zero.
+	PutWithInfo(ctx context.Context, id string, val ci.PrivKey, info KeyInfo) error
+	// GetInfo returns the metadata of a key, or ErrNoSuchKey.
+	GetInfo(ctx context.Context, id string) (*KeyInfo, error)
+	// ListInfo returns the metadata of all the keys.
+	ListInfo(ctx context.Context) ([]KeyInfo, error)
+}
+
+// KeyOrigin tells where a key comes from.
+type KeyOrigin string
+
+const (
+	// KeyOriginUnknown is the origin of the keys stored with Put.
+	KeyOriginUnknown   KeyOrigin = ""
+	KeyOriginGenerated KeyOrigin = "generated"
+	KeyOriginImported  KeyOrigin = "imported"
+)
+
+// KeyInfo is the metadata of a key.
+type KeyInfo struct {
+	Name string
+	// Type is the type of the key, e.g. "Ed25519"
+	Type      string
+	CreatedAt time.Time
+	// LastUsed is the last time the key was retrieved with Get, to the
+	// minute, zero if never
+	LastUsed time.Time
+	Comment  string
+	Origin   KeyOrigin
 }
 
-var _ keystore.Keystore = (*dsks)(nil)
+// lastUsedResolution is the resolution of KeyInfo.LastUsed, Get doesn't
+// write more often
+const lastUsedResolution = time.Minute
+
+// keyMeta is the metadata stored alongside a key, the key is stored as is
+// so that it's readable without it
+type keyMeta struct {
+	CreatedAt time.Time `json:"created_at,omitzero"`
+	LastUsed  time.Time `json:"last_used,omitzero"`
+	Comment   string    `json:"comment,omitempty"`
+	Origin    KeyOrigin `json:"origin,omitempty"`
+}
 
+// KeystoreFromDatastore returns a keystore storing the keys in ds, without
+// their metadata.
 func KeystoreFromDatastore(ds datastore.Datastore) keystore.Keystore {
-	return &dsks{ds}
+	return &dsks{ds: ds}
+}
+
+// KeystoreFromDatastores returns an InfoKeystore storing the keys in keys
+// and their metadata in meta.
+func KeystoreFromDatastores(keys, meta datastore.Datastore) keystore.Keystore {
+	return &dsks{ds: keys, meta: meta}
 }
 
 // Has returns whether or not a key exists in the Keystore
 func (ks *dsks) Has(id string) (bool, error) {
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	return ks.HasContext(context.Background(), id)
+}
+
+// HasContext is like Has with a context.
+func (ks *dsks) HasContext(ctx context.Context, id string) (bool, error) {
 	return ks.ds.Has(ctx, datastore.NewKey(id))
 }
 
 // Put stores a key in the Keystore, if a key with the same name already exists, returns ErrKeyExists
 func (ks *dsks) Put(id string, val ci.PrivKey) error {
+	return ks.PutContext(context.Background(), id, val)
+}
+
+// PutContext is like Put with a context.
+func (ks *dsks) PutContext(ctx context.Context, id string, val ci.PrivKey) error {
+	return ks.PutWithInfo(ctx, id, val, KeyInfo{})
+}
+
+// PutWithInfo is like Put and stores the Comment and Origin of info,
+// CreatedAt is the current time if zero.
+func (ks *dsks) PutWithInfo(ctx context.Context, id string, val ci.PrivKey, info KeyInfo) error {
 	valBytes, err := ci.MarshalPrivateKey(val)
 	if err != nil {
 		return err
@@ -35,8 +131,8 @@ func (ks *dsks) Put(id string, val ci.PrivKey) error {
 
 	key := datastore.NewKey(id)
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
 
 	has, err := ks.ds.Has(ctx, key)
 	if err != nil {
@@ -47,36 +143,189 @@ func (ks *dsks) Put(id string, val ci.PrivKey) error {
 		return keystore.ErrKeyExists
 	}
 
-	return ks.ds.Put(ctx, key, valBytes)
+	if err := ks.ds.Put(ctx, key, valBytes); err != nil {
+		return err
+	}
+
+	meta := &keyMeta{CreatedAt: info.CreatedAt, Comment: info.Comment, Origin: info.Origin}
+	if meta.CreatedAt.IsZero() {
+		meta.CreatedAt = time.Now().UTC()
+	}
+	if err := ks.putMeta(ctx, key, meta); err != nil {
+		_ = ks.ds.Delete(ctx, key)
+		return err
+	}
+	return nil
 }
 
 // Get retrieves a key from the Keystore if it exists, and returns ErrNoSuchKey
 // otherwise.
 func (ks *dsks) Get(id string) (ci.PrivKey, error) {
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	return ks.GetContext(context.Background(), id)
+}
+
+// GetContext is like Get with a context.
+func (ks *dsks) GetContext(ctx context.Context, id string) (ci.PrivKey, error) {
+	key := datastore.NewKey(id)
+	sk, err := ks.getKey(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	ks.recordUse(ctx, key)
+	return sk, nil
+}
+
+// recordUse updates the last use of a key, it's best effort: the keystore
+// of a read-only repo doesn't record the uses
+func (ks *dsks) recordUse(ctx context.Context, key datastore.Key) {
+	if ks.meta == nil {
+		return
+	}
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	// the key could have been deleted meanwhile
+	if has, err := ks.ds.Has(ctx, key); err != nil || !has {
+		return
+	}
+	meta, err := ks.getMeta(ctx, key)
+	if err != nil {
+		return
+	}
+	now := time.Now().UTC()
+	if now.Sub(meta.LastUsed) < lastUsedResolution {
+		return
+	}
+	meta.LastUsed = now.Truncate(lastUsedResolution)
+	_ = ks.putMeta(ctx, key, meta)
+}
+
+// GetInfo returns the metadata of a key, or ErrNoSuchKey.
+func (ks *dsks) GetInfo(ctx context.Context, id string) (*KeyInfo, error) {
+	key := datastore.NewKey(id)
+	sk, err := ks.getKey(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	meta, err := ks.getMeta(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return meta.info(key, sk), nil
+}
+
+// ListInfo returns the metadata of all the keys.
+func (ks *dsks) ListInfo(ctx context.Context) ([]KeyInfo, error) {
+	res, err := ks.ds.Query(ctx, query.Query{})
+	if err != nil {
+		return nil, err
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]KeyInfo, len(entries))
+	for i, e := range entries {
+		key := datastore.NewKey(e.Key)
+		sk, err := ci.UnmarshalPrivateKey(e.Value)
+		if err != nil {
+			return nil, errors.Wrap(err, "key "+key.Name())
+		}
+		meta, err := ks.getMeta(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		infos[i] = *meta.info(key, sk)
+	}
+	return infos, nil
+}
 
-	valBytes, err := ks.ds.Get(ctx, datastore.NewKey(id))
+func (ks *dsks) getKey(ctx context.Context, key datastore.Key) (ci.PrivKey, error) {
+	value, err := ks.ds.Get(ctx, key)
 	if err != nil {
 		if err == datastore.ErrNotFound {
 			return nil, keystore.ErrNoSuchKey
 		}
 		return nil, err
 	}
-	return ci.UnmarshalPrivateKey(valBytes)
+	return ci.UnmarshalPrivateKey(value)
+}
+
+// getMeta returns the metadata of a key, empty if it has none
+func (ks *dsks) getMeta(ctx context.Context, key datastore.Key) (*keyMeta, error) {
+	var meta keyMeta
+	if ks.meta == nil {
+		return &meta, nil
+	}
+	b, err := ks.meta.Get(ctx, key)
+	if err == datastore.ErrNotFound {
+		return &meta, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "get key metadata")
+	}
+	if err := json.Unmarshal(b, &meta); err != nil {
+		return nil, errors.Wrap(err, "unmarshal key metadata")
+	}
+	return &meta, nil
+}
+
+func (ks *dsks) putMeta(ctx context.Context, key datastore.Key, meta *keyMeta) error {
+	if ks.meta == nil {
+		return nil
+	}
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return errors.Wrap(err, "marshal key metadata")
+	}
+	if err := ks.meta.Put(ctx, key, b); err != nil {
+		return errors.Wrap(err, "put key metadata")
+	}
+	return nil
+}
+
+func (meta *keyMeta) info(key datastore.Key, sk ci.PrivKey) *KeyInfo {
+	return &KeyInfo{
+		Name:      key.Name(),
+		Type:      sk.Type().String(),
+		CreatedAt: meta.CreatedAt,
+		LastUsed:  meta.LastUsed,
+		Comment:   meta.Comment,
+		Origin:    meta.Origin,
+	}
 }
 
 // Delete removes a key from the Keystore
 func (ks *dsks) Delete(id string) error {
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-	return ks.ds.Delete(ctx, datastore.NewKey(id))
+	return ks.DeleteContext(context.Background(), id)
+}
+
+// DeleteContext is like Delete with a context.
+func (ks *dsks) DeleteContext(ctx context.Context, id string) error {
+	key := datastore.NewKey(id)
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if err := ks.ds.Delete(ctx, key); err != nil {
+		return err
+	}
+	if ks.meta != nil {
+		if err := ks.meta.Delete(ctx, key); err != nil {
+			return errors.Wrap(err, "delete key metadata")
+		}
+	}
+	return nil
 }
 
 // List returns a list of key identifier
 func (ks *dsks) List() ([]string, error) {
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	return ks.ListContext(context.Background())
+}
+
+// ListContext is like List with a context.
+func (ks *dsks) ListContext(ctx context.Context) ([]string, error) {
 	res, err := ks.ds.Query(ctx, query.Query{KeysOnly: true})
 	if err != nil {
 		return nil, err
@@ -7,8 +7,11 @@ import (
 	"path/filepath"
 	"sort"
 	"testing"
+	"time"
 
 	"github.com/ipfs/go-datastore"
+	keystore "github.com/ipfs/go-ipfs-keystore"
+	config "github.com/ipfs/kubo/config"
 	ci "github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/stretchr/testify/require"
 )
@@ -65,3 +68,101 @@ func TestKeystoreFromSQLiteDatastore(t *testing.T) {
 		require.Equal(t, val, v)
 	}
 }
+
+func TestKeystoreInfo(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds, err := NewSQLiteDatastore("sqlite3", filepath.Join(t.TempDir(), "db.sqlite"), "keys")
+	require.NoError(t, err)
+	defer requireClose(t, ds)
+	keys := NewNamespacedDatastore(ds, datastore.NewKey("keys"))
+	meta := NewNamespacedDatastore(ds, datastore.NewKey("keys-meta"))
+	ks := KeystoreFromDatastores(keys, meta).(InfoKeystore)
+
+	sk, _, err := ci.GenerateEd25519Key(secrand.Reader)
+	require.NoError(t, err)
+	createdAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	require.NoError(t, ks.PutWithInfo(ctx, "a", sk, KeyInfo{CreatedAt: createdAt, Comment: "node key", Origin: KeyOriginGenerated}))
+	require.ErrorIs(t, ks.PutWithInfo(ctx, "a", sk, KeyInfo{}), keystore.ErrKeyExists)
+	info, err := ks.GetInfo(ctx, "a")
+	require.NoError(t, err)
+	require.Equal(t, &KeyInfo{Name: "a", Type: "Ed25519", CreatedAt: createdAt, Comment: "node key", Origin: KeyOriginGenerated}, info)
+
+	t.Log("the key is stored as is")
+	raw, err := keys.Get(ctx, datastore.NewKey("a"))
+	require.NoError(t, err)
+	skBytes, err := ci.MarshalPrivateKey(sk)
+	require.NoError(t, err)
+	require.Equal(t, skBytes, raw)
+
+	t.Log("Get records the last use")
+	before := time.Now()
+	got, err := ks.Get("a")
+	require.NoError(t, err)
+	require.True(t, sk.Equals(got))
+	info, err = ks.GetInfo(ctx, "a")
+	require.NoError(t, err)
+	require.WithinDuration(t, before, info.LastUsed, time.Minute)
+	require.Equal(t, createdAt, info.CreatedAt)
+
+	t.Log("Put records the creation")
+	require.NoError(t, ks.Put("b", sk))
+	info, err = ks.GetInfo(ctx, "b")
+	require.NoError(t, err)
+	require.WithinDuration(t, before, info.CreatedAt, time.Minute)
+	require.Equal(t, KeyOriginUnknown, info.Origin)
+	require.True(t, info.LastUsed.IsZero())
+
+	t.Log("the keys stored without metadata are readable")
+	require.NoError(t, keys.Put(ctx, datastore.NewKey("c"), skBytes))
+	info, err = ks.GetInfo(ctx, "c")
+	require.NoError(t, err)
+	require.Equal(t, &KeyInfo{Name: "c", Type: "Ed25519"}, info)
+	got, err = ks.Get("c")
+	require.NoError(t, err)
+	require.True(t, sk.Equals(got))
+	info, err = ks.GetInfo(ctx, "c")
+	require.NoError(t, err)
+	require.False(t, info.LastUsed.IsZero())
+
+	infos, err := ks.ListInfo(ctx)
+	require.NoError(t, err)
+	names := make([]string, len(infos))
+	for i, info := range infos {
+		names[i] = info.Name
+	}
+	sort.Strings(names)
+	require.Equal(t, []string{"a", "b", "c"}, names)
+
+	require.NoError(t, ks.Delete("a"))
+	_, err = ks.GetInfo(ctx, "a")
+	require.ErrorIs(t, err, keystore.ErrNoSuchKey)
+	has, err := meta.Has(ctx, datastore.NewKey("a"))
+	require.NoError(t, err)
+	require.False(t, has)
+}
+
+func TestKeystoreInfoReadOnly(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "db.sqlite")
+	key := testingKey(t)
+	require.NoError(t, Init(dbPath, key, SQLCipherDatastoreOptions{}, &config.Config{Datastore: testingDatastoreConfig()}))
+
+	sk, _, err := ci.GenerateEd25519Key(secrand.Reader)
+	require.NoError(t, err)
+	r, err := Open(dbPath, key, SQLCipherDatastoreOptions{})
+	require.NoError(t, err)
+	require.NoError(t, r.Keystore().Put("a", sk))
+	require.NoError(t, r.Close())
+
+	t.Log("a read-only repo doesn't record the uses")
+	r, err = Open(dbPath, key, SQLCipherDatastoreOptions{ReadOnly: true})
+	require.NoError(t, err)
+	defer requireClose(t, r)
+	got, err := r.Keystore().Get("a")
+	require.NoError(t, err)
+	require.True(t, sk.Equals(got))
+	info, err := r.Keystore().(InfoKeystore).GetInfo(context.Background(), "a")
+	require.NoError(t, err)
+	require.True(t, info.LastUsed.IsZero())
+}
@@ -1,7 +1,62 @@
 package encrepo
 
-import "sync"
-
-var (
-	packageLock sync.Mutex
+import (
+	"path/filepath"
+	"sync"
 )
+
+// dbLocks serializes the operations on a database path: init, open, close
+// and the operations that require the repo to be closed. The operations on
+// an open repo are serialized by the encRepo mutex.
+var dbLocks pathLocker
+
+// pathLocker is a set of mutexes keyed by path, the mutexes are released
+// once unused.
+type pathLocker struct {
+	mu    sync.Mutex
+	locks map[string]*pathLock
+}
+
+type pathLock struct {
+	sync.Mutex
+	waiters int
+}
+
+// lock locks path and returns the function that unlocks it.
+func (l *pathLocker) lock(path string) (unlock func()) {
+	path = lockPath(path)
+
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*pathLock)
+	}
+	pl, ok := l.locks[path]
+	if !ok {
+		pl = &pathLock{}
+		l.locks[path] = pl
+	}
+	pl.waiters++
+	l.mu.Unlock()
+
+	pl.Lock()
+
+	return func() {
+		pl.Unlock()
+
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		pl.waiters--
+		if pl.waiters == 0 {
+			delete(l.locks, path)
+		}
+	}
+}
+
+// lockPath returns the key of path, the different spellings of a path
+// share the same lock
+func lockPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return filepath.Clean(path)
+}
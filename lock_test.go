@@ -0,0 +1,200 @@
+package encrepo
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	config "github.com/ipfs/kubo/config"
+	"github.com/stretchr/testify/require"
+)
+
+// requireDone fails if fn doesn't return within a few seconds
+func requireDone(t *testing.T, msg string, fn func()) {
+	t.Helper()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fn()
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("blocked: %s", msg)
+	}
+}
+
+func TestLocksIndependentRepos(t *testing.T) {
+	key := testingKey(t)
+	opts := SQLCipherDatastoreOptions{JournalMode: "WAL"}
+	dir := t.TempDir()
+	pathA := filepath.Join(dir, "a.sqlite")
+	pathB := filepath.Join(dir, "b.sqlite")
+	pathC := filepath.Join(dir, "c.sqlite")
+	conf := &config.Config{Identity: config.Identity{PeerID: "foo", PrivKey: "bar"}}
+
+	require.NoError(t, Init(pathA, key, opts, conf))
+	require.NoError(t, Init(pathB, key, opts, conf))
+
+	a, err := Open(pathA, key, opts)
+	require.NoError(t, err)
+	defer requireClose(t, a)
+	b, err := Open(pathB, key, opts)
+	require.NoError(t, err)
+	defer requireClose(t, b)
+
+	t.Log("config access to b while a is locked")
+	a.(*encRepo).mu.Lock()
+	requireDone(t, "config of b", func() {
+		_, err := b.Config()
+		require.NoError(t, err)
+		require.NoError(t, b.SetConfigKey("Identity.PeerID", "bar"))
+		val, err := b.GetConfigKey("Identity.PeerID")
+		require.NoError(t, err)
+		require.Equal(t, "bar", val)
+	})
+	a.(*encRepo).mu.Unlock()
+
+	t.Log("init and open of c while the path of a is locked")
+	unlock := dbLocks.lock(pathA)
+	requireDone(t, "init and open of c", func() {
+		require.NoError(t, Init(pathC, key, opts, conf))
+		c, err := Open(pathC, key, opts)
+		require.NoError(t, err)
+		_, err = c.Config()
+		require.NoError(t, err)
+		require.NoError(t, c.Close())
+	})
+
+	t.Log("open of a waits for the lock of its path")
+	opened := make(chan error, 1)
+	go func() {
+		r, err := Open(filepath.Join(dir, ".", "a.sqlite"), key, opts)
+		if err == nil {
+			err = r.Close()
+		}
+		opened <- err
+	}()
+	select {
+	case err := <-opened:
+		t.Fatalf("open returned while the path is locked: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	unlock()
+	requireDone(t, "open of a", func() {
+		require.NoError(t, <-opened)
+	})
+}
+
+func TestLocksConcurrentRepos(t *testing.T) {
+	key := testingKey(t)
+	opts := SQLCipherDatastoreOptions{JournalMode: "WAL"}
+	dir := t.TempDir()
+	conf := &config.Config{Identity: config.Identity{PeerID: "foo", PrivKey: "bar"}}
+
+	const (
+		numRepos   = 4
+		numWorkers = 3
+		numOps     = 10
+	)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, numRepos*(numWorkers+1))
+	for i := 0; i < numRepos; i++ {
+		dbPath := filepath.Join(dir, fmt.Sprintf("%d.sqlite", i))
+
+		// concurrent inits of the same repo
+		for j := 0; j < 2; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := Init(dbPath, key, opts, conf); err != nil {
+					errs <- err
+				}
+			}()
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	t.Log("config reads and writes on open repos with open/close cycles")
+	errs = make(chan error, numRepos*(numWorkers+1))
+	for i := 0; i < numRepos; i++ {
+		dbPath := filepath.Join(dir, fmt.Sprintf("%d.sqlite", i))
+		r, err := Open(dbPath, key, opts)
+		require.NoError(t, err)
+		defer requireClose(t, r)
+
+		for j := 0; j < numWorkers; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for k := 0; k < numOps; k++ {
+					peerID := fmt.Sprintf("peer-%d-%d", j, k)
+					if err := r.SetConfigKey("Identity.PeerID", peerID); err != nil {
+						errs <- err
+						return
+					}
+					if _, err := r.GetConfigKey("Identity.PeerID"); err != nil {
+						errs <- err
+						return
+					}
+					if _, err := r.Config(); err != nil {
+						errs <- err
+						return
+					}
+				}
+			}()
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := 0; k < numOps; k++ {
+				other, err := Open(dbPath, key, opts)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if _, err := other.Config(); err != nil {
+					errs <- err
+					return
+				}
+				if err := other.Close(); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+}
+
+func TestLocksPathSpellings(t *testing.T) {
+	key := testingKey(t)
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "db.sqlite")
+	require.NoError(t, Init(dbPath, key, SQLCipherDatastoreOptions{}, &config.Config{}))
+	t.Chdir(dir)
+
+	t.Log("the spellings of a path open the same repo")
+	r, err := Open(dbPath, key, SQLCipherDatastoreOptions{})
+	require.NoError(t, err)
+	defer requireClose(t, r)
+	other, err := Open("./db.sqlite", key, SQLCipherDatastoreOptions{})
+	require.NoError(t, err)
+	require.Same(t, r, other)
+	requireClose(t, other)
+
+	require.ErrorIs(t, Destroy("db.sqlite", DestroyOptions{}), ErrRepoOpen)
+}
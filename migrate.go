@@ -0,0 +1,675 @@
+package encrepo
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/cockroachdb/pebble/v2"
+	"github.com/ipfs/boxo/keystore"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	leveldb "github.com/ipfs/go-ds-leveldb"
+	ipfs "github.com/ipfs/kubo"
+	config "github.com/ipfs/kubo/config"
+	serialize "github.com/ipfs/kubo/config/serialize"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/pkg/errors"
+)
+
+// The files of a kubo fsrepo, see github.com/ipfs/kubo/repo/fsrepo.
+const (
+	fsrepoLockFile     = "repo.lock"
+	fsrepoVersionFile  = "version"
+	fsrepoConfigFile   = "config"
+	fsrepoKeystoreDir  = "keystore"
+	fsrepoSwarmKeyFile = "swarm.key"
+	fsrepoAPIFile      = "api"
+	fsrepoGatewayFile  = "gateway"
+)
+
+// migrateBatchSize is the number of datastore entries put at once by
+// MigrateFromFSRepo
+const migrateBatchSize = 1024
+
+// MigrateOptions are the options of MigrateFromFSRepo.
+type MigrateOptions struct {
+	// DatastoreSpec replaces the Config.Datastore.Spec of the fsrepo, nil is
+	// DefaultDatastoreSpec.
+	DatastoreSpec map[string]interface{}
+	// Shred overwrites the files of the fsrepo with random data and removes
+	// them once the migration is verified. The data may survive on
+	// copy-on-write filesystems and flash storage.
+	Shred bool
+}
+
+// MigrateReport is the result of MigrateFromFSRepo.
+type MigrateReport struct {
+	// Entries is the number of datastore entries migrated, by mountpoint of
+	// the fsrepo datastore
+	Entries map[string]int
+	// Keys is the number of keystore keys migrated
+	Keys int
+}
+
+// MigrateFromFSRepo creates an encrypted repo at dbPath from the kubo fsrepo
+// at fsrepoPath: its config and identity, keystore, datastore, swarm.key and
+// API and gateway addresses. The fsrepo must be at the repo version of the
+// kubo dependency, and is locked during the migration so a daemon can't use
+// it. Its datastores can be flatfs, levelds and pebbleds.
+//
+// The entries of the new repo are verified against the fsrepo, on failure
+// the new repo is removed. The fsrepo is left untouched unless opts.Shred is
+// set.
+func MigrateFromFSRepo(fsrepoPath, dbPath string, key []byte, opts SQLCipherDatastoreOptions, mopts MigrateOptions) (*MigrateReport, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	lock, err := lockFSRepo(fsrepoPath)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if lock != nil {
+			_ = unlockFSRepo(lock)
+		}
+	}()
+
+	conf, err := readFSRepoConfig(fsrepoPath)
+	if err != nil {
+		return nil, err
+	}
+	mounts, err := fsrepoMounts(fsrepoPath, conf.Datastore.Spec, ds.NewKey("/"))
+	if err != nil {
+		return nil, errors.Wrap(err, "parse fsrepo Datastore.Spec")
+	}
+
+	if _, err := os.Stat(dbPath); err == nil {
+		return nil, fmt.Errorf("%s already exists", dbPath)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	migrated := *conf
+	migrated.Datastore.Spec = mopts.DatastoreSpec
+	if len(migrated.Datastore.Spec) == 0 {
+		migrated.Datastore.Spec = DefaultDatastoreSpec()
+	}
+	dsc, err := parseDatastoreSpec(migrated.Datastore.Spec)
+	if err != nil {
+		return nil, err
+	}
+
+	report, err := migrateFSRepo(ctx, fsrepoPath, mounts, dbPath, key, opts, &migrated)
+	if err != nil {
+		// rollback, the fsrepo was not modified
+		_ = removeDBFiles(dbPath)
+		for _, f := range dsc.dbFiles(dbPath, opts) {
+			_ = removeDBFiles(f.path)
+		}
+		_ = os.Remove(LockPath(dbPath))
+		return nil, err
+	}
+
+	if mopts.Shred {
+		if err := shredFSRepo(fsrepoPath, mounts); err != nil {
+			return report, errors.Wrap(err, "shred fsrepo")
+		}
+		err := unlockFSRepo(lock)
+		lock = nil
+		if err != nil {
+			return report, errors.Wrap(err, "unlock fsrepo")
+		}
+		if err := removeFSRepo(fsrepoPath, mounts); err != nil {
+			return report, errors.Wrap(err, "remove fsrepo")
+		}
+	}
+
+	return report, nil
+}
+
+// readFSRepoConfig checks the version of the fsrepo and reads its config
+func readFSRepoConfig(fsrepoPath string) (*config.Config, error) {
+	b, err := os.ReadFile(filepath.Join(fsrepoPath, fsrepoVersionFile))
+	if err != nil {
+		return nil, errors.Wrap(err, "read fsrepo version")
+	}
+	version, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return nil, errors.Wrap(err, "parse fsrepo version")
+	}
+	if version != ipfs.RepoVersion {
+		return nil, fmt.Errorf("fsrepo version is %d, expected %d, run 'ipfs repo migrate'", version, ipfs.RepoVersion)
+	}
+
+	conf, err := serialize.Load(filepath.Join(fsrepoPath, fsrepoConfigFile))
+	if err != nil {
+		return nil, errors.Wrap(err, "read fsrepo config")
+	}
+
+	sk, err := conf.Identity.DecodePrivateKey("")
+	if err != nil {
+		return nil, errors.Wrap(err, "decode fsrepo identity")
+	}
+	id, err := peer.IDFromPrivateKey(sk)
+	if err != nil {
+		return nil, errors.Wrap(err, "decode fsrepo identity")
+	}
+	if id.String() != conf.Identity.PeerID {
+		return nil, fmt.Errorf("fsrepo identity mismatch, private key of %s and peer ID %s", id, conf.Identity.PeerID)
+	}
+
+	return conf, nil
+}
+
+// migrateFSRepo copies the fsrepo to a new repo at dbPath and verifies it
+func migrateFSRepo(ctx context.Context, fsrepoPath string, mounts []fsrepoMount, dbPath string, key []byte, opts SQLCipherDatastoreOptions, conf *config.Config) (*MigrateReport, error) {
+	if err := InitContext(ctx, dbPath, key, opts, conf); err != nil {
+		return nil, errors.Wrap(err, "init repo")
+	}
+
+	rr, err := OpenContext(ctx, dbPath, key, opts)
+	if err != nil {
+		return nil, errors.Wrap(err, "open repo")
+	}
+	r := rr.(*encRepo)
+
+	report, err := migrateFSRepoData(ctx, fsrepoPath, mounts, r)
+	if cerr := r.Close(); err == nil && cerr != nil {
+		err = errors.Wrap(cerr, "close repo")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+func migrateFSRepoData(ctx context.Context, fsrepoPath string, mounts []fsrepoMount, r *encRepo) (*MigrateReport, error) {
+	report := &MigrateReport{Entries: make(map[string]int, len(mounts))}
+
+	for _, m := range mounts {
+		src, err := m.open()
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("open fsrepo datastore %s", m.prefix))
+		}
+		copied, err := migrateEntries(ctx, r.Datastore(), m, mounts, src)
+		if err == nil {
+			var verified int
+			verified, err = verifyEntries(ctx, r.Datastore(), m, mounts, src)
+			if err == nil && verified != copied {
+				err = fmt.Errorf("migrated %d entries of %s, verified %d", copied, m.prefix, verified)
+			}
+		}
+		if cerr := src.Close(); err == nil && cerr != nil {
+			err = errors.Wrap(cerr, fmt.Sprintf("close fsrepo datastore %s", m.prefix))
+		}
+		if err != nil {
+			return nil, err
+		}
+		report.Entries[m.prefix.String()] = copied
+	}
+
+	keys, err := migrateKeystore(ctx, filepath.Join(fsrepoPath, fsrepoKeystoreDir), r)
+	if err != nil {
+		return nil, err
+	}
+	report.Keys = keys
+
+	swarmKey, err := os.ReadFile(filepath.Join(fsrepoPath, fsrepoSwarmKeyFile))
+	switch {
+	case err == nil:
+		if err := r.root.Put(ctx, ds.NewKey("swarm.key"), swarmKey); err != nil {
+			return nil, errors.Wrap(err, "put swarm.key")
+		}
+	case !os.IsNotExist(err):
+		return nil, errors.Wrap(err, "read swarm.key")
+	}
+
+	if err := migrateAddrs(ctx, fsrepoPath, r); err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+// migrateEntries copies the entries of the fsrepo datastore mounted at m
+func migrateEntries(ctx context.Context, dst ds.Batching, m fsrepoMount, mounts []fsrepoMount, src fsrepoDatastore) (int, error) {
+	batch, err := dst.Batch(ctx)
+	if err != nil {
+		return 0, err
+	}
+	count, pending := 0, 0
+	err = src.each(ctx, false, func(k ds.Key, value []byte, _ int) error {
+		k, ok := m.key(k, mounts)
+		if !ok {
+			return nil
+		}
+		if err := batch.Put(ctx, k, value); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("put %s", k))
+		}
+		count++
+		pending++
+		if pending == migrateBatchSize {
+			if err := batch.Commit(ctx); err != nil {
+				return errors.Wrap(err, "commit batch")
+			}
+			if batch, err = dst.Batch(ctx); err != nil {
+				return err
+			}
+			pending = 0
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err := batch.Commit(ctx); err != nil {
+		return 0, errors.Wrap(err, "commit batch")
+	}
+	return count, nil
+}
+
+// verifyEntries checks that the entries of the fsrepo datastore mounted at
+// m are in dst with the same size
+func verifyEntries(ctx context.Context, dst ds.Datastore, m fsrepoMount, mounts []fsrepoMount, src fsrepoDatastore) (int, error) {
+	count := 0
+	err := src.each(ctx, true, func(k ds.Key, _ []byte, size int) error {
+		k, ok := m.key(k, mounts)
+		if !ok {
+			return nil
+		}
+		dstSize, err := dst.GetSize(ctx, k)
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("verify %s", k))
+		}
+		if dstSize != size {
+			return fmt.Errorf("migrated %s has %d bytes, expected %d", k, dstSize, size)
+		}
+		count++
+		return nil
+	})
+	return count, err
+}
+
+// migrateKeystore copies the keys of the keystore of the fsrepo at dir
+func migrateKeystore(ctx context.Context, dir string, r *encRepo) (int, error) {
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return 0, nil
+	}
+	// NewFSKeystore only creates the directory if it's missing
+	src, err := keystore.NewFSKeystore(dir)
+	if err != nil {
+		return 0, errors.Wrap(err, "open fsrepo keystore")
+	}
+	names, err := src.List()
+	if err != nil {
+		return 0, errors.Wrap(err, "list fsrepo keys")
+	}
+
+	dst := r.Keystore().(InfoKeystore)
+	for _, name := range names {
+		k, err := src.Get(name)
+		if err != nil {
+			return 0, errors.Wrap(err, fmt.Sprintf("get fsrepo key %s", name))
+		}
+		if err := dst.PutWithInfo(ctx, name, k, KeyInfo{Origin: KeyOriginImported}); err != nil {
+			return 0, errors.Wrap(err, fmt.Sprintf("put key %s", name))
+		}
+	}
+
+	migrated, err := dst.ListContext(ctx)
+	if err != nil {
+		return 0, errors.Wrap(err, "list keys")
+	}
+	if len(migrated) != len(names) {
+		return 0, fmt.Errorf("migrated %d keys, expected %d", len(migrated), len(names))
+	}
+	return len(names), nil
+}
+
+// migrateAddrs copies the API and gateway addresses written by the daemon
+func migrateAddrs(ctx context.Context, fsrepoPath string, r *encRepo) error {
+	b, err := os.ReadFile(filepath.Join(fsrepoPath, fsrepoAPIFile))
+	switch {
+	case err == nil:
+		addr, err := ma.NewMultiaddr(strings.TrimSpace(string(b)))
+		if err != nil {
+			return errors.Wrap(err, "parse fsrepo api file")
+		}
+		if err := r.SetAPIAddrContext(ctx, addr); err != nil {
+			return err
+		}
+	case !os.IsNotExist(err):
+		return errors.Wrap(err, "read fsrepo api file")
+	}
+
+	b, err = os.ReadFile(filepath.Join(fsrepoPath, fsrepoGatewayFile))
+	switch {
+	case err == nil:
+		// the gateway file has the URL of the gateway
+		u, err := url.Parse(strings.TrimSpace(string(b)))
+		if err != nil {
+			return errors.Wrap(err, "parse fsrepo gateway file")
+		}
+		addr, err := net.ResolveTCPAddr("tcp", u.Host)
+		if err != nil {
+			return errors.Wrap(err, "parse fsrepo gateway file")
+		}
+		if err := r.SetGatewayAddrContext(ctx, addr); err != nil {
+			return err
+		}
+	case !os.IsNotExist(err):
+		return errors.Wrap(err, "read fsrepo gateway file")
+	}
+
+	return nil
+}
+
+// fsrepoMount is a datastore of the spec of a fsrepo
+type fsrepoMount struct {
+	prefix ds.Key
+	typ    string
+	path   string
+	// params is the spec of the datastore
+	params map[string]interface{}
+}
+
+// fsrepoMounts returns the datastores of a fsrepo spec, the paths are made
+// absolute
+func fsrepoMounts(fsrepoPath string, spec map[string]interface{}, prefix ds.Key) ([]fsrepoMount, error) {
+	which, ok := spec["type"].(string)
+	if !ok {
+		return nil, fmt.Errorf("'type' field missing or not a string")
+	}
+
+	switch which {
+	case "mount":
+		mounts, ok := spec["mounts"].([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("'mounts' field is missing or not an array")
+		}
+		var res []fsrepoMount
+		for _, iface := range mounts {
+			cfg, ok := iface.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("expected map for mountpoint")
+			}
+			mountpoint, ok := cfg["mountpoint"].(string)
+			if !ok {
+				return nil, fmt.Errorf("'mountpoint' field is missing or not a string")
+			}
+			children, err := fsrepoMounts(fsrepoPath, cfg, prefix.Child(ds.NewKey(mountpoint)))
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, children...)
+		}
+		return res, nil
+
+	case "measure", "log":
+		child, ok := spec["child"].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("'child' field is missing or not a map")
+		}
+		return fsrepoMounts(fsrepoPath, child, prefix)
+
+	case "flatfs", "levelds", "pebbleds":
+		path, ok := spec["path"].(string)
+		if !ok {
+			return nil, fmt.Errorf("'path' field is missing or not a string")
+		}
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(fsrepoPath, path)
+		}
+		return []fsrepoMount{{prefix: prefix, typ: which, path: path, params: spec}}, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported fsrepo datastore type: %s", which)
+	}
+}
+
+// key returns the key of an entry of m in the repo, false if the entry is
+// shadowed by another mount as in the fsrepo
+func (m fsrepoMount) key(k ds.Key, mounts []fsrepoMount) (ds.Key, bool) {
+	k = m.prefix.Child(k)
+	for _, other := range mounts {
+		if m.prefix.IsAncestorOf(other.prefix) && (other.prefix.Equal(k) || other.prefix.IsAncestorOf(k)) {
+			return k, false
+		}
+	}
+	return k, true
+}
+
+func (m fsrepoMount) open() (fsrepoDatastore, error) {
+	switch m.typ {
+	case "flatfs":
+		if _, err := os.Stat(m.path); err != nil {
+			return nil, err
+		}
+		return flatfsDatastore(m.path), nil
+	case "levelds":
+		d, err := leveldb.NewDatastore(m.path, &leveldb.Options{ReadOnly: true, ErrorIfMissing: true})
+		if err != nil {
+			return nil, err
+		}
+		return &leveldbDatastore{d}, nil
+	case "pebbleds":
+		db, err := pebble.Open(m.path, &pebble.Options{ReadOnly: true, ErrorIfNotExists: true, Logger: pebbleLogger{}})
+		if err != nil {
+			return nil, err
+		}
+		return &pebbleDatastore{db}, nil
+	default:
+		return nil, fmt.Errorf("unsupported fsrepo datastore type: %s", m.typ)
+	}
+}
+
+// fsrepoDatastore reads a datastore of a fsrepo
+type fsrepoDatastore interface {
+	// each calls fn with each entry, the value is nil if keysOnly
+	each(ctx context.Context, keysOnly bool, fn func(k ds.Key, value []byte, size int) error) error
+	Close() error
+}
+
+// flatfsDatastore reads a go-ds-flatfs directory, its entries are the .data
+// files of the shard directories named by key
+type flatfsDatastore string
+
+func (d flatfsDatastore) each(ctx context.Context, keysOnly bool, fn func(k ds.Key, value []byte, size int) error) error {
+	shards, err := os.ReadDir(string(d))
+	if err != nil {
+		return err
+	}
+	for _, shard := range shards {
+		// the hidden directories hold the temporary files
+		if !shard.IsDir() || strings.HasPrefix(shard.Name(), ".") {
+			continue
+		}
+		dir := filepath.Join(string(d), shard.Name())
+		files, err := os.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			name, ok := strings.CutSuffix(file.Name(), ".data")
+			if !ok || !file.Type().IsRegular() {
+				continue
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			path := filepath.Join(dir, file.Name())
+			var value []byte
+			var size int
+			if keysOnly {
+				fi, err := file.Info()
+				if err != nil {
+					return err
+				}
+				size = int(fi.Size())
+			} else {
+				if value, err = os.ReadFile(path); err != nil {
+					return err
+				}
+				size = len(value)
+			}
+			if err := fn(ds.NewKey(name), value, size); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (d flatfsDatastore) Close() error { return nil }
+
+type leveldbDatastore struct {
+	*leveldb.Datastore
+}
+
+func (d *leveldbDatastore) each(ctx context.Context, keysOnly bool, fn func(k ds.Key, value []byte, size int) error) error {
+	res, err := d.Query(ctx, query.Query{KeysOnly: keysOnly, ReturnsSizes: true})
+	if err != nil {
+		return err
+	}
+	defer res.Close()
+	for e := range res.Next() {
+		if e.Error != nil {
+			return e.Error
+		}
+		if err := fn(ds.NewKey(e.Key), e.Value, e.Size); err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
+
+// pebbleDatastore reads a go-ds-pebble database, its keys are the datastore
+// keys
+type pebbleDatastore struct {
+	db *pebble.DB
+}
+
+func (d *pebbleDatastore) each(ctx context.Context, keysOnly bool, fn func(k ds.Key, value []byte, size int) error) error {
+	it, err := d.db.NewIterWithContext(ctx, nil)
+	if err != nil {
+		return err
+	}
+	for valid := it.First(); valid; valid = it.Next() {
+		if err := ctx.Err(); err != nil {
+			_ = it.Close()
+			return err
+		}
+		v := it.Value()
+		var value []byte
+		if !keysOnly {
+			value = bytes.Clone(v)
+		}
+		if err := fn(ds.NewKey(string(it.Key())), value, len(v)); err != nil {
+			_ = it.Close()
+			return err
+		}
+	}
+	return it.Close()
+}
+
+func (d *pebbleDatastore) Close() error { return d.db.Close() }
+
+// pebbleLogger drops the info messages of pebble, e.g. on each WAL replay
+type pebbleLogger struct{}
+
+func (pebbleLogger) Infof(string, ...interface{}) {}
+
+func (pebbleLogger) Errorf(format string, args ...interface{}) {
+	pebble.DefaultLogger.Errorf(format, args...)
+}
+
+func (pebbleLogger) Fatalf(format string, args ...interface{}) {
+	pebble.DefaultLogger.Fatalf(format, args...)
+}
+
+// lockFSRepo takes the lock kubo takes on a fsrepo
+func lockFSRepo(fsrepoPath string) (*os.File, error) {
+	if _, err := os.Stat(filepath.Join(fsrepoPath, fsrepoConfigFile)); err != nil {
+		return nil, errors.Wrap(err, "not a fsrepo")
+	}
+	f, err := os.OpenFile(filepath.Join(fsrepoPath, fsrepoLockFile), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, errors.Wrap(err, "open fsrepo lock file")
+	}
+	if err := lockFSRepoFile(f); err != nil {
+		_ = f.Close()
+		if err == errLockHeld {
+			return nil, &RepoLockedError{Path: fsrepoPath}
+		}
+		return nil, errors.Wrap(err, "lock fsrepo")
+	}
+	return f, nil
+}
+
+func unlockFSRepo(f *os.File) error {
+	err := unlockFSRepoFile(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// fsrepoPaths returns the fsrepo directory and the datastores outside of it
+func fsrepoPaths(fsrepoPath string, mounts []fsrepoMount) []string {
+	paths := []string{fsrepoPath}
+	for _, m := range mounts {
+		rel, err := filepath.Rel(fsrepoPath, m.path)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			paths = append(paths, m.path)
+		}
+	}
+	return paths
+}
+
+// shredFSRepo overwrites the files of the fsrepo with random data, but the
+// lock file
+func shredFSRepo(fsrepoPath string, mounts []fsrepoMount) error {
+	lockPath := filepath.Join(fsrepoPath, fsrepoLockFile)
+	for _, root := range fsrepoPaths(fsrepoPath, mounts) {
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.Type().IsRegular() || path == lockPath {
+				return nil
+			}
+			return shredFile(path)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func shredFile(path string) error {
+	// the keystore files are read-only
+	if err := os.Chmod(path, 0o600); err != nil {
+		return err
+	}
+	return overwriteFile(path, -1)
+}
+
+func removeFSRepo(fsrepoPath string, mounts []fsrepoMount) error {
+	for _, path := range fsrepoPaths(fsrepoPath, mounts) {
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
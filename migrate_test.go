@@ -0,0 +1,159 @@
+package encrepo
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cockroachdb/pebble/v2"
+	"github.com/ipfs/boxo/datastore/dshelp"
+	"github.com/ipfs/boxo/keystore"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-datastore"
+	leveldb "github.com/ipfs/go-ds-leveldb"
+	ipfs "github.com/ipfs/kubo"
+	config "github.com/ipfs/kubo/config"
+	serialize "github.com/ipfs/kubo/config/serialize"
+	"github.com/ipfs/kubo/core/coreiface/options"
+	ci "github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/stretchr/testify/require"
+)
+
+// testingFSRepo writes the files of a kubo fsrepo with the given spec
+func testingFSRepo(t *testing.T, spec map[string]interface{}) (string, *config.Config) {
+	t.Helper()
+	dir := filepath.Join(t.TempDir(), ".ipfs")
+	require.NoError(t, os.Mkdir(dir, 0o700))
+
+	identity, err := config.CreateIdentity(io.Discard, []options.KeyGenerateOption{options.Key.Type(options.Ed25519Key)})
+	require.NoError(t, err)
+	conf, err := config.InitWithIdentity(identity)
+	require.NoError(t, err)
+	conf.Datastore.Spec = spec
+	require.NoError(t, serialize.WriteConfigFile(filepath.Join(dir, "config"), conf))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "version"), []byte(fmt.Sprintf("%d\n", ipfs.RepoVersion)), 0o644))
+	return dir, conf
+}
+
+// writeFlatfsBlock writes a block like go-ds-flatfs with the
+// next-to-last/2 shard function
+func writeFlatfsBlock(t *testing.T, dir string, b blocks.Block) {
+	t.Helper()
+	name := dshelp.MultihashToDsKey(b.Cid().Hash()).String()[1:]
+	shard := filepath.Join(dir, name[len(name)-3:len(name)-1])
+	require.NoError(t, os.MkdirAll(shard, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(shard, name+".data"), b.RawData(), 0o644))
+}
+
+func TestMigrateFromFSRepo(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fsrepoPath, conf := testingFSRepo(t, config.DefaultDatastoreConfig().Spec)
+
+	t.Log("fill the fsrepo")
+	blockA, blockB := blocks.NewBlock([]byte("foo")), blocks.NewBlock([]byte("bar"))
+	blocksDir := filepath.Join(fsrepoPath, "blocks")
+	writeFlatfsBlock(t, blocksDir, blockA)
+	writeFlatfsBlock(t, blocksDir, blockB)
+	require.NoError(t, os.WriteFile(filepath.Join(blocksDir, "SHARDING"), []byte("/repo/flatfs/shard/v1/next-to-last/2\n"), 0o644))
+
+	lds, err := leveldb.NewDatastore(filepath.Join(fsrepoPath, "datastore"), nil)
+	require.NoError(t, err)
+	require.NoError(t, lds.Put(ctx, datastore.NewKey("/local/filesroot"), []byte("root")))
+	require.NoError(t, lds.Close())
+
+	ks, err := keystore.NewFSKeystore(filepath.Join(fsrepoPath, "keystore"))
+	require.NoError(t, err)
+	sk, _, err := ci.GenerateEd25519Key(nil)
+	require.NoError(t, err)
+	require.NoError(t, ks.Put("foo", sk))
+
+	require.NoError(t, os.WriteFile(filepath.Join(fsrepoPath, "swarm.key"), []byte("swarm key"), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(fsrepoPath, "api"), []byte("/ip4/127.0.0.1/tcp/5001"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(fsrepoPath, "gateway"), []byte("http://127.0.0.1:8080"), 0o644))
+
+	key := testingKey(t)
+	opts := SQLCipherDatastoreOptions{JournalMode: "WAL"}
+	dbPath := filepath.Join(t.TempDir(), "db.sqlite")
+
+	t.Log("the database must not exist")
+	require.NoError(t, os.WriteFile(dbPath, nil, 0o600))
+	_, err = MigrateFromFSRepo(fsrepoPath, dbPath, key, opts, MigrateOptions{})
+	require.ErrorContains(t, err, "already exists")
+	require.NoError(t, os.Remove(dbPath))
+
+	t.Log("migrate and shred")
+	report, err := MigrateFromFSRepo(fsrepoPath, dbPath, key, opts, MigrateOptions{Shred: true})
+	require.NoError(t, err)
+	require.Equal(t, map[string]int{"/blocks": 2, "/": 1}, report.Entries)
+	require.Equal(t, 1, report.Keys)
+	_, err = os.Stat(fsrepoPath)
+	require.True(t, os.IsNotExist(err))
+
+	r, err := Open(dbPath, key, opts)
+	require.NoError(t, err)
+	defer requireClose(t, r)
+
+	migrated, err := r.Config()
+	require.NoError(t, err)
+	require.Equal(t, conf.Identity, migrated.Identity)
+	require.Equal(t, DefaultDatastoreSpec(), migrated.Datastore.Spec)
+
+	for _, b := range []blocks.Block{blockA, blockB} {
+		got, err := r.(Repo).Blockstore().Get(ctx, b.Cid())
+		require.NoError(t, err)
+		require.Equal(t, b.RawData(), got.RawData())
+	}
+	val, err := r.Datastore().Get(ctx, datastore.NewKey("/local/filesroot"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("root"), val)
+
+	got, err := r.Keystore().Get("foo")
+	require.NoError(t, err)
+	require.True(t, sk.Equals(got))
+	info, err := r.Keystore().(InfoKeystore).GetInfo(ctx, "foo")
+	require.NoError(t, err)
+	require.Equal(t, KeyOriginImported, info.Origin)
+
+	swarmKey, err := r.SwarmKey()
+	require.NoError(t, err)
+	require.Equal(t, []byte("swarm key"), swarmKey)
+	_, err = r.(*encRepo).root.Get(ctx, datastore.NewKey("gateway"))
+	require.NoError(t, err)
+}
+
+func TestMigrateFromFSRepoPebble(t *testing.T) {
+	fsrepoPath, _ := testingFSRepo(t, map[string]interface{}{
+		"type":   "measure",
+		"prefix": "pebble.datastore",
+		"child":  map[string]interface{}{"type": "pebbleds", "path": "pebbleds"},
+	})
+
+	b := blocks.NewBlock([]byte("foo"))
+	db, err := pebble.Open(filepath.Join(fsrepoPath, "pebbleds"), &pebble.Options{Logger: pebbleLogger{}})
+	require.NoError(t, err)
+	require.NoError(t, db.Set([]byte("/local/filesroot"), []byte("root"), nil))
+	require.NoError(t, db.Set([]byte("/blocks"+dshelp.MultihashToDsKey(b.Cid().Hash()).String()), b.RawData(), nil))
+	require.NoError(t, db.Close())
+
+	key := testingKey(t)
+	dbPath := filepath.Join(t.TempDir(), "db.sqlite")
+	report, err := MigrateFromFSRepo(fsrepoPath, dbPath, key, SQLCipherDatastoreOptions{}, MigrateOptions{})
+	require.NoError(t, err)
+	require.Equal(t, map[string]int{"/": 2}, report.Entries)
+
+	t.Log("the fsrepo is kept")
+	_, err = os.Stat(filepath.Join(fsrepoPath, "config"))
+	require.NoError(t, err)
+
+	r, err := Open(dbPath, key, SQLCipherDatastoreOptions{})
+	require.NoError(t, err)
+	defer requireClose(t, r)
+	has, err := r.(Repo).Blockstore().Has(context.Background(), b.Cid())
+	require.NoError(t, err)
+	require.True(t, has)
+}
@@ -0,0 +1,110 @@
+package encrepo
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// ErrRepoOpen is returned by operations that require the repo to be closed.
+var ErrRepoOpen = errors.New("repo is open")
+
+// repoRegistry tracks open repos by path and returns the already open one.
+// It's similar to kubo's repo.OnlyOne but returns the *encRepo itself so
+// that the methods specific to encrypted repos are reachable by callers.
+type repoRegistry struct {
+	mu     sync.Mutex
+	active map[repoKey]*encRepo
+}
+
+// repoKey identifies an open repo, a repo opened read-only is not shared
+// with the read-write one.
+type repoKey struct {
+	path     string
+	readOnly bool
+}
+
+// newRepoKey returns the key of the repo at dbPath, the different spellings
+// of dbPath share it like they share the lock of dbPath
+func newRepoKey(dbPath string, readOnly bool) repoKey {
+	return repoKey{path: lockPath(dbPath), readOnly: readOnly}
+}
+
+func (r *encRepo) key() repoKey {
+	return newRepoKey(r.path, r.readOnly)
+}
+
+// Open a repo identified by dbPath. If the repo is not already open, the
+// open function is called with the lock of dbPath held, and the result is
+// remembered for further use.
+//
+// Call encRepo.Close when done.
+func (o *repoRegistry) Open(dbPath string, opts SQLCipherDatastoreOptions, open func() (*encRepo, error)) (*encRepo, error) {
+	unlock := dbLocks.lock(dbPath)
+	defer unlock()
+
+	key := newRepoKey(dbPath, opts.ReadOnly)
+
+	o.mu.Lock()
+	r, found := o.active[key]
+	if found {
+		r.refs++
+		o.mu.Unlock()
+		return r, nil
+	}
+	o.mu.Unlock()
+
+	// the other repos can be opened meanwhile
+	r, err := open()
+	if err != nil {
+		return nil, err
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.active == nil {
+		o.active = make(map[repoKey]*encRepo)
+	}
+	o.active[key] = r
+	r.refs++
+	return r, nil
+}
+
+// release decrements the reference count of r and reports whether it was
+// the last reference. Caller must hold the lock of r.path.
+func (o *repoRegistry) release(r *encRepo) (bool, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if r.refs == 0 {
+		return false, errors.New("repo is already closed")
+	}
+
+	r.refs--
+	if r.refs > 0 {
+		// others are holding it open
+		return false, nil
+	}
+
+	// last one
+	delete(o.active, r.key())
+	return true, nil
+}
+
+// WithClosed runs fn with the lock of dbPath held, while ensuring that the
+// repo at dbPath is not and cannot be opened in this process, read-write or
+// read-only. It returns ErrRepoOpen if the repo is already open.
+func (o *repoRegistry) WithClosed(dbPath string, fn func() error) error {
+	unlock := dbLocks.lock(dbPath)
+	defer unlock()
+
+	o.mu.Lock()
+	_, found := o.active[newRepoKey(dbPath, false)]
+	_, foundRO := o.active[newRepoKey(dbPath, true)]
+	o.mu.Unlock()
+	if found || foundRO {
+		return ErrRepoOpen
+	}
+
+	return fn()
+}
@@ -2,6 +2,7 @@ package encrepo
 
 import (
 	"context"
+	"os"
 
 	"github.com/ipfs/go-datastore"
 	sync_ds "github.com/ipfs/go-datastore/sync"
@@ -10,39 +11,107 @@ import (
 )
 
 var (
-	onlyOne repo.OnlyOne
+	onlyOne repoRegistry
 )
 
 func Open(dbPath string, key []byte, opts SQLCipherDatastoreOptions) (repo.Repo, error) {
-	fn := func() (repo.Repo, error) {
-		ctx, cancel := context.WithCancel(context.Background())
-		defer cancel()
+	return OpenContext(context.Background(), dbPath, key, opts)
+}
+
+// OpenContext is like Open with a context, the context only applies to the
+// opening of the repo.
+func OpenContext(ctx context.Context, dbPath string, key []byte, opts SQLCipherDatastoreOptions) (repo.Repo, error) {
+	// a duress key replaces the repo with a decoy which is then opened
+	if err := checkDuressKey(ctx, dbPath, key, opts); err != nil {
+		return nil, err
+	}
+
+	fn := func() (*encRepo, error) {
 		return open(ctx, dbPath, key, opts)
 	}
-	return onlyOne.Open(dbPath, fn)
+	return onlyOne.Open(dbPath, opts, fn)
 }
 
-func open(ctx context.Context, dbPath string, key []byte, opts SQLCipherDatastoreOptions) (repo.Repo, error) {
-	packageLock.Lock()
-	defer packageLock.Unlock()
+// open opens the repo at dbPath. Caller must hold the lock of dbPath.
+func open(ctx context.Context, dbPath string, key []byte, opts SQLCipherDatastoreOptions) (r *encRepo, err error) {
+	// don't create the lock files of a missing repo
+	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
+		return nil, errors.Wrap(ErrDatabaseNotFound, "instantiate datastore")
+	}
+
+	// exclude the other processes, the readers only exclude the functions
+	// replacing or removing the database
+	lock := lockRepoFile
+	if opts.ReadOnly {
+		lock = lockRepoReader
+	}
+	fileLock, err := lock(ctx, dbPath, opts.LockTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if r == nil {
+			_ = fileLock.Close()
+		}
+	}()
 
-	uroot, err := OpenSQLCipherDatastore("sqlite3", dbPath, tableName, key, opts)
+	// the repo could have been destroyed while waiting for the lock
+	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
+		return nil, errors.Wrap(ErrDatabaseNotFound, "instantiate datastore")
+	}
+
+	store, err := newSQLCipherStore(ctx, "sqlite3", dbPath, tableName, key, opts)
 	if err != nil {
 		return nil, errors.Wrap(err, "instantiate datastore")
 	}
 
-	root := sync_ds.MutexWrap(uroot)
+	if err := openRepoVersion(ctx, dbPath, store.db, opts); err != nil {
+		_ = store.Close()
+		return nil, err
+	}
+
+	root := sync_ds.MutexWrap(store)
 
 	conf, err := getConfigFromDatastore(ctx, root)
 	if err != nil {
+		_ = root.Close()
 		return nil, errors.Wrap(err, "get config")
 	}
 
+	var spec map[string]interface{}
+	if conf != nil {
+		spec = conf.Datastore.Spec
+	}
+	dsc, err := parseDatastoreSpec(spec)
+	if err != nil {
+		_ = root.Close()
+		return nil, err
+	}
+
+	env := &datastoreEnv{dbPath: dbPath, key: key, opts: opts, root: root, store: store}
+	ds, err := createDatastore(ctx, dsc, env)
+	if err != nil {
+		_ = root.Close()
+		return nil, errors.Wrap(err, "instantiate datastore")
+	}
+
+	var keys datastore.Batching = root
+	if opts.ReadOnly {
+		ds = &readOnlyDatastore{Batching: ds}
+		keys = &readOnlyDatastore{Batching: root}
+	}
+
 	return &encRepo{
-		root:   root,
-		ds:     NewNamespacedDatastore(root, datastore.NewKey("data")),
-		ks:     KeystoreFromDatastore(NewNamespacedDatastore(root, datastore.NewKey("keys"))),
-		config: conf,
-		path:   dbPath,
+		root:     root,
+		store:    store,
+		locks:    env.locks,
+		files:    env.files,
+		ds:       ds,
+		bs:       env.blockstore,
+		ks:       KeystoreFromDatastores(NewNamespacedDatastore(keys, datastore.NewKey("keys")), NewNamespacedDatastore(keys, datastore.NewKey("keys-meta"))),
+		config:   conf,
+		path:     dbPath,
+		readOnly: opts.ReadOnly,
+		fileLock: fileLock,
 	}, nil
 }
@@ -0,0 +1,36 @@
+package encrepo
+
+import (
+	"context"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/pkg/errors"
+)
+
+// ErrReadOnly is returned by the writes to a repo opened with
+// SQLCipherDatastoreOptions.ReadOnly.
+var ErrReadOnly = errors.New("repo is read-only")
+
+// readOnlyDatastore rejects the writes to a datastore, the database also
+// rejects them but with a less helpful error.
+type readOnlyDatastore struct {
+	ds.Batching
+}
+
+var _ ds.PersistentDatastore = (*readOnlyDatastore)(nil)
+
+func (d *readOnlyDatastore) Put(context.Context, ds.Key, []byte) error {
+	return ErrReadOnly
+}
+
+func (d *readOnlyDatastore) Delete(context.Context, ds.Key) error {
+	return ErrReadOnly
+}
+
+func (d *readOnlyDatastore) Batch(context.Context) (ds.Batch, error) {
+	return nil, ErrReadOnly
+}
+
+func (d *readOnlyDatastore) DiskUsage(ctx context.Context) (uint64, error) {
+	return ds.DiskUsage(ctx, d.Batching)
+}
@@ -0,0 +1,60 @@
+package encrepo
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-datastore"
+	config "github.com/ipfs/kubo/config"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadOnly(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	key := testingKey(t)
+	opts := SQLCipherDatastoreOptions{JournalMode: "WAL"}
+	roOpts := SQLCipherDatastoreOptions{ReadOnly: true}
+	dbPath := filepath.Join(t.TempDir(), "db.sqlite")
+	conf := &config.Config{Identity: config.Identity{PeerID: "foo", PrivKey: "bar"}}
+
+	require.NoError(t, Init(dbPath, key, opts, conf))
+
+	t.Log("open a reader while the writer holds the repo")
+	w, err := Open(dbPath, key, opts)
+	require.NoError(t, err)
+	r, err := Open(dbPath, key, roOpts)
+	require.NoError(t, err)
+	defer requireClose(t, r)
+	require.NotSame(t, w, r)
+
+	t.Log("the reader sees the writes")
+	require.NoError(t, w.SetConfigKey("Identity.PeerID", "bar"))
+	require.NoError(t, w.Datastore().Put(ctx, datastore.NewKey("/foo"), []byte("foo")))
+	val, err := r.GetConfigKey("Identity.PeerID")
+	require.NoError(t, err)
+	require.Equal(t, "bar", val)
+	data, err := r.Datastore().Get(ctx, datastore.NewKey("/foo"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("foo"), data)
+
+	t.Log("the writes are rejected")
+	require.ErrorIs(t, r.SetConfig(conf), ErrReadOnly)
+	require.ErrorIs(t, r.SetConfigKey("Identity.PeerID", "baz"), ErrReadOnly)
+	require.ErrorIs(t, r.SetAPIAddr(ma.StringCast("/ip4/127.0.0.1/tcp/5001")), ErrReadOnly)
+	require.ErrorIs(t, r.Datastore().Put(ctx, datastore.NewKey("/bar"), []byte("bar")), ErrReadOnly)
+	require.ErrorIs(t, r.Datastore().Delete(ctx, datastore.NewKey("/foo")), ErrReadOnly)
+	require.ErrorIs(t, r.(Repo).Blockstore().Put(ctx, blocks.NewBlock([]byte("foo"))), ErrReadOnly)
+	require.ErrorIs(t, r.Keystore().Delete("foo"), ErrReadOnly)
+	require.ErrorIs(t, r.(Repo).Rekey(testingKey(t)), ErrReadOnly)
+	_, err = r.(*encRepo).store.db.ExecContext(ctx, "DELETE FROM ipfs")
+	require.Error(t, err)
+
+	t.Log("the reader is an open repo")
+	require.NoError(t, w.Close())
+	require.ErrorIs(t, Rekey(dbPath, key, testingKey(t), opts), ErrRepoOpen)
+}
@@ -0,0 +1,256 @@
+package encrepo
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"time"
+
+	sqlds "github.com/ipfs/go-ds-sql"
+	sqliteds "github.com/ipfs/go-ds-sql/sqlite"
+	"github.com/pkg/errors"
+)
+
+// ErrKeyWrapped is returned when rekeying a repo whose key is wrapped by key
+// slots or derived from a passphrase, they would no longer open it. The
+// secrets of the key slots are changed with AddKeySlot and RemoveKeySlot.
+var ErrKeyWrapped = errors.New("the key of the repo is wrapped by key slots or derived from a passphrase")
+
+// Rekey changes the key of the encrypted database at dbPath from oldKey to
+// newKey, along with the separate database files mounted by its
+// Config.Datastore.Spec. The repo must not be open in this process, nor
+// have key slots or a KDF descriptor, see ErrKeyWrapped.
+//
+// SQLCipher re-encrypts all the pages in a single transaction, so if the
+// operation is interrupted the database is rolled back to oldKey the next
+// time it's opened. Calling Rekey again with the same keys after a
+// successful rekey is a no-op.
+func Rekey(dbPath string, oldKey, newKey []byte, opts SQLCipherDatastoreOptions) error {
+	if len(oldKey) == 0 {
+		return errors.New("missing old key, db is not encrypted")
+	}
+	if len(newKey) == 0 {
+		return errors.New("missing new key")
+	}
+
+	return onlyOne.WithClosed(dbPath, func() error {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		if _, err := os.Stat(dbPath); os.IsNotExist(err) {
+			return ErrDatabaseNotFound
+		}
+
+		fileLock, err := lockRepoExclusive(ctx, dbPath, opts.LockTimeout)
+		if err != nil {
+			return err
+		}
+		defer fileLock.Close()
+
+		if err := checkKeyNotWrapped(dbPath); err != nil {
+			return err
+		}
+		return rekey(ctx, dbPath, oldKey, newKey, opts)
+	})
+}
+
+// Rekey changes the key of the underlying database, see the Rekey function.
+// Datastore operations are blocked until the database is rekeyed. It returns
+// ErrRepoLocked if the repo is open read-only in another process.
+func (r *encRepo) Rekey(newKey []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return errors.New("repo is closed")
+	}
+
+	if r.readOnly {
+		return ErrReadOnly
+	}
+
+	if len(newKey) == 0 {
+		return errors.New("missing new key")
+	}
+
+	if err := checkKeyNotWrapped(r.path); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the readers would read pages being re-encrypted, then hold the old key
+	readers, err := waitLockFile(ctx, r.path, readersLockPath(r.path), true, time.Now())
+	if err != nil {
+		return err
+	}
+	defer readers.Close()
+
+	r.root.Lock()
+	defer r.root.Unlock()
+	for _, l := range r.locks {
+		l.Lock()
+		defer l.Unlock()
+	}
+
+	// the main database is rekeyed last, like in rekey
+	return rekeyDBs(ctx, append(append([]*sqlcipherDB{}, r.files...), r.store.db), newKey)
+}
+
+// checkKeyNotWrapped returns ErrKeyWrapped if the repo at dbPath has key
+// slots or a KDF descriptor
+func checkKeyNotWrapped(dbPath string) error {
+	for _, path := range []string{KeySlotsPath(dbPath), KDFDescriptorPath(dbPath)} {
+		_, err := os.Stat(path)
+		if err == nil {
+			return ErrKeyWrapped
+		}
+		if !os.IsNotExist(err) {
+			return errors.Wrap(err, "stat key material")
+		}
+	}
+	return nil
+}
+
+// rekeyDBs rekeys the databases in order, on failure the already rekeyed
+// databases are rekeyed back to their previous key
+func rekeyDBs(ctx context.Context, dbs []*sqlcipherDB, newKey []byte) error {
+	oldKeys := make([]*secret, 0, len(dbs))
+	defer func() {
+		for _, k := range oldKeys {
+			k.Close()
+		}
+	}()
+
+	for i, db := range dbs {
+		oldKeys = append(oldKeys, db.connector.keyCopy())
+
+		if err := db.rekey(ctx, newKey); err != nil {
+			for j := i - 1; j >= 0; j-- {
+				if rerr := dbs[j].rekey(ctx, oldKeys[j].Bytes()); rerr != nil {
+					return errors.Wrap(rerr, fmt.Sprintf("rollback rekey after: %s", err))
+				}
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// rekey rekeys the database at dbPath and the separate database files
+// mounted by its Config.Datastore.Spec. The separate files are rekeyed
+// first, so an interrupted rekey can be resumed with the same keys.
+func rekey(ctx context.Context, dbPath string, oldKey, newKey []byte, opts SQLCipherDatastoreOptions) error {
+	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
+		return ErrDatabaseNotFound
+	}
+
+	if err := verifyKey(ctx, dbPath, oldKey, opts); err != nil {
+		// a previous rekey may have been interrupted after it was committed
+		if verifyKey(ctx, dbPath, newKey, opts) == nil {
+			return nil
+		}
+		return errors.Wrap(err, "verify old key")
+	}
+
+	db, _, err := openSQLCipherDB(ctx, "sqlite3", dbPath, oldKey, opts)
+	if err != nil {
+		return errors.Wrap(err, "open database")
+	}
+	defer db.Close()
+
+	files, err := specDBFiles(ctx, db, dbPath, opts)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if _, err := os.Stat(f.path); os.IsNotExist(err) {
+			// not created yet
+			continue
+		}
+		if err := rekeyFile(ctx, f.path, oldKey, newKey, f.opts); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("rekey %s", f.path))
+		}
+	}
+
+	return rekeyDB(ctx, db, newKey)
+}
+
+// rekeyFile rekeys a separate database file, it's a no-op if the file is
+// already keyed with newKey
+func rekeyFile(ctx context.Context, path string, oldKey, newKey []byte, opts SQLCipherDatastoreOptions) error {
+	if err := verifyKey(ctx, path, oldKey, opts); err != nil {
+		if verifyKey(ctx, path, newKey, opts) == nil {
+			return nil
+		}
+		return errors.Wrap(err, "verify old key")
+	}
+
+	db, _, err := openSQLCipherDB(ctx, "sqlite3", path, oldKey, opts)
+	if err != nil {
+		return errors.Wrap(err, "open database")
+	}
+	defer db.Close()
+
+	return rekeyDB(ctx, db, newKey)
+}
+
+// specDBFiles returns the separate database files mounted by the
+// Config.Datastore.Spec of the database
+func specDBFiles(ctx context.Context, db *sql.DB, dbPath string, opts SQLCipherDatastoreOptions) ([]dbFile, error) {
+	conf, err := getConfigFromDatastore(ctx, sqlds.NewDatastore(db, sqliteds.NewQueries(tableName)))
+	if err != nil {
+		return nil, errors.Wrap(err, "get config")
+	}
+	if conf == nil {
+		return nil, nil
+	}
+	dsc, err := parseDatastoreSpec(conf.Datastore.Spec)
+	if err != nil {
+		return nil, err
+	}
+	return dsc.dbFiles(dbPath, opts), nil
+}
+
+// verifyKey checks that the database at dbPath can be read with key
+func verifyKey(ctx context.Context, dbPath string, key []byte, opts SQLCipherDatastoreOptions) error {
+	db, _, err := openSQLCipherDB(ctx, "sqlite3", dbPath, key, opts)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return checkReadable(ctx, db)
+}
+
+// checkReadable reads the schema, this fails if the database is keyed with
+// the wrong key
+func checkReadable(ctx context.Context, db queryer) error {
+	var count int
+	if err := db.QueryRowContext(ctx, "SELECT count(*) FROM sqlite_master").Scan(&count); err != nil {
+		return errors.Wrap(err, "read schema")
+	}
+	return nil
+}
+
+func rekeyDB(ctx context.Context, db *sql.DB, newKey []byte) error {
+	if len(newKey) != keyLength {
+		return fmt.Errorf("bad key length, expected %d bytes, got %d", keyLength, len(newKey))
+	}
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return errors.Wrap(err, "get connection")
+	}
+	defer conn.Close()
+
+	q := hexSecret(`PRAGMA rekey = "x'`, newKey, `'"`)
+	defer q.Close()
+	if _, err := conn.ExecContext(ctx, q.String()); err != nil {
+		return errors.Wrap(err, "rekey")
+	}
+
+	return checkReadable(ctx, conn)
+}
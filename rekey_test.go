@@ -0,0 +1,100 @@
+package encrepo
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+	config "github.com/ipfs/kubo/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRekey(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	oldKey := testingKey(t)
+	newKey := testingKey(t)
+	salt := testingSalt(t)
+	opts := SQLCipherDatastoreOptions{PlaintextHeader: true, Salt: salt, JournalMode: "WAL"}
+	dbPath := filepath.Join(t.TempDir(), "db.sqlite")
+
+	require.NoError(t, Init(dbPath, oldKey, opts, &config.Config{}))
+
+	r, err := Open(dbPath, oldKey, opts)
+	require.NoError(t, err)
+	require.NoError(t, r.Datastore().Put(ctx, datastore.NewKey("foo"), []byte("bar")))
+
+	t.Log("refuse to rekey an open repo")
+	require.ErrorIs(t, Rekey(dbPath, oldKey, newKey, opts), ErrRepoOpen)
+	require.NoError(t, r.Close())
+
+	require.NoError(t, Rekey(dbPath, oldKey, newKey, opts))
+
+	t.Log("rekeying twice is a no-op")
+	require.NoError(t, Rekey(dbPath, oldKey, newKey, opts))
+
+	_, err = Open(dbPath, oldKey, opts)
+	require.Error(t, err)
+
+	r, err = Open(dbPath, newKey, opts)
+	require.NoError(t, err)
+	defer requireClose(t, r)
+	val, err := r.Datastore().Get(ctx, datastore.NewKey("foo"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("bar"), val)
+}
+
+func TestRekeyBadOldKey(t *testing.T) {
+	key := testingKey(t)
+	opts := SQLCipherDatastoreOptions{JournalMode: "WAL"}
+	dbPath := filepath.Join(t.TempDir(), "db.sqlite")
+
+	require.NoError(t, Init(dbPath, key, opts, &config.Config{}))
+
+	require.Error(t, Rekey(dbPath, testingKey(t), testingKey(t), opts))
+
+	isInit, err := IsInitialized(dbPath, key, opts)
+	require.NoError(t, err)
+	require.True(t, isInit)
+}
+
+func TestRepoRekey(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	oldKey := testingKey(t)
+	newKey := testingKey(t)
+	salt := testingSalt(t)
+	opts := SQLCipherDatastoreOptions{PlaintextHeader: true, Salt: salt, JournalMode: "WAL"}
+	dbPath := filepath.Join(t.TempDir(), "db.sqlite")
+
+	require.NoError(t, Init(dbPath, oldKey, opts, &config.Config{}))
+
+	r, err := Open(dbPath, oldKey, opts)
+	require.NoError(t, err)
+	require.NoError(t, r.Datastore().Put(ctx, datastore.NewKey("foo"), []byte("bar")))
+
+	er, ok := r.(Repo)
+	require.True(t, ok)
+	require.NoError(t, er.Rekey(newKey))
+
+	t.Log("the open repo is still usable")
+	require.NoError(t, r.Datastore().Put(ctx, datastore.NewKey("baz"), []byte("qux")))
+	val, err := r.Datastore().Get(ctx, datastore.NewKey("foo"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("bar"), val)
+	require.NoError(t, r.Close())
+
+	isInit, err := IsInitialized(dbPath, newKey, opts)
+	require.NoError(t, err)
+	require.True(t, isInit)
+
+	r, err = Open(dbPath, newKey, opts)
+	require.NoError(t, err)
+	defer requireClose(t, r)
+	val, err = r.Datastore().Get(ctx, datastore.NewKey("baz"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("qux"), val)
+}
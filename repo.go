@@ -3,11 +3,16 @@ package encrepo
 import (
 	"context"
 	"fmt"
+	"io"
 	"net"
+	"sync"
 
+	"github.com/ipfs/boxo/blockstore"
 	"github.com/ipfs/boxo/filestore"
 	"github.com/ipfs/boxo/keystore"
+	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-datastore"
+	sync_ds "github.com/ipfs/go-datastore/sync"
 	config "github.com/ipfs/kubo/config"
 	"github.com/ipfs/kubo/repo"
 	"github.com/ipfs/kubo/repo/common"
@@ -17,24 +22,109 @@ import (
 	"github.com/pkg/errors"
 )
 
+// Repo is implemented by the repos returned by Open, it extends repo.Repo
+// with the methods specific to encrypted repos.
+type Repo interface {
+	repo.Repo
+	RepoContext
+
+	// Rekey changes the key of the underlying database, it fails with
+	// ErrRepoLocked while the repo is open read-only in another process.
+	Rekey(newKey []byte) error
+
+	// Blockstore returns a blockstore backed by the blocks of the repo
+	// datastore.
+	Blockstore() blockstore.Blockstore
+
+	// ListConfigBackups returns the identifiers of the backups created by
+	// BackupConfig.
+	ListConfigBackups() ([]string, error)
+	// ReadConfigBackup returns the config backup identified by id.
+	ReadConfigBackup(id string) (*config.Config, error)
+	// RestoreConfigBackup replaces the current configuration with the config
+	// backup identified by id.
+	RestoreConfigBackup(id string) error
+
+	// SetConfigWithInfo is like SetConfig and records info in the config
+	// history.
+	SetConfigWithInfo(updated *config.Config, info ConfigChangeInfo) error
+	// SetConfigKeyWithInfo is like SetConfigKey and records info in the
+	// config history.
+	SetConfigKeyWithInfo(key string, value interface{}, info ConfigChangeInfo) error
+	// ConfigHistory returns the config revisions, oldest first.
+	ConfigHistory() ([]ConfigRevision, error)
+	// ConfigRevision returns the config revision id.
+	ConfigRevision(id uint64) (*ConfigRevision, error)
+	// DiffConfigRevisions returns the config keys changed between the
+	// revisions from and to.
+	DiffConfigRevisions(from, to uint64) ([]ConfigDiff, error)
+	// RollbackConfig atomically replaces the config with the snapshot of the
+	// revision id.
+	RollbackConfig(id uint64, info ConfigChangeInfo) error
+
+	// Verify checks the integrity of the databases and optionally of the
+	// blocks of the repo.
+	Verify(ctx context.Context, opts VerifyOptions) (*VerifyReport, error)
+
+	// Backup writes a consistent snapshot of the repo database at dstPath
+	// while the repo is in use.
+	Backup(ctx context.Context, dstPath string, opts BackupOptions) error
+	// BackupTo is like Backup but writes the snapshot to w.
+	BackupTo(ctx context.Context, w io.Writer, opts BackupOptions) error
+
+	// ExportCAR writes the blocks of the repo, or the DAGs under
+	// opts.Roots, as a CARv2 to w.
+	ExportCAR(ctx context.Context, w io.Writer, opts CARExportOptions) error
+	// ImportCAR puts the blocks of a CAR in the repo and returns its roots.
+	ImportCAR(ctx context.Context, r io.Reader, opts CARImportOptions) ([]cid.Cid, error)
+}
+
+// RepoContext has the variants of the repo.Repo methods that accept a
+// context.
+type RepoContext interface {
+	SetConfigContext(ctx context.Context, updated *config.Config) error
+	SetConfigKeyContext(ctx context.Context, key string, value interface{}) error
+	GetConfigKeyContext(ctx context.Context, key string) (interface{}, error)
+	SetAPIAddrContext(ctx context.Context, addr ma.Multiaddr) error
+	SetGatewayAddrContext(ctx context.Context, addr net.Addr) error
+	SwarmKeyContext(ctx context.Context) ([]byte, error)
+}
+
 type encRepo struct {
-	root   datastore.Datastore
+	// mu guards config and closed, the datastores have their own mutexes
+	mu sync.RWMutex
+
+	root  *sync_ds.MutexDatastore
+	store *sqlcipherStore
+	// locks and files are the mutexes and separate database files of the
+	// datastores mounted by Config.Datastore.Spec
+	locks  []*sync_ds.MutexDatastore
+	files  []*sqlcipherDB
 	ds     repo.Datastore
+	bs     *sqlBlockstore
 	ks     keystore.Keystore
 	config *config.Config
 	path   string
 	closed bool
+	refs   uint32
+	// readOnly rejects the writes with ErrReadOnly
+	readOnly bool
+	// fileLock excludes the other processes until the repo is closed, only
+	// the functions replacing or removing the database if read-only
+	fileLock *repoFileLock
+
+	unregisterRotation func()
 }
 
 func (r *encRepo) Path() string { return r.path }
 
-var _ repo.Repo = (*encRepo)(nil)
+var _ Repo = (*encRepo)(nil)
 
 // Config returns the ipfs configuration file from the repo. Changes made
 // to the returned config are not automatically persisted.
 func (r *encRepo) Config() (*config.Config, error) {
-	packageLock.Lock()
-	defer packageLock.Unlock()
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 
 	if r.closed {
 		return nil, errors.New("cannot access config, repo not open")
@@ -43,21 +133,19 @@ func (r *encRepo) Config() (*config.Config, error) {
 	return r.config, nil
 }
 
-// BackupConfig creates a backup of the current configuration file using
-// the given prefix for naming.
-func (r *encRepo) BackupConfig(prefix string) (string, error) {
-	// Not implemented since the implementation of this in fsrepo makes no sense
-	// The backup file name is randomly generated within the function but not returned, so it's not possible to find the backup file afterwards
-	return "", errors.New("not implemented")
-}
-
 // SetGatewayAddr sets the Gateway address in the repo.
 func (r *encRepo) SetGatewayAddr(addr net.Addr) error {
-	packageLock.Lock()
-	defer packageLock.Unlock()
+	return r.SetGatewayAddrContext(context.Background(), addr)
+}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+// SetGatewayAddrContext is like SetGatewayAddr with a context.
+func (r *encRepo) SetGatewayAddrContext(ctx context.Context, addr net.Addr) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.readOnly {
+		return ErrReadOnly
+	}
 
 	m, err := manet.FromNetAddr(addr)
 	if err != nil {
@@ -79,17 +167,19 @@ func (r *encRepo) SetGatewayAddr(addr net.Addr) error {
 
 // SetConfig persists the given configuration struct to storage.
 func (r *encRepo) SetConfig(updated *config.Config) error {
-	packageLock.Lock()
-	defer packageLock.Unlock()
+	return r.SetConfigContext(context.Background(), updated)
+}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+// SetConfigContext is like SetConfig with a context.
+func (r *encRepo) SetConfigContext(ctx context.Context, updated *config.Config) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 
-	return r.setConfig(ctx, updated)
+	return r.setConfig(ctx, updated, ConfigChangeInfo{})
 }
 
 // SetConfig persists the given configuration struct to storage.
-func (r *encRepo) setConfig(ctx context.Context, updated *config.Config) error {
+func (r *encRepo) setConfig(ctx context.Context, updated *config.Config, info ConfigChangeInfo) error {
 	// to avoid clobbering user-provided keys, must read the config from disk
 	// as a map, write the updated struct values to the map and write the map
 	// to disk.
@@ -112,7 +202,7 @@ func (r *encRepo) setConfig(ctx context.Context, updated *config.Config) error {
 		return err
 	}
 
-	if err := writeConfigToDatastore(ctx, r.root, conf); err != nil {
+	if err := r.commitConfig(ctx, conf, info); err != nil {
 		return err
 	}
 
@@ -123,16 +213,24 @@ func (r *encRepo) setConfig(ctx context.Context, updated *config.Config) error {
 
 // SetConfigKey sets the given key-value pair within the config and persists it to storage.
 func (r *encRepo) SetConfigKey(key string, value interface{}) error {
-	packageLock.Lock()
-	defer packageLock.Unlock()
+	return r.SetConfigKeyContext(context.Background(), key, value)
+}
+
+// SetConfigKeyContext is like SetConfigKey with a context.
+func (r *encRepo) SetConfigKeyContext(ctx context.Context, key string, value interface{}) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.setConfigKey(ctx, key, value, ConfigChangeInfo{})
+}
 
+// setConfigKey sets the given key-value pair within the config and persists it
+// to storage. Caller must hold r.mu.
+func (r *encRepo) setConfigKey(ctx context.Context, key string, value interface{}, info ConfigChangeInfo) error {
 	if r.closed {
 		return errors.New("repo is closed")
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
 	// Load into a map so we don't end up writing any additional defaults to the config file.
 	var mapconf map[string]interface{}
 	if err := readConfigFromDatastore(ctx, r.root, &mapconf); err != nil {
@@ -164,21 +262,23 @@ func (r *encRepo) SetConfigKey(key string, value interface{}) error {
 	}
 
 	// Write config
-	return r.setConfig(ctx, conf)
+	return r.setConfig(ctx, conf, info)
 }
 
 // GetConfigKey reads the value for the given key from the configuration in storage.
 func (r *encRepo) GetConfigKey(key string) (interface{}, error) {
-	packageLock.Lock()
-	defer packageLock.Unlock()
+	return r.GetConfigKeyContext(context.Background(), key)
+}
+
+// GetConfigKeyContext is like GetConfigKey with a context.
+func (r *encRepo) GetConfigKeyContext(ctx context.Context, key string) (interface{}, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 
 	if r.closed {
 		return nil, errors.New("repo is closed")
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
 	var cfg map[string]interface{}
 	if err := readConfigFromDatastore(ctx, r.root, &cfg); err != nil {
 		return nil, err
@@ -196,6 +296,16 @@ func (r *encRepo) GetStorageUsage(ctx context.Context) (uint64, error) {
 	return datastore.DiskUsage(ctx, r.Datastore())
 }
 
+// Blockstore returns a blockstore reading and writing the blocks table
+// mounted at /blocks directly, or a boxo blockstore over the datastore if
+// the blocks are not stored in a blocks table.
+func (r *encRepo) Blockstore() blockstore.Blockstore {
+	if r.bs == nil {
+		return blockstore.NewBlockstore(r.ds)
+	}
+	return r.bs
+}
+
 // Keystore returns a reference to the key management interface.
 func (r *encRepo) Keystore() keystore.Keystore {
 	return r.ks
@@ -208,11 +318,17 @@ func (r *encRepo) FileManager() *filestore.FileManager {
 
 // SetAPIAddr sets the API address in the repo.
 func (r *encRepo) SetAPIAddr(addr ma.Multiaddr) error {
-	packageLock.Lock()
-	defer packageLock.Unlock()
+	return r.SetAPIAddrContext(context.Background(), addr)
+}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+// SetAPIAddrContext is like SetAPIAddr with a context.
+func (r *encRepo) SetAPIAddrContext(ctx context.Context, addr ma.Multiaddr) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.readOnly {
+		return ErrReadOnly
+	}
 
 	bytes, err := addr.MarshalBinary()
 	if err != nil {
@@ -227,8 +343,11 @@ func (r *encRepo) SetAPIAddr(addr ma.Multiaddr) error {
 
 // SwarmKey returns the configured shared symmetric key for the private networks feature.
 func (r *encRepo) SwarmKey() ([]byte, error) {
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	return r.SwarmKeyContext(context.Background())
+}
+
+// SwarmKeyContext is like SwarmKey with a context.
+func (r *encRepo) SwarmKeyContext(ctx context.Context) ([]byte, error) {
 	swarmKey, err := r.root.Get(ctx, datastore.NewKey("swarm.key"))
 	switch err {
 	case nil:
@@ -241,16 +360,38 @@ func (r *encRepo) SwarmKey() ([]byte, error) {
 }
 
 func (r *encRepo) Close() error {
-	packageLock.Lock()
-	defer packageLock.Unlock()
+	// the repo can't be opened again until it's closed
+	defer dbLocks.lock(r.path)()
 
-	if r.closed {
-		return errors.New("repo is already closed")
+	last, err := onlyOne.release(r)
+	if err != nil || !last {
+		return err
+	}
+
+	if r.unregisterRotation != nil {
+		r.unregisterRotation()
 	}
 
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
 	r.closed = true
 
-	return r.root.Close()
+	err = r.ds.Close()
+	for _, db := range r.files {
+		if cerr := db.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if cerr := r.root.Close(); err == nil {
+		err = cerr
+	}
+	if r.fileLock != nil {
+		if cerr := r.fileLock.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
 }
 
 func (r *encRepo) UserResourceOverrides() (rcmgr.PartialLimitConfig, error) {
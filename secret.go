@@ -0,0 +1,77 @@
+package encrepo
+
+import (
+	"encoding/hex"
+	"unsafe"
+)
+
+// secret is a buffer holding key material. Its memory is locked where
+// supported so that it's not swapped out, and it's zeroed when closed.
+type secret struct {
+	b    []byte
+	free func()
+}
+
+// newSecret copies b to a new secret, nil if b is empty. The methods of a
+// nil secret return no data.
+func newSecret(b []byte) *secret {
+	if len(b) == 0 {
+		return nil
+	}
+	s := allocSecret(len(b))
+	copy(s.b, b)
+	return s
+}
+
+// allocSecret returns a zeroed secret of n bytes
+func allocSecret(n int) *secret {
+	if b, free, err := allocLocked(n); err == nil {
+		return &secret{b: b, free: free}
+	}
+	// the memory can't be locked, e.g. over RLIMIT_MEMLOCK
+	return &secret{b: make([]byte, n), free: func() {}}
+}
+
+// hexSecret returns a secret holding prefix, the hex encoding of key and
+// suffix, this builds the statements keying a database without copying the
+// key to the heap
+func hexSecret(prefix string, key []byte, suffix string) *secret {
+	s := allocSecret(len(prefix) + hex.EncodedLen(len(key)) + len(suffix))
+	n := copy(s.b, prefix)
+	n += hex.Encode(s.b[n:], key)
+	copy(s.b[n:], suffix)
+	return s
+}
+
+func (s *secret) Bytes() []byte {
+	if s == nil {
+		return nil
+	}
+	return s.b
+}
+
+func (s *secret) Len() int {
+	return len(s.Bytes())
+}
+
+// String returns the secret as a string without copying it, the string must
+// not be used once the secret is closed.
+func (s *secret) String() string {
+	b := s.Bytes()
+	return unsafe.String(unsafe.SliceData(b), len(b))
+}
+
+// Clone copies the secret.
+func (s *secret) Clone() *secret {
+	return newSecret(s.Bytes())
+}
+
+// Close zeroes and frees the secret, it can be called more than once.
+func (s *secret) Close() {
+	if s == nil || s.b == nil {
+		return
+	}
+	clear(s.b)
+	s.free()
+	s.b = nil
+}
@@ -0,0 +1,11 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+
+package encrepo
+
+import "github.com/pkg/errors"
+
+// the secrets are not locked in memory on this platform
+
+func allocLocked(int) ([]byte, func(), error) {
+	return nil, nil, errors.New("memory locking not supported")
+}
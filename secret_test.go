@@ -0,0 +1,62 @@
+package encrepo
+
+import (
+	"encoding/hex"
+	"path/filepath"
+	"testing"
+
+	config "github.com/ipfs/kubo/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSecret(t *testing.T) {
+	key := testingKey(t)
+	s := newSecret(key)
+	require.Equal(t, key, s.Bytes())
+	key[0] ^= 1
+	require.NotEqual(t, key, s.Bytes(), "the secret is a copy")
+
+	c := s.Clone()
+	require.Equal(t, s.Bytes(), c.Bytes())
+	s.Close()
+	require.Nil(t, s.Bytes())
+	s.Close()
+	require.Len(t, c.Bytes(), keyLength)
+	c.Close()
+
+	var empty *secret
+	require.Nil(t, newSecret(nil))
+	require.Zero(t, empty.Len())
+	require.Empty(t, empty.String())
+	empty.Close()
+
+	h := hexSecret("x'", []byte{0xde, 0xad}, "'")
+	require.Equal(t, "x'dead'", h.String())
+	h.Close()
+}
+
+func TestSecretKeyHandling(t *testing.T) {
+	key := testingKey(t)
+	hexKey := hex.EncodeToString(key)
+	dbPath := filepath.Join(t.TempDir(), "db.sqlite")
+	opts := SQLCipherDatastoreOptions{PlaintextHeader: true, Salt: testingSalt(t)}
+	require.NoError(t, Init(dbPath, key, opts, &config.Config{Datastore: testingDatastoreConfig()}))
+
+	t.Log("the key is not in the errors")
+	wrongOpts := opts
+	wrongOpts.Salt = testingSalt(t)
+	_, err := Open(dbPath, key, wrongOpts)
+	require.Error(t, err)
+	require.NotContains(t, err.Error(), hexKey)
+	_, err = Open(dbPath, testingKey(t), opts)
+	require.Error(t, err)
+
+	t.Log("the key is wiped when the repo is closed")
+	r, err := Open(dbPath, key, opts)
+	require.NoError(t, err)
+	connector := r.(*encRepo).store.db.connector
+	require.True(t, connector.encrypted())
+	require.NoError(t, r.Close())
+	require.False(t, connector.encrypted())
+	require.Nil(t, connector.key)
+}
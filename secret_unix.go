@@ -0,0 +1,21 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package encrepo
+
+import "golang.org/x/sys/unix"
+
+// allocLocked maps n bytes out of the Go heap and locks them in memory
+func allocLocked(n int) ([]byte, func(), error) {
+	b, err := unix.Mmap(-1, 0, n, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_ANON|unix.MAP_PRIVATE)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := unix.Mlock(b); err != nil {
+		_ = unix.Munmap(b)
+		return nil, nil, err
+	}
+	return b, func() {
+		_ = unix.Munlock(b)
+		_ = unix.Munmap(b)
+	}, nil
+}
@@ -0,0 +1,286 @@
+package encrepo
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrTokenClosed    = errors.New("token is closed")
+	ErrTokenBadPIN    = errors.New("bad token pin")
+	ErrTokenNoSuchKey = errors.New("no such key in token")
+	ErrTokenKeyExists = errors.New("key already exists in token")
+)
+
+// softTokenVerifyTag is sealed with the PIN derived key to check the PIN
+var softTokenVerifyTag = []byte("encrepo-softtoken")
+
+// SoftToken is a local stand-in for a PKCS#11 token. It stores labeled keys
+// in a file, wrapped with a key derived from the token PIN, and provides
+// them through KeyProviders.
+type SoftToken struct {
+	path string
+
+	mu        sync.Mutex
+	kek       []byte
+	state     *softTokenState
+	providers map[string]*softTokenKeyProvider
+}
+
+type softTokenState struct {
+	KDF      *KDFDescriptor `json:"kdf"`
+	Nonce    []byte         `json:"nonce"`
+	Verifier []byte         `json:"verifier"`
+	// Objects are the keys by label, wrapped with the PIN derived key
+	Objects map[string]*softTokenObject `json:"objects"`
+}
+
+type softTokenObject struct {
+	Current KeySlot `json:"current"`
+	// Previous is the key replaced by the last rotation
+	Previous *KeySlot `json:"previous,omitempty"`
+}
+
+// OpenSoftToken logs in the token stored at path with pin, the token is
+// created with the given KDF parameters if it does not exist.
+func OpenSoftToken(path string, pin []byte, params KDFParams) (*SoftToken, error) {
+	t := &SoftToken{path: path, providers: make(map[string]*softTokenKeyProvider)}
+
+	b, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(b, &t.state); err != nil {
+			return nil, errors.Wrap(err, "unmarshal token")
+		}
+		if t.state == nil || t.state.KDF == nil {
+			return nil, errors.New("invalid token")
+		}
+		if t.kek, err = t.state.KDF.DeriveKey(pin); err != nil {
+			return nil, errors.Wrap(err, "derive key")
+		}
+		aead, err := newGCM(t.kek)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := aead.Open(nil, t.state.Nonce, t.state.Verifier, softTokenVerifyTag); err != nil {
+			clear(t.kek)
+			return nil, ErrTokenBadPIN
+		}
+	case os.IsNotExist(err):
+		if err := params.validate(); err != nil {
+			return nil, err
+		}
+		t.state = &softTokenState{
+			KDF:     &KDFDescriptor{KDFParams: params, Salt: make([]byte, kdfSaltLength)},
+			Objects: make(map[string]*softTokenObject),
+		}
+		if _, err := rand.Read(t.state.KDF.Salt); err != nil {
+			return nil, errors.Wrap(err, "generate kdf salt")
+		}
+		if t.kek, err = t.state.KDF.DeriveKey(pin); err != nil {
+			return nil, errors.Wrap(err, "derive key")
+		}
+		aead, err := newGCM(t.kek)
+		if err != nil {
+			return nil, err
+		}
+		t.state.Nonce = make([]byte, aead.NonceSize())
+		if _, err := rand.Read(t.state.Nonce); err != nil {
+			return nil, errors.Wrap(err, "generate nonce")
+		}
+		t.state.Verifier = aead.Seal(nil, t.state.Nonce, nil, softTokenVerifyTag)
+		if err := t.save(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.Wrap(err, "read token")
+	}
+
+	return t, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (t *SoftToken) save() error {
+	b, err := json.MarshalIndent(t.state, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "marshal token")
+	}
+	return writeFileAtomic(t.path, b)
+}
+
+// GenerateKey generates a random key labeled label.
+func (t *SoftToken) GenerateKey(label string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.kek == nil {
+		return ErrTokenClosed
+	}
+	if _, ok := t.state.Objects[label]; ok {
+		return ErrTokenKeyExists
+	}
+
+	slot, err := t.newObjectKey(label)
+	if err != nil {
+		return err
+	}
+	t.state.Objects[label] = &softTokenObject{Current: *slot}
+
+	return t.save()
+}
+
+func (t *SoftToken) newObjectKey(label string) (*KeySlot, error) {
+	key := make([]byte, keyLength)
+	defer clear(key)
+	if _, err := rand.Read(key); err != nil {
+		return nil, errors.Wrap(err, "generate key")
+	}
+	return newKeySlot(label, key, t.kek, nil)
+}
+
+// DestroyKey removes the key labeled label.
+func (t *SoftToken) DestroyKey(label string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.kek == nil {
+		return ErrTokenClosed
+	}
+	if _, ok := t.state.Objects[label]; !ok {
+		return ErrTokenNoSuchKey
+	}
+	delete(t.state.Objects, label)
+
+	return t.save()
+}
+
+// RotateKey replaces the key labeled label with a new random key and
+// notifies the rotation callbacks of its providers, e.g. to rekey the repos
+// opened with it. If a callback fails the previous key is restored and the
+// new key is kept as the previous one.
+func (t *SoftToken) RotateKey(ctx context.Context, label string) error {
+	t.mu.Lock()
+	if t.kek == nil {
+		t.mu.Unlock()
+		return ErrTokenClosed
+	}
+	obj, ok := t.state.Objects[label]
+	if !ok {
+		t.mu.Unlock()
+		return ErrTokenNoSuchKey
+	}
+	slot, err := t.newObjectKey(label)
+	if err != nil {
+		t.mu.Unlock()
+		return err
+	}
+	// the new key is saved before being used, so it can't be lost
+	previous := *obj
+	t.state.Objects[label] = &softTokenObject{Current: *slot, Previous: &previous.Current}
+	if err := t.save(); err != nil {
+		t.state.Objects[label] = &previous
+		t.mu.Unlock()
+		return err
+	}
+	p := t.providers[label]
+	t.mu.Unlock()
+
+	if p == nil {
+		return nil
+	}
+
+	if err := p.notifyRotation(ctx); err != nil {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		// keep the new key around, some repos may already be rekeyed with it
+		t.state.Objects[label] = &softTokenObject{Current: previous.Current, Previous: slot}
+		if serr := t.save(); serr != nil {
+			return errors.Wrap(serr, "restore previous key")
+		}
+		return err
+	}
+
+	return nil
+}
+
+// Labels lists the labels of the keys stored in the token.
+func (t *SoftToken) Labels() ([]string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.kek == nil {
+		return nil, ErrTokenClosed
+	}
+	labels := make([]string, 0, len(t.state.Objects))
+	for label := range t.state.Objects {
+		labels = append(labels, label)
+	}
+	return labels, nil
+}
+
+// KeyProvider returns the provider of the key labeled label.
+func (t *SoftToken) KeyProvider(label string) KeyProvider {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p, ok := t.providers[label]
+	if !ok {
+		p = &softTokenKeyProvider{token: t, label: label}
+		t.providers[label] = p
+	}
+	return p
+}
+
+func (t *SoftToken) key(label string) ([]byte, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.kek == nil {
+		return nil, ErrTokenClosed
+	}
+	obj, ok := t.state.Objects[label]
+	if !ok {
+		return nil, ErrTokenNoSuchKey
+	}
+	return obj.Current.unwrap(t.kek)
+}
+
+// Close logs out of the token and wipes the PIN derived key.
+func (t *SoftToken) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	clear(t.kek)
+	t.kek = nil
+	return nil
+}
+
+type softTokenKeyProvider struct {
+	rotationNotifier
+
+	token *SoftToken
+	label string
+}
+
+var _ KeyProvider = (*softTokenKeyProvider)(nil)
+
+func (p *softTokenKeyProvider) Key(context.Context) ([]byte, error) {
+	return p.token.key(p.label)
+}
+
+// Wipe is a noop, the key material is wiped when the token is closed.
+func (p *softTokenKeyProvider) Wipe() {}
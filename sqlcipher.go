@@ -1,10 +1,19 @@
 package encrepo
 
 import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/binary"
 	"encoding/hex"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	sqlds "github.com/ipfs/go-ds-sql"
 	sqliteds "github.com/ipfs/go-ds-sql/sqlite"
@@ -15,79 +24,561 @@ import (
 type SQLCipherDatastoreOptions struct {
 	PlaintextHeader bool
 	Salt            []byte
-	JournalMode     string
+	// JournalMode is the journal_mode pragma: DELETE, TRUNCATE, PERSIST,
+	// MEMORY, WAL or OFF, empty leaves it as is.
+	JournalMode string
+
+	// The SQLCipher settings of the database, they must be the same each
+	// time the database is opened. Zero values are the defaults of
+	// CipherCompatibility. The settings of an encrypted database are stored
+	// next to it, see CipherSettingsPath.
+
+	// CipherCompatibility is the major version of SQLCipher whose defaults are
+	// used, from 1 to 4. Zero is 4.
+	CipherCompatibility int
+	// CipherPageSize is the cipher_page_size pragma, a power of two from 512
+	// to 65536.
+	CipherPageSize int
+	// KDFIter is the kdf_iter pragma, the number of PBKDF2 iterations.
+	KDFIter int
+	// CipherHMACAlgorithm is the cipher_hmac_algorithm pragma: HMAC_SHA1,
+	// HMAC_SHA256 or HMAC_SHA512.
+	CipherHMACAlgorithm string
+	// CipherKDFAlgorithm is the cipher_kdf_algorithm pragma:
+	// PBKDF2_HMAC_SHA1, PBKDF2_HMAC_SHA256 or PBKDF2_HMAC_SHA512.
+	CipherKDFAlgorithm string
+
+	// The connection settings, zero values leave the defaults.
+
+	// CacheSize is the cache_size pragma, a number of pages if positive or
+	// of KiB if negative.
+	CacheSize int
+	// Synchronous is the synchronous pragma: OFF, NORMAL, FULL or EXTRA.
+	Synchronous string
+	// BusyTimeout is the busy_timeout pragma, the driver default is 5s.
+	BusyTimeout time.Duration
+	// MmapSize is the mmap_size pragma, the maximum number of bytes of the
+	// database mapped in memory.
+	MmapSize int64
+	// TempStoreMemory sets the temp_store pragma to MEMORY.
+	TempStoreMemory bool
+
+	// ReadOnly opens the database read-only, the writes to the repo fail with
+	// ErrReadOnly. A read-only repo only excludes the functions replacing or
+	// removing the database, like Rekey or Destroy, so it can be opened while
+	// another process writes to it in WAL mode.
+	ReadOnly bool
+
+	// LockTimeout is how long the repo functions wait for the lock of a repo
+	// held by another process before returning ErrRepoLocked, zero doesn't
+	// wait.
+	LockTimeout time.Duration
+
+	// MigrationBackupPath is where Open backs up the main database before
+	// migrating a repo created by an older version, empty doesn't back it
+	// up. See MigrateRepo.
+	MigrationBackupPath string
 }
 
 func NewSQLiteDatastore(driver, dbPath, table string) (*sqlds.Datastore, error) {
 	return (&sqliteds.Options{Driver: driver, DSN: dbPath, Table: table}).Create()
 }
 
-const saltLength = 16
+const (
+	saltLength = 16
+	keyLength  = 32
+)
 
 func NewSQLCipherDatastore(driver, dbPath, table string, key []byte, opts SQLCipherDatastoreOptions) (*sqlds.Datastore, error) {
-	if !opts.PlaintextHeader { // enabling plaintext header breaks encryption detection
-		if err := checkDBCrypto(dbPath, len(key) != 0); err != nil {
-			return nil, err
+	return NewSQLCipherDatastoreContext(context.Background(), driver, dbPath, table, key, opts)
+}
+
+// NewSQLCipherDatastoreContext is like NewSQLCipherDatastore with a context.
+func NewSQLCipherDatastoreContext(ctx context.Context, driver, dbPath, table string, key []byte, opts SQLCipherDatastoreOptions) (*sqlds.Datastore, error) {
+	store, err := newSQLCipherStore(ctx, driver, dbPath, table, key, opts)
+	if err != nil {
+		return nil, err
+	}
+	return store.Datastore, nil
+}
+
+func OpenSQLCipherDatastore(driver, dbPath, table string, key []byte, opts SQLCipherDatastoreOptions) (*sqlds.Datastore, error) {
+	return OpenSQLCipherDatastoreContext(context.Background(), driver, dbPath, table, key, opts)
+}
+
+// OpenSQLCipherDatastoreContext is like OpenSQLCipherDatastore with a
+// context.
+func OpenSQLCipherDatastoreContext(ctx context.Context, driver, dbPath, table string, key []byte, opts SQLCipherDatastoreOptions) (*sqlds.Datastore, error) {
+	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
+		return nil, ErrDatabaseNotFound
+	}
+
+	return NewSQLCipherDatastoreContext(ctx, driver, dbPath, table, key, opts)
+}
+
+var (
+	ErrDatabaseNotFound = errors.New("database not found")
+)
+
+// sqlcipherStore is a go-ds-sql datastore that keeps a handle on the
+// underlying database so it can be managed (rekeyed, ...) while open.
+type sqlcipherStore struct {
+	*sqlds.Datastore
+	db *sqlcipherDB
+}
+
+func newSQLCipherStore(ctx context.Context, driver, dbPath, table string, key []byte, opts SQLCipherDatastoreOptions) (*sqlcipherStore, error) {
+	db, connector, err := openSQLCipherDB(ctx, driver, dbPath, key, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := createTable(ctx, db, table); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	return &sqlcipherStore{
+		Datastore: sqlds.NewDatastore(db, sqliteds.NewQueries(table)),
+		db:        &sqlcipherDB{DB: db, connector: connector},
+	}, nil
+}
+
+// sqlcipherDB is an open database that can be rekeyed.
+type sqlcipherDB struct {
+	*sql.DB
+	connector *sqlcipherConnector
+}
+
+func createTable(ctx context.Context, db *sql.DB, table string) error {
+	if _, err := db.ExecContext(ctx, fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+			key TEXT PRIMARY KEY,
+			data BLOB
+		) WITHOUT ROWID;
+	`, table)); err != nil {
+		return fmt.Errorf("failed to ensure table exists: %w", err)
+	}
+	return checkTableSchema(ctx, db, table, "key TEXT", "data BLOB")
+}
+
+// checkTableSchema checks that the columns of table are the given "name
+// TYPE" ones, an existing table could have been created by something else
+func checkTableSchema(ctx context.Context, db queryer, table string, columns ...string) error {
+	rows, err := db.QueryContext(ctx, "SELECT name, type FROM pragma_table_info(?) ORDER BY cid", table)
+	if err != nil {
+		return errors.Wrap(err, "read table info")
+	}
+	defer rows.Close()
+
+	found := []string{}
+	for rows.Next() {
+		var name, typ string
+		if err := rows.Scan(&name, &typ); err != nil {
+			return errors.Wrap(err, "read table info")
+		}
+		found = append(found, name+" "+strings.ToUpper(typ))
+	}
+	if err := rows.Err(); err != nil {
+		return errors.Wrap(err, "read table info")
+	}
+
+	if strings.Join(found, ", ") != strings.Join(columns, ", ") {
+		return fmt.Errorf("%w, table %s has columns (%s), expected (%s)", ErrSchemaMismatch, table, strings.Join(found, ", "), strings.Join(columns, ", "))
+	}
+	return nil
+}
+
+// rekey changes the key of the database. The caller must ensure that the
+// database is not used concurrently.
+func (db *sqlcipherDB) rekey(ctx context.Context, newKey []byte) error {
+	if !db.connector.encrypted() {
+		return errors.New("db is not encrypted")
+	}
+
+	if err := rekeyDB(ctx, db.DB, newKey); err != nil {
+		return err
+	}
+
+	db.connector.setKey(newKey)
+
+	// drop the pooled connections, they are still keyed with the old key
+	db.SetMaxIdleConns(0)
+	db.SetMaxIdleConns(defaultMaxIdleConns)
+
+	return nil
+}
+
+// defaultMaxIdleConns is the database/sql default
+const defaultMaxIdleConns = 2
+
+// openSQLCipherDB opens the database at dbPath and checks that it's
+// readable. The cipher settings are checked against the stored ones, and
+// stored if missing.
+func openSQLCipherDB(ctx context.Context, driver, dbPath string, key []byte, opts SQLCipherDatastoreOptions) (*sql.DB, *sqlcipherConnector, error) {
+	if err := opts.validate(); err != nil {
+		return nil, nil, err
+	}
+
+	encrypted := len(key) != 0
+	header, err := checkDBHeader(dbPath, encrypted, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	settings := opts.cipherSettings()
+	storeSettings := false
+	if encrypted {
+		stored, err := readCipherSettings(dbPath)
+		switch {
+		case err == nil:
+			if err := stored.check(settings); err != nil {
+				return nil, nil, err
+			}
+		case os.IsNotExist(errors.Cause(err)):
+			storeSettings = !opts.ReadOnly
+		default:
+			return nil, nil, err
+		}
+	}
+
+	connector, err := newSQLCipherConnector(driver, dbPath, key, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	db := sql.OpenDB(connector)
+	if err := db.PingContext(ctx); err != nil {
+		_ = db.Close()
+		return nil, nil, sqlcipherError(fmt.Errorf("failed to ping database: %w", err), header)
+	}
+
+	// SQLCipher decrypts the pages when they're read, the key is only known
+	// to be right once the schema is read
+	if err := checkReadable(ctx, db); err != nil {
+		_ = db.Close()
+		return nil, nil, sqlcipherError(err, header)
+	}
+
+	if storeSettings {
+		if err := writeCipherSettings(dbPath, settings); err != nil {
+			_ = db.Close()
+			return nil, nil, err
+		}
+	}
+
+	return db, connector, nil
+}
+
+// sqlcipherConnector is a driver.Connector that builds the dsn on each
+// connection, this allows to change the key of an open database.
+type sqlcipherConnector struct {
+	driver driver.Driver
+	dbPath string
+	opts   SQLCipherDatastoreOptions
+
+	muKey sync.RWMutex
+	// key is nil if the database is not encrypted. It's kept in locked
+	// memory until Close, called by encRepo.Close, since each connection
+	// opened by the pool is keyed: the pool replaces the connections closed
+	// when idle, broken or dropped after a rekey.
+	key *secret
+}
+
+var (
+	_ driver.Connector = (*sqlcipherConnector)(nil)
+	_ io.Closer        = (*sqlcipherConnector)(nil)
+)
+
+func newSQLCipherConnector(driverName, dbPath string, key []byte, opts SQLCipherDatastoreOptions) (*sqlcipherConnector, error) {
+	if len(key) != 0 && len(key) != keyLength {
+		return nil, fmt.Errorf("bad key length, expected %d bytes, got %d", keyLength, len(key))
+	}
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
+	// sql.Open does not connect, it's used to lookup the registered driver
+	db, err := sql.Open(driverName, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	drv := db.Driver()
+	if err := db.Close(); err != nil {
+		return nil, err
+	}
+
+	return &sqlcipherConnector{driver: drv, dbPath: dbPath, key: newSecret(key), opts: opts}, nil
+}
+
+func (c *sqlcipherConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	c.muKey.RLock()
+	defer c.muKey.RUnlock()
+
+	var conn driver.Conn
+	var err error
+	if c.key != nil {
+		conn, err = c.openWithCipherDefaults(ctx, c.opts.cipherDefaultPragmas())
+	} else {
+		conn, err = c.open()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := execPragmas(ctx, conn, c.opts.pragmas()); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// cipherDefaultsMu serializes the keyed connections, the SQLCipher defaults
+// are global and a connection is keyed with the defaults of the time
+var cipherDefaultsMu sync.Mutex
+
+// openWithCipherDefaults opens a keyed connection with the given SQLCipher
+// defaults, none leaves the defaults of defaultCipherCompatibility. The
+// driver only supports setting the key and page size before it reads the
+// database, the other cipher settings of the connection are the defaults
+// when the key is set.
+func (c *sqlcipherConnector) openWithCipherDefaults(ctx context.Context, defaults []string) (driver.Conn, error) {
+	cipherDefaultsMu.Lock()
+	defer cipherDefaultsMu.Unlock()
+
+	if len(defaults) == 0 {
+		return c.open()
+	}
+
+	mem, err := c.driver.Open(":memory:")
+	if err != nil {
+		return nil, err
+	}
+	defer mem.Close()
+
+	if err := execPragmas(ctx, mem, defaults); err != nil {
+		return nil, err
+	}
+	conn, err := c.open()
+
+	// restore the defaults for the other connections
+	if rerr := execPragmas(ctx, mem, []string{fmt.Sprintf("PRAGMA cipher_default_compatibility = %d", defaultCipherCompatibility)}); rerr != nil {
+		if err == nil {
+			_ = conn.Close()
+		}
+		return nil, rerr
+	}
+	return conn, err
+}
+
+func execPragmas(ctx context.Context, conn driver.Conn, pragmas []string) error {
+	execer, ok := conn.(driver.ExecerContext)
+	if !ok {
+		return errors.New("driver connection doesn't support exec")
+	}
+	for _, q := range pragmas {
+		if _, err := execer.ExecContext(ctx, q, nil); err != nil {
+			return errors.Wrap(err, q)
 		}
 	}
+	return nil
+}
+
+func (c *sqlcipherConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+func (c *sqlcipherConnector) setKey(key []byte) {
+	c.muKey.Lock()
+	defer c.muKey.Unlock()
+	c.key.Close()
+	c.key = newSecret(key)
+}
+
+// encrypted reports whether the database is keyed
+func (c *sqlcipherConnector) encrypted() bool {
+	c.muKey.RLock()
+	defer c.muKey.RUnlock()
+	return c.key != nil
+}
+
+// keyCopy returns a copy of the key, to be closed by the caller
+func (c *sqlcipherConnector) keyCopy() *secret {
+	c.muKey.RLock()
+	defer c.muKey.RUnlock()
+	return c.key.Clone()
+}
 
+// Close wipes the key, it's called by sql.DB.Close.
+func (c *sqlcipherConnector) Close() error {
+	c.muKey.Lock()
+	defer c.muKey.Unlock()
+	c.key.Close()
+	c.key = nil
+	return nil
+}
+
+// open opens a connection, the caller must hold c.muKey
+func (c *sqlcipherConnector) open() (driver.Conn, error) {
+	dsn := sqlcipherDSN(c.dbPath, c.key.Bytes(), c.opts)
+	defer dsn.Close()
+	return c.driver.Open(dsn.String())
+}
+
+// sqlcipherDSN returns the dsn of the database at dbPath. It holds the key:
+// the driver reads the schema in Open, with PRAGMA synchronous, before a
+// statement can be run on the connection, so the key and the cipher
+// settings must be set by the dsn. The dsn is a secret, the driver parses
+// the key out of it without copying it but formats its PRAGMA key on the
+// heap, this copy is out of our reach.
+func sqlcipherDSN(dbPath string, key []byte, opts SQLCipherDatastoreOptions) *secret {
 	args := []string{}
-	if opts.JournalMode != "" {
-		args = append(args, "_journal_mode="+opts.JournalMode)
+	if opts.ReadOnly {
+		args = append(args, "mode=ro")
 	}
 
 	if opts.PlaintextHeader {
-		if len(opts.Salt) != saltLength {
-			return nil, fmt.Errorf("bad salt, expected %d bytes, got %d", saltLength, len(opts.Salt))
-		}
 		args = append(args, "_pragma_cipher_plaintext_header_size=32")
 		args = append(args, fmt.Sprintf("_pragma_cipher_salt=x'%s'", hex.EncodeToString(opts.Salt)))
 	}
 
+	if len(key) != 0 {
+		args = append(args, fmt.Sprintf("_pragma_cipher_page_size=%d", opts.cipherSettings().PageSize))
+	}
+
 	dsn := dbPath
+	if opts.ReadOnly {
+		// the mode is only supported in URIs
+		dsn = "file:" + sqliteURIPath(dbPath)
+	}
+	if len(key) != 0 {
+		// the page size is set, the key follows it
+		return hexSecret(dsn+"?"+strings.Join(args, "&")+"&_pragma_key=x'", key, "'")
+	}
 	if len(args) != 0 {
 		dsn += "?" + strings.Join(args, "&")
 	}
-
-	return (&sqliteds.Options{Driver: driver, DSN: dsn, Table: table, Key: key}).Create()
+	return newSecret([]byte(dsn))
 }
 
-func OpenSQLCipherDatastore(driver, dbPath, table string, key []byte, opts SQLCipherDatastoreOptions) (*sqlds.Datastore, error) {
-	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
-		return nil, ErrDatabaseNotFound
-	}
-
-	return NewSQLCipherDatastore(driver, dbPath, table, key, opts)
+// sqliteURIPath escapes path for a SQLite file: URI
+func sqliteURIPath(path string) string {
+	return strings.NewReplacer("%", "%25", "?", "%3f", "#", "%23").Replace(filepath.ToSlash(path))
 }
 
-var (
-	ErrDatabaseNotFound = errors.New("database not found")
+// dbHeader is what the header of a database file tells about it
+type dbHeader int
+
+const (
+	// dbHeaderNone is a missing or empty file, the database is created
+	dbHeaderNone dbHeader = iota
+	dbHeaderPlaintext
+	dbHeaderPlaintextHeader
+	dbHeaderEncrypted
 )
 
-func checkDBCrypto(dbPath string, shouldBeEncrypted bool) error {
-	fi, err := os.Stat(dbPath)
+var sqliteMagic = []byte("SQLite format 3\x00")
+
+// sqliteHeaderSize is the size of the header at the start of a SQLite
+// database, see https://www.sqlite.org/fileformat.html#the_database_header
+const sqliteHeaderSize = 100
+
+// readDBHeader reads the header of the database file at dbPath. SQLCipher
+// encrypts it unless the plaintext header is enabled, in which case the
+// reserved bytes at the end of the pages, where SQLCipher stores the IVs and
+// HMACs, are not zero.
+func readDBHeader(dbPath string) (dbHeader, error) {
+	f, err := os.Open(dbPath)
 	if os.IsNotExist(err) {
-		return nil
+		return dbHeaderNone, nil
 	}
 	if err != nil {
-		return errors.Wrap(err, "failed to stat db file at "+dbPath)
+		return 0, errors.Wrap(err, "failed to open db file at "+dbPath)
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to stat db file at "+dbPath)
 	}
 	if fi.IsDir() {
-		return fmt.Errorf("%s is a directory, not a db file", dbPath)
+		return 0, fmt.Errorf("%s is a directory, not a db file", dbPath)
+	}
+	if fi.Size() == 0 {
+		return dbHeaderNone, nil
+	}
+
+	header := make([]byte, sqliteHeaderSize)
+	if _, err := io.ReadFull(f, header); err == io.ErrUnexpectedEOF {
+		return 0, fmt.Errorf("%w: %s is too small", ErrCorrupt, dbPath)
+	} else if err != nil {
+		return 0, errors.Wrap(err, "failed to read db header")
+	}
+
+	if !bytes.Equal(header[:len(sqliteMagic)], sqliteMagic) {
+		return dbHeaderEncrypted, nil
+	}
+
+	pageSize := int64(binary.BigEndian.Uint16(header[16:18]))
+	if pageSize == 1 {
+		pageSize = 65536
+	}
+	if pageSize < 512 || pageSize&(pageSize-1) != 0 {
+		return 0, fmt.Errorf("%w: invalid page size %d", ErrCorrupt, pageSize)
+	}
+	if fi.Size()%pageSize != 0 {
+		return 0, fmt.Errorf("%w: size %d is not a multiple of the page size %d", ErrCorrupt, fi.Size(), pageSize)
 	}
 
-	hasEncryptedDB, err := sqlite3.IsEncrypted(dbPath)
+	if header[20] != 0 {
+		return dbHeaderPlaintextHeader, nil
+	}
+	return dbHeaderPlaintext, nil
+}
+
+// checkDBHeader checks that the database at dbPath is encrypted as the key
+// and options expect
+func checkDBHeader(dbPath string, encrypted bool, opts SQLCipherDatastoreOptions) (dbHeader, error) {
+	header, err := readDBHeader(dbPath)
 	if err != nil {
-		return errors.Wrap(err, "failed to check if db is encrypted")
+		return 0, err
 	}
 
-	if shouldBeEncrypted {
-		if !hasEncryptedDB {
-			return errors.New("key provided while datastore db is NOT encrypted")
-		}
-	} else if hasEncryptedDB {
-		return errors.New("missing key, db is encrypted")
+	switch {
+	case header == dbHeaderNone:
+	case !encrypted && header != dbHeaderPlaintext:
+		return 0, ErrEncryptedNoKey
+	case encrypted && header == dbHeaderPlaintext:
+		return 0, ErrNotEncrypted
+	case header == dbHeaderPlaintextHeader && !opts.PlaintextHeader:
+		return 0, fmt.Errorf("%w, db has a plaintext header", ErrBadSalt)
+	case header == dbHeaderEncrypted && opts.PlaintextHeader:
+		return 0, fmt.Errorf("%w, db has no plaintext header", ErrBadSalt)
 	}
+	return header, nil
+}
 
-	return nil
+// sqlcipherError maps the errors of reading the database to the typed
+// errors. SQLCipher reports the pages it can't decrypt as not a database,
+// but with a plaintext header SQLite reads the header and then fails to
+// parse the schema.
+func sqlcipherError(err error, header dbHeader) error {
+	var serr sqlite3.Error
+	if !errors.As(err, &serr) {
+		return err
+	}
+	switch serr.Code {
+	case sqlite3.ErrError:
+		if header == dbHeaderPlaintextHeader {
+			return fmt.Errorf("%w: %w", ErrWrongKey, err)
+		}
+	case sqlite3.ErrNotADB:
+		if header == dbHeaderPlaintext {
+			return fmt.Errorf("%w: %w", ErrCorrupt, err)
+		}
+		return fmt.Errorf("%w: %w", ErrWrongKey, err)
+	case sqlite3.ErrCorrupt:
+		return fmt.Errorf("%w: %w", ErrCorrupt, err)
+	}
+	return err
 }
@@ -0,0 +1,225 @@
+package encrepo
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/ipfs/boxo/blockstore"
+	"github.com/ipfs/boxo/datastore/dshelp"
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	mh "github.com/multiformats/go-multihash"
+	sqlite3 "github.com/mutecomm/go-sqlcipher/v4"
+	"github.com/pkg/errors"
+)
+
+// VerifyOptions are the options of Verify.
+type VerifyOptions struct {
+	// Blocks re-hashes the blocks under /blocks against their CIDs, this
+	// reads all the blocks.
+	Blocks bool
+}
+
+// VerifyReport is the result of Verify, the repo is intact if OK returns
+// true.
+type VerifyReport struct {
+	// Databases are the reports of the main database then of the separate
+	// database files mounted by Config.Datastore.Spec.
+	Databases []DatabaseReport
+	// BlocksChecked is the number of blocks re-hashed.
+	BlocksChecked int
+	// BadBlocks are the blocks whose data doesn't match their CID.
+	BadBlocks []BadBlock
+}
+
+// DatabaseReport is the result of the integrity checks of a database file.
+type DatabaseReport struct {
+	Path string
+	// BadPages are the pages failing SQLCipher's cipher_integrity_check,
+	// their HMAC doesn't match their content. It's empty for plaintext
+	// databases.
+	BadPages []BadPage
+	// Errors are the errors reported by SQLite's integrity_check.
+	Errors []string
+}
+
+// BadPage is a page of a database that failed its HMAC verification.
+type BadPage struct {
+	// Page is the page number, zero if unknown.
+	Page    int
+	Message string
+}
+
+// BadBlock is a block that failed the re-hash.
+type BadBlock struct {
+	Key ds.Key
+	// Cid is the raw CIDv1 of the block, undefined if the key is not a
+	// multihash.
+	Cid cid.Cid
+	Err error
+}
+
+// OK returns true if no problem was found.
+func (r *VerifyReport) OK() bool {
+	for _, db := range r.Databases {
+		if len(db.BadPages) != 0 || len(db.Errors) != 0 {
+			return false
+		}
+	}
+	return len(r.BadBlocks) == 0
+}
+
+// Verify opens the repo at dbPath and verifies it, see Repo.Verify. A repo
+// that can't be opened returns the error of Open, e.g. ErrCorrupt.
+func Verify(dbPath string, key []byte, opts SQLCipherDatastoreOptions, vopts VerifyOptions) (*VerifyReport, error) {
+	return VerifyContext(context.Background(), dbPath, key, opts, vopts)
+}
+
+// VerifyContext is like Verify with a context.
+func VerifyContext(ctx context.Context, dbPath string, key []byte, opts SQLCipherDatastoreOptions, vopts VerifyOptions) (*VerifyReport, error) {
+	r, err := OpenContext(ctx, dbPath, key, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return r.(Repo).Verify(ctx, vopts)
+}
+
+// Verify runs SQLCipher's cipher_integrity_check and SQLite's
+// integrity_check on the databases of the repo, then re-hashes the blocks
+// if opts.Blocks is set. The problems found are returned in the report, the
+// error is only set if the checks couldn't run.
+func (r *encRepo) Verify(ctx context.Context, opts VerifyOptions) (*VerifyReport, error) {
+	// the databases can't be rekeyed or closed during the checks
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.closed {
+		return nil, errors.New("repo is closed")
+	}
+
+	report := &VerifyReport{}
+	for _, db := range append([]*sqlcipherDB{r.store.db}, r.files...) {
+		dbReport, err := verifyDB(ctx, db)
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("verify %s", db.connector.dbPath))
+		}
+		report.Databases = append(report.Databases, *dbReport)
+	}
+
+	if opts.Blocks {
+		if err := verifyBlocks(ctx, r.ds, report); err != nil {
+			return nil, errors.Wrap(err, "verify blocks")
+		}
+	}
+
+	return report, nil
+}
+
+var badPageRegexp = regexp.MustCompile(`page (\d+)`)
+
+func verifyDB(ctx context.Context, db *sqlcipherDB) (*DatabaseReport, error) {
+	encrypted := db.connector.encrypted()
+
+	report := &DatabaseReport{Path: db.connector.dbPath}
+
+	if encrypted {
+		messages, err := queryStrings(ctx, db.DB, "PRAGMA cipher_integrity_check")
+		if err != nil {
+			return nil, err
+		}
+		for _, msg := range messages {
+			page := BadPage{Message: msg}
+			if m := badPageRegexp.FindStringSubmatch(msg); m != nil {
+				page.Page, _ = strconv.Atoi(m[1])
+			}
+			report.BadPages = append(report.BadPages, page)
+		}
+	}
+
+	messages, err := queryStrings(ctx, db.DB, "PRAGMA integrity_check")
+	var serr sqlite3.Error
+	switch {
+	case err == nil:
+		if len(messages) != 1 || messages[0] != "ok" {
+			report.Errors = messages
+		}
+	case errors.As(err, &serr) && (serr.Code == sqlite3.ErrError || serr.Code == sqlite3.ErrCorrupt || serr.Code == sqlite3.ErrNotADB):
+		// the pages that can't be decrypted abort the check, SQLCipher
+		// reports them as SQL errors
+		report.Errors = []string{err.Error()}
+	default:
+		return nil, err
+	}
+
+	return report, nil
+}
+
+func queryStrings(ctx context.Context, db *sql.DB, q string) ([]string, error) {
+	rows, err := db.QueryContext(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := []string{}
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			return nil, err
+		}
+		res = append(res, s)
+	}
+	return res, rows.Err()
+}
+
+// verifyBlocks re-hashes the blocks under /blocks of d
+func verifyBlocks(ctx context.Context, d ds.Datastore, report *VerifyReport) error {
+	res, err := d.Query(ctx, query.Query{Prefix: blockstore.BlockPrefix.String()})
+	if err != nil {
+		return err
+	}
+	defer res.Close()
+
+	for result := range res.Next() {
+		if result.Error != nil {
+			return result.Error
+		}
+		report.BlocksChecked++
+
+		key := ds.NewKey(result.Key)
+		if err := verifyBlock(key, result.Value); err != nil {
+			bad := BadBlock{Key: key, Err: err}
+			if hash, err := dshelp.BinaryFromDsKey(ds.NewKey(key.BaseNamespace())); err == nil {
+				bad.Cid = cid.NewCidV1(cid.Raw, hash)
+			}
+			report.BadBlocks = append(report.BadBlocks, bad)
+		}
+	}
+	return ctx.Err()
+}
+
+func verifyBlock(key ds.Key, data []byte) error {
+	hash, err := dshelp.BinaryFromDsKey(ds.NewKey(key.BaseNamespace()))
+	if err != nil {
+		return errors.Wrap(err, "invalid block key")
+	}
+	decoded, err := mh.Decode(hash)
+	if err != nil {
+		return errors.Wrap(err, "invalid block multihash")
+	}
+	sum, err := mh.Sum(data, decoded.Code, decoded.Length)
+	if err != nil {
+		return errors.Wrap(err, "hash block")
+	}
+	if !bytes.Equal(sum, hash) {
+		return blockstore.ErrHashMismatch
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package encrepo
+
+import (
+	"context"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ipfs/boxo/blockstore"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	config "github.com/ipfs/kubo/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerify(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	key := testingKey(t)
+	opts := SQLCipherDatastoreOptions{}
+	dbPath := filepath.Join(t.TempDir(), "db.sqlite")
+	require.NoError(t, Init(dbPath, key, opts, &config.Config{}))
+
+	r, err := Open(dbPath, key, opts)
+	require.NoError(t, err)
+	bs := r.(Repo).Blockstore()
+	b1 := blocks.NewBlock([]byte("foo"))
+	b2 := blocks.NewBlock([]byte("bar"))
+	require.NoError(t, bs.PutMany(ctx, []blocks.Block{b1, b2}))
+
+	t.Log("intact repo")
+	report, err := r.(Repo).Verify(ctx, VerifyOptions{Blocks: true})
+	require.NoError(t, err)
+	require.True(t, report.OK())
+	require.Len(t, report.Databases, 1)
+	require.Equal(t, dbPath, report.Databases[0].Path)
+	require.Equal(t, 2, report.BlocksChecked)
+
+	t.Log("block with bad data")
+	_, err = r.(*encRepo).store.db.ExecContext(ctx, "UPDATE blocks SET data = ? WHERE mh = ?", []byte("baz"), b2.Cid().Hash())
+	require.NoError(t, err)
+	report, err = r.(Repo).Verify(ctx, VerifyOptions{Blocks: true})
+	require.NoError(t, err)
+	require.False(t, report.OK())
+	require.Len(t, report.BadBlocks, 1)
+	require.Equal(t, cid.NewCidV1(cid.Raw, b2.Cid().Hash()), report.BadBlocks[0].Cid)
+	require.ErrorIs(t, report.BadBlocks[0].Err, blockstore.ErrHashMismatch)
+
+	t.Log("the blocks are only checked on demand")
+	report, err = r.(Repo).Verify(ctx, VerifyOptions{})
+	require.NoError(t, err)
+	require.True(t, report.OK())
+	require.Zero(t, report.BlocksChecked)
+	require.NoError(t, r.Close())
+}
+
+func TestVerifyBadPage(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	key := testingKey(t)
+	opts := SQLCipherDatastoreOptions{}
+	dbPath := filepath.Join(t.TempDir(), "db.sqlite")
+	require.NoError(t, Init(dbPath, key, opts, &config.Config{}))
+
+	t.Log("add a large block, it's stored at the end of the file")
+	r, err := Open(dbPath, key, opts)
+	require.NoError(t, err)
+	data := make([]byte, 64<<10)
+	_, err = rand.Read(data)
+	require.NoError(t, err)
+	require.NoError(t, r.(Repo).Blockstore().Put(ctx, blocks.NewBlock(data)))
+	require.NoError(t, r.Close())
+
+	report, err := Verify(dbPath, key, opts, VerifyOptions{})
+	require.NoError(t, err)
+	require.True(t, report.OK())
+
+	t.Log("flip a byte of the last page")
+	fi, err := os.Stat(dbPath)
+	require.NoError(t, err)
+	pageSize := int64(opts.cipherSettings().PageSize)
+	lastPage := int(fi.Size() / pageSize)
+	f, err := os.OpenFile(dbPath, os.O_RDWR, 0)
+	require.NoError(t, err)
+	b := make([]byte, 1)
+	_, err = f.ReadAt(b, fi.Size()-pageSize/2)
+	require.NoError(t, err)
+	b[0] ^= 0xff
+	_, err = f.WriteAt(b, fi.Size()-pageSize/2)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	report, err = Verify(dbPath, key, opts, VerifyOptions{})
+	require.NoError(t, err)
+	require.False(t, report.OK())
+	require.Len(t, report.Databases[0].BadPages, 1)
+	require.Equal(t, lastPage, report.Databases[0].BadPages[0].Page)
+	require.NotEmpty(t, report.Databases[0].Errors)
+}
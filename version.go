@@ -0,0 +1,250 @@
+package encrepo
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/pkg/errors"
+)
+
+// RepoVersion is the version of the layout of the repos created by Init,
+// the older repos are migrated when they are opened.
+const RepoVersion = 1
+
+var (
+	// ErrRepoTooNew is returned when a repo was created by a newer version
+	// of this package, the returned error is a *RepoVersionError.
+	ErrRepoTooNew = errors.New("repo version is too new")
+	// ErrRepoNeedsMigration is returned when a repo opened read-only was
+	// created by an older version of this package, the returned error is a
+	// *RepoVersionError.
+	ErrRepoNeedsMigration = errors.New("repo needs a migration")
+)
+
+// RepoVersionError reports the version of a repo that can't be opened.
+type RepoVersionError struct {
+	Path    string
+	Version int
+	// Supported is the RepoVersion of this package
+	Supported int
+}
+
+func (e *RepoVersionError) Error() string {
+	return fmt.Sprintf("repo %s has version %d, expected %d", e.Path, e.Version, e.Supported)
+}
+
+func (e *RepoVersionError) Is(target error) bool {
+	switch target {
+	case ErrRepoTooNew:
+		return e.Version > e.Supported
+	case ErrRepoNeedsMigration:
+		return e.Version < e.Supported
+	default:
+		return false
+	}
+}
+
+// repoVersionKey stores the version of the repo, the repos without it have
+// the version 0
+var repoVersionKey = datastore.NewKey("version")
+
+// repoMigration migrates the main database of a repo to version, in the
+// transaction of tx.
+type repoMigration struct {
+	version     int
+	description string
+	migrate     func(ctx context.Context, tx *sql.Tx) error
+}
+
+// repoMigrations are the migrations by version, the last one is
+// RepoVersion.
+var repoMigrations = []repoMigration{
+	{
+		version:     1,
+		description: "add the repo version",
+		migrate:     func(context.Context, *sql.Tx) error { return nil },
+	},
+}
+
+// RepoMigrationOptions are the options of MigrateRepo.
+type RepoMigrationOptions struct {
+	// DryRun runs the migrations and rolls them back.
+	DryRun bool
+	// BackupPath is where the main database is backed up with the online
+	// backup API before it's migrated, empty doesn't back it up. The backup
+	// can be installed with Restore.
+	BackupPath string
+}
+
+// RepoMigrationInfo describes a migration.
+type RepoMigrationInfo struct {
+	Version     int
+	Description string
+}
+
+// MigrateRepo runs the migrations of the repo at dbPath up to RepoVersion and
+// returns them. The repo must not be open in this process, Open runs them
+// too, with opts.MigrationBackupPath as RepoMigrationOptions.BackupPath.
+//
+// Each migration and the update of the version are made in a transaction of
+// the main database, so a failed migration leaves the repo at the version
+// of the previous one.
+func MigrateRepo(dbPath string, key []byte, opts SQLCipherDatastoreOptions, mopts RepoMigrationOptions) ([]RepoMigrationInfo, error) {
+	opts.ReadOnly = false
+
+	var infos []RepoMigrationInfo
+	err := onlyOne.WithClosed(dbPath, func() error {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		fileLock, err := lockRepoExclusive(ctx, dbPath, opts.LockTimeout)
+		if err != nil {
+			return err
+		}
+		defer fileLock.Close()
+
+		store, err := newSQLCipherStore(ctx, "sqlite3", dbPath, tableName, key, opts)
+		if err != nil {
+			return errors.Wrap(err, "instantiate datastore")
+		}
+		infos, err = migrateRepoDB(ctx, dbPath, store.db, repoMigrations, mopts)
+		if cerr := store.Close(); err == nil && cerr != nil {
+			err = errors.Wrap(cerr, "close datastore")
+		}
+		return err
+	})
+	return infos, err
+}
+
+// openRepoVersion checks the version of the repo being opened and migrates
+// it if it's older
+func openRepoVersion(ctx context.Context, dbPath string, db *sqlcipherDB, opts SQLCipherDatastoreOptions) error {
+	version, initialized, err := readRepoVersion(ctx, db)
+	if err != nil {
+		return err
+	}
+	if !initialized || version == RepoVersion {
+		return nil
+	}
+	if version > RepoVersion || opts.ReadOnly {
+		return &RepoVersionError{Path: dbPath, Version: version, Supported: RepoVersion}
+	}
+
+	_, err = migrateRepoDB(ctx, dbPath, db, repoMigrations, RepoMigrationOptions{BackupPath: opts.MigrationBackupPath})
+	return err
+}
+
+// migrateRepoDB runs the migrations newer than the version of the database
+func migrateRepoDB(ctx context.Context, dbPath string, db *sqlcipherDB, migrations []repoMigration, mopts RepoMigrationOptions) ([]RepoMigrationInfo, error) {
+	version, initialized, err := readRepoVersion(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	if !initialized {
+		return nil, errors.New("repo is not initialized")
+	}
+	latest := migrations[len(migrations)-1].version
+	if version > latest {
+		return nil, &RepoVersionError{Path: dbPath, Version: version, Supported: latest}
+	}
+
+	var pending []repoMigration
+	for _, m := range migrations {
+		if m.version > version {
+			pending = append(pending, m)
+		}
+	}
+	if len(pending) == 0 {
+		return nil, nil
+	}
+
+	if mopts.BackupPath != "" && !mopts.DryRun {
+		if err := backupDBTo(ctx, db, dbPath, mopts.BackupPath, BackupOptions{}); err != nil {
+			return nil, errors.Wrap(err, "backup before migration")
+		}
+	}
+
+	// a dry run applies all the migrations in a single transaction
+	var tx *sql.Tx
+	if mopts.DryRun {
+		if tx, err = db.BeginTx(ctx, nil); err != nil {
+			return nil, errors.Wrap(err, "begin migration")
+		}
+		defer func() { _ = tx.Rollback() }()
+	}
+
+	infos := make([]RepoMigrationInfo, 0, len(pending))
+	for _, m := range pending {
+		if err := applyRepoMigration(ctx, db, tx, m); err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("migrate repo to version %d", m.version))
+		}
+		infos = append(infos, RepoMigrationInfo{Version: m.version, Description: m.description})
+	}
+	return infos, nil
+}
+
+// applyRepoMigration applies m in tx if set, or in its own transaction
+func applyRepoMigration(ctx context.Context, db *sqlcipherDB, tx *sql.Tx, m repoMigration) error {
+	commit := tx == nil
+	if commit {
+		var err error
+		if tx, err = db.BeginTx(ctx, nil); err != nil {
+			return err
+		}
+		defer func() { _ = tx.Rollback() }()
+	}
+
+	if err := m.migrate(ctx, tx); err != nil {
+		return err
+	}
+	query := fmt.Sprintf("INSERT OR REPLACE INTO %s(key, data) VALUES($1, $2)", tableName)
+	if _, err := tx.ExecContext(ctx, query, repoVersionKey.String(), []byte(strconv.Itoa(m.version))); err != nil {
+		return errors.Wrap(err, "put version")
+	}
+
+	if commit {
+		return tx.Commit()
+	}
+	return nil
+}
+
+// readRepoVersion returns the version of the repo, initialized is false if
+// the repo has no config
+func readRepoVersion(ctx context.Context, db queryer) (version int, initialized bool, err error) {
+	query := fmt.Sprintf("SELECT key, data FROM %s WHERE key IN ($1, $2)", tableName)
+	rows, err := db.QueryContext(ctx, query, repoVersionKey.String(), datastore.NewKey(configKey).String())
+	if err != nil {
+		return 0, false, errors.Wrap(err, "get version")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key string
+		var data []byte
+		if err := rows.Scan(&key, &data); err != nil {
+			return 0, false, errors.Wrap(err, "get version")
+		}
+		if key != repoVersionKey.String() {
+			initialized = true
+			continue
+		}
+		if version, err = strconv.Atoi(string(data)); err != nil {
+			return 0, false, errors.Wrap(err, "parse version")
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return 0, false, errors.Wrap(err, "get version")
+	}
+	return version, initialized, nil
+}
+
+// putRepoVersion marks a new repo with RepoVersion
+func putRepoVersion(ctx context.Context, ds datastore.Datastore) error {
+	if err := ds.Put(ctx, repoVersionKey, []byte(strconv.Itoa(RepoVersion))); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("put '%s' in ds", repoVersionKey))
+	}
+	return nil
+}
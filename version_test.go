@@ -0,0 +1,134 @@
+package encrepo
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	config "github.com/ipfs/kubo/config"
+	"github.com/stretchr/testify/require"
+)
+
+// setTestingRepoVersion sets the version of a closed repo, an empty
+// version removes it
+func setTestingRepoVersion(t *testing.T, dbPath string, key []byte, opts SQLCipherDatastoreOptions, version string) {
+	t.Helper()
+	ctx := context.Background()
+	ds, err := OpenSQLCipherDatastore("sqlite3", dbPath, tableName, key, opts)
+	require.NoError(t, err)
+	if version == "" {
+		require.NoError(t, ds.Delete(ctx, repoVersionKey))
+	} else {
+		require.NoError(t, ds.Put(ctx, repoVersionKey, []byte(version)))
+	}
+	require.NoError(t, ds.Close())
+}
+
+func TestRepoVersion(t *testing.T) {
+	ctx := context.Background()
+	key := testingKey(t)
+	opts := SQLCipherDatastoreOptions{}
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "db.sqlite")
+	require.NoError(t, Init(dbPath, key, opts, &config.Config{}))
+
+	r, err := Open(dbPath, key, opts)
+	require.NoError(t, err)
+	version, initialized, err := readRepoVersion(ctx, r.(*encRepo).store.db)
+	require.NoError(t, err)
+	require.True(t, initialized)
+	require.Equal(t, RepoVersion, version)
+	require.NoError(t, r.Close())
+
+	t.Log("a newer repo can't be opened")
+	setTestingRepoVersion(t, dbPath, key, opts, "1000")
+	_, err = Open(dbPath, key, opts)
+	require.ErrorIs(t, err, ErrRepoTooNew)
+	var verr *RepoVersionError
+	require.True(t, errors.As(err, &verr))
+	require.Equal(t, 1000, verr.Version)
+	_, err = MigrateRepo(dbPath, key, opts, RepoMigrationOptions{})
+	require.ErrorIs(t, err, ErrRepoTooNew)
+
+	t.Log("an older repo is migrated when opened")
+	setTestingRepoVersion(t, dbPath, key, opts, "")
+	_, err = Open(dbPath, key, SQLCipherDatastoreOptions{ReadOnly: true})
+	require.ErrorIs(t, err, ErrRepoNeedsMigration)
+
+	infos, err := MigrateRepo(dbPath, key, opts, RepoMigrationOptions{DryRun: true})
+	require.NoError(t, err)
+	require.Len(t, infos, 1)
+	require.Equal(t, RepoVersion, infos[0].Version)
+
+	backupPath := filepath.Join(dir, "backup.sqlite")
+	r, err = Open(dbPath, key, SQLCipherDatastoreOptions{MigrationBackupPath: backupPath})
+	require.NoError(t, err)
+	version, _, err = readRepoVersion(ctx, r.(*encRepo).store.db)
+	require.NoError(t, err)
+	require.Equal(t, RepoVersion, version)
+	require.NoError(t, r.Close())
+
+	backup, _, err := openSQLCipherDB(ctx, "sqlite3", backupPath, key, opts)
+	require.NoError(t, err)
+	defer backup.Close()
+	version, initialized, err = readRepoVersion(ctx, backup)
+	require.NoError(t, err)
+	require.True(t, initialized)
+	require.Zero(t, version, "the backup is not migrated")
+}
+
+func TestRepoMigrations(t *testing.T) {
+	ctx := context.Background()
+	key := testingKey(t)
+	opts := SQLCipherDatastoreOptions{}
+	dbPath := filepath.Join(t.TempDir(), "db.sqlite")
+	require.NoError(t, Init(dbPath, key, opts, &config.Config{}))
+
+	store, err := newSQLCipherStore(ctx, "sqlite3", dbPath, tableName, key, opts)
+	require.NoError(t, err)
+	defer store.Close()
+
+	exec := func(query string) func(context.Context, *sql.Tx) error {
+		return func(ctx context.Context, tx *sql.Tx) error {
+			_, err := tx.ExecContext(ctx, query)
+			return err
+		}
+	}
+	migrations := append(repoMigrations[:len(repoMigrations):len(repoMigrations)],
+		repoMigration{version: 2, description: "create foo", migrate: exec("CREATE TABLE foo (bar TEXT)")},
+		repoMigration{version: 3, description: "fill foo", migrate: exec("INSERT INTO foo VALUES ('bar')")},
+	)
+	hasFoo := func() bool {
+		var count int
+		require.NoError(t, store.db.QueryRowContext(ctx, "SELECT count(*) FROM sqlite_master WHERE name = 'foo'").Scan(&count))
+		return count != 0
+	}
+
+	t.Log("dry run")
+	infos, err := migrateRepoDB(ctx, dbPath, store.db, migrations, RepoMigrationOptions{DryRun: true})
+	require.NoError(t, err)
+	require.Equal(t, []RepoMigrationInfo{{2, "create foo"}, {3, "fill foo"}}, infos)
+	require.False(t, hasFoo())
+	version, _, err := readRepoVersion(ctx, store.db)
+	require.NoError(t, err)
+	require.Equal(t, 1, version)
+
+	t.Log("a failed migration is rolled back")
+	failing := append(migrations[:2:2], repoMigration{version: 3, description: "fail", migrate: exec("INSERT INTO nope VALUES (1)")})
+	_, err = migrateRepoDB(ctx, dbPath, store.db, failing, RepoMigrationOptions{})
+	require.ErrorContains(t, err, "migrate repo to version 3")
+	require.True(t, hasFoo())
+	version, _, err = readRepoVersion(ctx, store.db)
+	require.NoError(t, err)
+	require.Equal(t, 2, version)
+
+	t.Log("resume")
+	infos, err = migrateRepoDB(ctx, dbPath, store.db, migrations, RepoMigrationOptions{})
+	require.NoError(t, err)
+	require.Equal(t, []RepoMigrationInfo{{3, "fill foo"}}, infos)
+	var bar string
+	require.NoError(t, store.db.QueryRowContext(ctx, "SELECT bar FROM foo").Scan(&bar))
+	require.Equal(t, "bar", bar)
+}